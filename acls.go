@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-uuid"
+	"github.com/rboyer/devconsul/consulfunc"
+)
+
+const (
+	// declaredACLDescription marks the policies and roles that come from the
+	// acl block, so that boot only ever deletes ones it created.
+	declaredACLDescription = "declared in devconsul config.hcl"
+
+	// declaredTokenPrefix starts the description of every token from the acl
+	// block. Tokens are looked up by description.
+	declaredTokenPrefix = "config--"
+)
+
+// reservedPolicyNames are the policies boot creates for itself. The agent--
+// and mesh-gateway roles are reserved too.
+var reservedPolicyNames = []string{
+	"global-management",
+	"anonymous",
+	"cross-ns-catalog-read",
+	replicationName,
+	meshGatewayName,
+}
+
+func parseDeclaredACLs(uc *userConfigACL) ([]*api.ACLPolicy, []*api.ACLRole, []*api.ACLToken, error) {
+	var (
+		policies []*api.ACLPolicy
+		roles    []*api.ACLRole
+		tokens   []*api.ACLToken
+	)
+
+	seen := make(map[string]struct{})
+	for _, p := range uc.Policies {
+		if _, ok := seen[p.Name]; ok {
+			return nil, nil, nil, fmt.Errorf("acl policy %q is defined more than once", p.Name)
+		}
+		seen[p.Name] = struct{}{}
+
+		if stringSliceContains(reservedPolicyNames, p.Name) || strings.HasPrefix(p.Name, "agent--") {
+			return nil, nil, nil, fmt.Errorf("acl policy %q is reserved for devconsul", p.Name)
+		}
+		if strings.TrimSpace(p.Rules) == "" {
+			return nil, nil, nil, fmt.Errorf("acl policy %q has no rules", p.Name)
+		}
+
+		policies = append(policies, &api.ACLPolicy{
+			Name:        p.Name,
+			Description: declaredACLDescription,
+			Rules:       p.Rules,
+			Datacenters: p.Datacenters,
+		})
+	}
+
+	seen = make(map[string]struct{})
+	for _, r := range uc.Roles {
+		if _, ok := seen[r.Name]; ok {
+			return nil, nil, nil, fmt.Errorf("acl role %q is defined more than once", r.Name)
+		}
+		seen[r.Name] = struct{}{}
+
+		if r.Name == meshGatewayName || strings.HasPrefix(r.Name, "agent--") {
+			return nil, nil, nil, fmt.Errorf("acl role %q is reserved for devconsul", r.Name)
+		}
+
+		role := &api.ACLRole{
+			Name:        r.Name,
+			Description: declaredACLDescription,
+		}
+		for _, name := range r.Policies {
+			role.Policies = append(role.Policies, &api.ACLRolePolicyLink{Name: name})
+		}
+		for _, name := range r.ServiceIdentities {
+			role.ServiceIdentities = append(role.ServiceIdentities, &api.ACLServiceIdentity{ServiceName: name})
+		}
+		roles = append(roles, role)
+	}
+
+	seen = make(map[string]struct{})
+	for _, t := range uc.Tokens {
+		if _, ok := seen[t.Name]; ok {
+			return nil, nil, nil, fmt.Errorf("acl token %q is defined more than once", t.Name)
+		}
+		seen[t.Name] = struct{}{}
+
+		if t.SecretID != "" {
+			if _, err := uuid.ParseUUID(t.SecretID); err != nil {
+				return nil, nil, nil, fmt.Errorf("acl token %q has an invalid secret_id: %v", t.Name, err)
+			}
+		}
+
+		token := &api.ACLToken{
+			Description: declaredTokenPrefix + t.Name,
+			SecretID:    t.SecretID,
+			Local:       t.Local,
+		}
+		for _, name := range t.Policies {
+			token.Policies = append(token.Policies, &api.ACLTokenPolicyLink{Name: name})
+		}
+		for _, name := range t.Roles {
+			token.Roles = append(token.Roles, &api.ACLTokenRoleLink{Name: name})
+		}
+		for _, name := range t.ServiceIdentities {
+			token.ServiceIdentities = append(token.ServiceIdentities, &api.ACLServiceIdentity{ServiceName: name})
+		}
+		tokens = append(tokens, token)
+	}
+
+	return policies, roles, tokens, nil
+}
+
+// reconcileDeclaredACLs makes the policies, roles and tokens from the acl
+// block exist, and deletes any that were declared before but no longer are.
+func (c *Core) reconcileDeclaredACLs() error {
+	client := c.primaryClient()
+
+	for _, p := range c.config.ACLPolicies {
+		p := *p
+		if _, err := consulfunc.CreateOrUpdatePolicy(client, &p); err != nil {
+			return fmt.Errorf("acl policy %q: %v", p.Name, err)
+		}
+		c.logger.Info("declared acl policy", "name", p.Name)
+	}
+
+	for _, r := range c.config.ACLRoles {
+		r := *r
+		if _, err := consulfunc.CreateOrUpdateRole(client, &r); err != nil {
+			return fmt.Errorf("acl role %q: %v", r.Name, err)
+		}
+		c.logger.Info("declared acl role", "name", r.Name)
+	}
+
+	for _, t := range c.config.ACLTokens {
+		t := *t
+		token, err := c.createOrUpdateDeclaredToken(client, &t)
+		if err != nil {
+			return fmt.Errorf("acl token %q: %v", strings.TrimPrefix(t.Description, declaredTokenPrefix), err)
+		}
+		name := strings.TrimPrefix(token.Description, declaredTokenPrefix)
+		c.logger.Info("declared acl token", append([]interface{}{"name", name},
+			c.tokenLogArgs(token.AccessorID, token.SecretID)...)...)
+		if err := c.recordToken(newTokenRecord("config", name, PrimaryDC, token)); err != nil {
+			return err
+		}
+	}
+
+	return c.pruneDeclaredACLs(client)
+}
+
+// createOrUpdateDeclaredToken is CreateOrUpdateToken, except a secret_id
+// that changed in config replaces the token instead of being ignored.
+func (c *Core) createOrUpdateDeclaredToken(client *api.Client, t *api.ACLToken) (*api.ACLToken, error) {
+	if t.SecretID != "" {
+		current, err := consulfunc.GetTokenByDescription(client, t.Description)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil && current.SecretID != t.SecretID {
+			if _, err := client.ACL().TokenDelete(current.AccessorID, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return consulfunc.CreateOrUpdateToken(client, t)
+}
+
+// staleACLs holds what boot created from config.hcl that is no longer
+// declared there, keyed by token description or role and policy name.
+type staleACLs struct {
+	Tokens   map[string]string
+	Roles    map[string]string
+	Policies map[string]string
+}
+
+func (c *Core) findStaleDeclaredACLs(client *api.Client) (*staleACLs, error) {
+	var (
+		ac  = client.ACL()
+		out = &staleACLs{
+			Tokens:   make(map[string]string),
+			Roles:    make(map[string]string),
+			Policies: make(map[string]string),
+		}
+	)
+
+	tokenDescs := make(map[string]struct{})
+	for _, t := range c.config.ACLTokens {
+		tokenDescs[t.Description] = struct{}{}
+	}
+	tokens, err := consulfunc.ListExistingTokenAccessorsByDescription(client)
+	if err != nil {
+		return nil, err
+	}
+	for desc, accessorID := range tokens {
+		if _, ok := tokenDescs[desc]; ok || !strings.HasPrefix(desc, declaredTokenPrefix) {
+			continue
+		}
+		out.Tokens[desc] = accessorID
+	}
+
+	roleNames := make(map[string]struct{})
+	for _, r := range c.config.ACLRoles {
+		roleNames[r.Name] = struct{}{}
+	}
+	roles, _, err := ac.RoleList(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range roles {
+		if _, ok := roleNames[r.Name]; ok || r.Description != declaredACLDescription {
+			continue
+		}
+		out.Roles[r.Name] = r.ID
+	}
+
+	policyNames := make(map[string]struct{})
+	for _, p := range c.config.ACLPolicies {
+		policyNames[p.Name] = struct{}{}
+	}
+	policies, _, err := ac.PolicyList(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		if _, ok := policyNames[p.Name]; ok || p.Description != declaredACLDescription {
+			continue
+		}
+		out.Policies[p.Name] = p.ID
+	}
+
+	return out, nil
+}
+
+func (c *Core) pruneDeclaredACLs(client *api.Client) error {
+	ac := client.ACL()
+
+	stale, err := c.findStaleDeclaredACLs(client)
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range sortedKeys(stale.Tokens) {
+		if _, err := ac.TokenDelete(stale.Tokens[desc], nil); err != nil {
+			return err
+		}
+		c.logger.Info("deleted acl token", "name", strings.TrimPrefix(desc, declaredTokenPrefix))
+	}
+	for _, name := range sortedKeys(stale.Roles) {
+		if _, err := ac.RoleDelete(stale.Roles[name], nil); err != nil {
+			return err
+		}
+		c.logger.Info("deleted acl role", "name", name)
+	}
+	for _, name := range sortedKeys(stale.Policies) {
+		if _, err := ac.PolicyDelete(stale.Policies[name], nil); err != nil {
+			return err
+		}
+		c.logger.Info("deleted acl policy", "name", name)
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeclaredACLs_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"duplicate policy": `policy "a" { rules = "x" } policy "a" { rules = "y" }`,
+		"reserved policy":  `policy "anonymous" { rules = "x" }`,
+		"agent policy":     `policy "agent--dc1-client1" { rules = "x" }`,
+		"empty rules":      `policy "a" { rules = " " }`,
+		"duplicate role":   `role "a" {} role "a" {}`,
+		"duplicate token":  `token "a" {} token "a" {}`,
+		"bad secret":       `token "a" { secret_id = "hunter2" }`,
+	}
+	for name, acl := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := parseConfigPartial([]byte(`acl {` + acl + `}`))
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+)
+
+const (
+	autoConfigIssuer   = "devconsul"
+	autoConfigAudience = "devconsul"
+	autoConfigValidity = 10 * 365 * 24 * time.Hour
+)
+
+// initClientTLS generates whatever secrets the client agents need up front for
+// the configured client_tls mode.
+func (c *Core) initClientTLS() error {
+	switch c.config.ClientTLS {
+	case ClientTLSAutoEncrypt:
+		// With auto_encrypt a client has to make an authorized RPC before it
+		// will start serving HTTP, so the agent token we would otherwise
+		// inject later has to be baked into its config instead.
+		c.config.PresetAgentTokens = make(map[string]string)
+		return c.topology.Walk(func(node *Node) error {
+			if node.Server {
+				return nil
+			}
+			secretID, err := c.loadOrSaveCacheValue("agent-token--"+node.Name, func() (string, error) {
+				return uuid.GenerateUUID()
+			})
+			if err != nil {
+				return err
+			}
+			c.config.PresetAgentTokens[node.Name] = secretID
+			return nil
+		})
+
+	case ClientTLSAutoConfig:
+		signingKeyPEM, err := c.loadOrSaveCacheValue("auto-config-signing-key", func() (string, error) {
+			signer, err := generatePrivateKey("ec", 256)
+			if err != nil {
+				return "", err
+			}
+			return encodePrivateKey(signer)
+		})
+		if err != nil {
+			return err
+		}
+
+		signer, err := parsePrivateKey(signingKeyPEM)
+		if err != nil {
+			return fmt.Errorf("error parsing auto_config signing key: %v", err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(signer.Public())
+		if err != nil {
+			return err
+		}
+		c.config.AutoConfigPublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+		c.config.AutoConfigIntroTokens = make(map[string]string)
+		return c.topology.Walk(func(node *Node) error {
+			if node.Server {
+				return nil
+			}
+			jwt, err := c.loadOrSaveCacheValue("auto-config-intro-token--"+node.Name, func() (string, error) {
+				return mintIntroToken(signer, node.Name+"-pod", time.Now())
+			})
+			if err != nil {
+				return err
+			}
+			c.config.AutoConfigIntroTokens[node.Name] = jwt
+			return nil
+		})
+
+	default:
+		return nil
+	}
+}
+
+// mintIntroToken creates an ES256 JWT that the servers' static auto_config
+// authorizer will accept for the given node name.
+func mintIntroToken(signer crypto.Signer, nodeName string, now time.Time) (string, error) {
+	key, ok := signer.(*ecdsa.PrivateKey)
+	if !ok || key.Curve.Params().BitSize != 256 {
+		return "", fmt.Errorf("intro tokens must be signed with a P-256 key")
+	}
+
+	header := map[string]interface{}{
+		"alg": "ES256",
+		"typ": "JWT",
+	}
+	claims := map[string]interface{}{
+		"iss":  autoConfigIssuer,
+		"aud":  []string{autoConfigAudience},
+		"sub":  nodeName,
+		"node": nodeName,
+		"iat":  now.Unix(),
+		"nbf":  now.Add(-time.Minute).Unix(),
+		"exp":  now.Add(autoConfigValidity).Unix(),
+	}
+
+	var signingInput string
+	for i, part := range []interface{}{header, claims} {
+		b, err := json.Marshal(part)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 {
+			signingInput += "."
+		}
+		signingInput += base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JWS wants the raw fixed-width r||s rather than DER.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
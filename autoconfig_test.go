@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rboyer/devconsul/cachestore"
+)
+
+func TestMintIntroToken(t *testing.T) {
+	signer, err := generatePrivateKey("ec", 256)
+	require.NoError(t, err)
+
+	now := time.Unix(1600000000, 0)
+	jwt, err := mintIntroToken(signer, "dc1-client1-pod", now)
+	require.NoError(t, err)
+
+	parts := strings.Split(jwt, ".")
+	require.Len(t, parts, 3)
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	require.Len(t, sig, 64)
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	require.True(t, ecdsa.Verify(signer.Public().(*ecdsa.PublicKey), digest[:], r, s))
+
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	var claims map[string]interface{}
+	require.NoError(t, json.Unmarshal(raw, &claims))
+
+	require.Equal(t, "devconsul", claims["iss"])
+	require.Equal(t, []interface{}{"devconsul"}, claims["aud"])
+	require.Equal(t, "dc1-client1-pod", claims["node"])
+	require.Equal(t, float64(1600000000), claims["iat"])
+
+	rsaSigner, err := generatePrivateKey("rsa", 2048)
+	require.NoError(t, err)
+	_, err = mintIntroToken(rsaSigner, "dc1-client1-pod", now)
+	require.Error(t, err)
+}
+
+func TestAgentHCL_ClientTLS(t *testing.T) {
+	for _, mode := range []string{ClientTLSStatic, ClientTLSAutoEncrypt, ClientTLSAutoConfig} {
+		mode := mode
+		t.Run(mode, func(t *testing.T) {
+			cfg, topo, err := parseConfig([]byte(`
+				security {
+					encryption {
+						tls = true
+					}
+					client_tls = "` + mode + `"
+				}
+			`))
+			require.NoError(t, err)
+
+			cacheDir, err := ioutil.TempDir("", "devconsul-cache")
+			require.NoError(t, err)
+			defer os.RemoveAll(cacheDir)
+
+			cache, err := cachestore.New(cacheDir)
+			require.NoError(t, err)
+
+			c := &Core{
+				logger:   hclog.NewNullLogger(),
+				cache:    cache,
+				config:   cfg,
+				topology: topo,
+			}
+			require.NoError(t, c.initClientTLS())
+
+			serverHCL, err := c.generateAgentHCL(topo.Node("dc1-server1"))
+			require.NoError(t, err)
+			clientHCL, err := c.generateAgentHCL(topo.Node("dc1-client1"))
+			require.NoError(t, err)
+
+			for _, body := range []string{serverHCL, clientHCL} {
+				_, diags := hclsyntax.ParseConfig([]byte(body), "agent.hcl", hcl.Pos{Line: 1, Column: 1})
+				for _, diag := range diags {
+					// consul tolerates the duplicated client_addr
+					if diag.Summary != "Attribute redefined" {
+						t.Fatalf("invalid agent HCL: %v", diag)
+					}
+				}
+			}
+
+			// ignore alignment
+			serverHCL = strings.Join(strings.Fields(serverHCL), " ")
+			clientHCL = strings.Join(strings.Fields(clientHCL), " ")
+
+			require.Contains(t, serverHCL, `cert_file = "/tls/dc1-server-consul-0.pem"`)
+			require.Contains(t, clientHCL, `ca_file = "/tls/consul-agent-ca.pem"`)
+
+			switch mode {
+			case ClientTLSStatic:
+				require.Contains(t, clientHCL, `cert_file = "/tls/dc1-client-consul-0.pem"`)
+				require.NotContains(t, serverHCL, "auto_encrypt")
+				require.NotContains(t, serverHCL, "auto_config")
+				require.NotContains(t, clientHCL, "auto_encrypt")
+				require.NotContains(t, clientHCL, "auto_config")
+			case ClientTLSAutoEncrypt:
+				require.NotContains(t, clientHCL, "cert_file")
+				require.Contains(t, serverHCL, "allow_tls = true")
+				require.Contains(t, clientHCL, "tls = true")
+				require.Contains(t, clientHCL, `agent = "`+cfg.PresetAgentTokens["dc1-client1"]+`"`)
+			case ClientTLSAutoConfig:
+				require.NotContains(t, clientHCL, "cert_file")
+				require.Contains(t, serverHCL, "BEGIN PUBLIC KEY")
+				require.Contains(t, serverHCL, `"value.node_name == \"${node}\""`)
+				require.Contains(t, clientHCL, `intro_token = "`+cfg.AutoConfigIntroTokens["dc1-client1"]+`"`)
+				require.Contains(t, clientHCL, `server_addresses = ["10.0.1.11"]`)
+			}
+		})
+	}
+}
+
+func TestDesiredACLs_AutoConfigSkipsClients(t *testing.T) {
+	for _, mode := range []string{ClientTLSStatic, ClientTLSAutoConfig} {
+		mode := mode
+		t.Run(mode, func(t *testing.T) {
+			cfg, topo, err := parseConfig([]byte(`
+				security {
+					encryption {
+						tls = true
+					}
+					client_tls = "` + mode + `"
+				}
+			`))
+			require.NoError(t, err)
+
+			c := &Core{config: cfg, topology: topo}
+
+			roles := make(map[string]bool)
+			for _, r := range c.desiredACLRoles() {
+				roles[r.Name] = true
+			}
+			tokens := make(map[string]bool)
+			for _, tok := range c.desiredACLTokens() {
+				tokens[tok.Description] = true
+			}
+
+			topo.WalkSilent(func(n *Node) {
+				want := n.Server || mode == ClientTLSStatic
+				require.Equal(t, want, roles["agent--"+n.Name], n.Name)
+				require.Equal(t, want, tokens[n.TokenName()], n.Name)
+			})
+		})
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -14,13 +18,30 @@ import (
 type BootInfo struct {
 	primaryOnly bool
 
+	// parallelism bounds how many nodes are talked to at once.
+	parallelism int
+	limiter     chan struct{}
+
+	// ctx ends when boot times out or is interrupted, and every wait loop
+	// gives up when it does.
+	ctx         context.Context
+	bootTimeout time.Duration
+	progress    *bootProgress
+
+	// logSecrets logs the secret of each token as well as its accessor.
+	logSecrets bool
+
 	masterToken         string
 	clients             map[string]*api.Client
 	replicationSecretID string
 
-	tokens map[string]string
-
+	// bootMu guards everything below, which is written to by concurrent
+	// per-node and per-datacenter work.
+	bootMu       sync.Mutex
+	tokens       map[string]string
 	upgradedACLs map[string]map[string]struct{}
+	registry     map[string]*tokenRecord
+	registrySeen map[string]struct{}
 }
 
 func (c *Core) runBoot(primaryOnly bool) error {
@@ -34,8 +55,26 @@ func (c *Core) runBoot(primaryOnly bool) error {
 		c.logger.Info("only bootstrapping the primary datacenter", "dc", PrimaryDC)
 	}
 
+	stop := c.startBoot()
+	defer stop()
+
+	if err := c.loadTokenRegistry(); err != nil {
+		return err
+	}
+	if err := c.recordStaticTokens(); err != nil {
+		return err
+	}
+
 	var err error
 
+	if c.config.VaultEnabled {
+		c.progress.setPhase("vault")
+		if err := c.initVault(); err != nil {
+			return fmt.Errorf("initVault: %v", err)
+		}
+	}
+
+	var dcs []Datacenter
 	c.clients = make(map[string]*api.Client)
 	for _, dc := range c.topology.Datacenters() {
 		if c.primaryOnly && !dc.Primary {
@@ -45,10 +84,18 @@ func (c *Core) runBoot(primaryOnly bool) error {
 		if err != nil {
 			return fmt.Errorf("error creating initial bootstrap client for dc=%s: %v", dc.Name, err)
 		}
+		dcs = append(dcs, dc)
+	}
 
-		c.waitForLeader(dc.Name)
+	c.progress.setPhase("leaders")
+	err = c.eachDatacenter(dcs, func(dc Datacenter) error {
+		return c.waitForLeader(dc.Name)
+	})
+	if err != nil {
+		return err
 	}
 
+	c.progress.setPhase("bootstrap")
 	if err := c.bootstrap(c.primaryClient()); err != nil {
 		return fmt.Errorf("bootstrap: %v", err)
 	}
@@ -69,6 +116,22 @@ func (c *Core) runBoot(primaryOnly bool) error {
 		}
 	}
 
+	c.progress.setPhase("fixtures")
+	if err := c.seedFixtures(); err != nil {
+		return fmt.Errorf("seedFixtures: %v", err)
+	}
+
+	if c.config.VaultEnabled {
+		c.progress.setPhase("vault ca")
+		if err := c.verifyVaultCA(); err != nil {
+			return fmt.Errorf("verifyVaultCA: %v", err)
+		}
+	}
+
+	if err := c.pruneTokenRegistry(); err != nil {
+		return err
+	}
+
 	if err := c.cache.SaveValue("ready", "1"); err != nil {
 		return err
 	}
@@ -76,36 +139,40 @@ func (c *Core) runBoot(primaryOnly bool) error {
 	return nil
 }
 
-func (c *Core) waitForKV(fromDC, toDC string) {
+func (c *Core) waitForKV(fromDC, toDC string) error {
 	client := c.clients[fromDC]
 
-	for {
+	return c.retryUntil("kv "+fromDC+"->"+toDC, func() (bool, error) {
 		_, err := client.KV().Put(&api.KVPair{
 			Key:   "test-from-" + fromDC + "-to-" + toDC,
 			Value: []byte("payload-for-" + fromDC + "-to-" + toDC),
-		}, &api.WriteOptions{
+		}, (&api.WriteOptions{
 			Datacenter: toDC,
-		})
+		}).WithContext(c.bootContext()))
 
 		if err == nil {
 			c.logger.Info("kv write success",
 				"from_dc", fromDC, "to_dc", toDC,
 			)
-			return
+			return true, nil
 		}
 
 		c.logger.Warn("kv write failed; wan not converged yet",
 			"from_dc", fromDC, "to_dc", toDC,
 		)
-		time.Sleep(500 * time.Millisecond)
-	}
+		return false, nil
+	})
 }
 
 func (c *Core) initPrimaryDC() error {
 	var err error
 
-	c.waitForUpgrade(PrimaryDC)
+	c.progress.setPhase("primary acl upgrade")
+	if err := c.waitForUpgrade(PrimaryDC); err != nil {
+		return err
+	}
 
+	c.progress.setPhase("primary acls")
 	err = c.createNamespaces()
 	if err != nil {
 		return fmt.Errorf("createNamespaces: %v", err)
@@ -126,16 +193,23 @@ func (c *Core) initPrimaryDC() error {
 		return fmt.Errorf("createAgentTokens: %v", err)
 	}
 
+	c.progress.setPhase("primary agent tokens")
 	err = c.injectAgentTokensAndWaitForNodeUpdates(PrimaryDC)
 	if err != nil {
 		return fmt.Errorf("injectAgentTokensAndWaitForNodeUpdates[%s]: %v", PrimaryDC, err)
 	}
 
+	c.progress.setPhase("primary config")
 	err = c.createAnonymousToken()
 	if err != nil {
 		return fmt.Errorf("createAnonymousPolicy: %v", err)
 	}
 
+	err = c.reconcileDeclaredACLs()
+	if err != nil {
+		return fmt.Errorf("reconcileDeclaredACLs: %v", err)
+	}
+
 	err = c.writeCentralConfigs()
 	if err != nil {
 		return fmt.Errorf("writeCentralConfigs: %v", err)
@@ -164,11 +238,13 @@ func (c *Core) initPrimaryDC() error {
 func (c *Core) initSecondaryDCs() error {
 	var err error
 
+	c.progress.setPhase("replication tokens")
 	err = c.injectReplicationToken()
 	if err != nil {
 		return fmt.Errorf("injectReplicationToken: %v", err)
 	}
 
+	var secondaries []Datacenter
 	for _, dc := range c.topology.Datacenters() {
 		if dc.Primary {
 			continue
@@ -177,24 +253,38 @@ func (c *Core) initSecondaryDCs() error {
 		if err != nil {
 			return fmt.Errorf("error creating final client for dc=%s: %v", dc.Name, err)
 		}
-		c.waitForUpgrade(dc.Name)
+		secondaries = append(secondaries, dc)
+	}
+
+	c.progress.setPhase("secondary agent tokens")
+	err = c.eachDatacenter(secondaries, func(dc Datacenter) error {
+		if err := c.waitForUpgrade(dc.Name); err != nil {
+			return err
+		}
 
-		err = c.injectAgentTokensAndWaitForNodeUpdates(dc.Name)
-		if err != nil {
-			return fmt.Errorf("injectAgentTokensAndWaitForNodeUpdates[%s]: %v", dc.Name, err)
+		if err := c.injectAgentTokensAndWaitForNodeUpdates(dc.Name); err != nil {
+			return fmt.Errorf("injectAgentTokensAndWaitForNodeUpdates: %v", err)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
+	var kvChecks []func() error
 	for _, dc1 := range c.topology.Datacenters() {
 		for _, dc2 := range c.topology.Datacenters() {
 			if dc1 == dc2 {
 				continue
 			}
-			c.waitForKV(dc1.Name, dc2.Name)
+			from, to := dc1.Name, dc2.Name
+			kvChecks = append(kvChecks, func() error {
+				return c.waitForKV(from, to)
+			})
 		}
 	}
-
-	return nil
+	c.progress.setPhase("wan kv")
+	return runParallel(c.nodeLimiter(), kvChecks)
 }
 
 func (c *Core) primaryClient() *api.Client {
@@ -222,32 +312,46 @@ func (c *Core) bootstrap(client *api.Client) error {
 	ac := client.ACL()
 
 	if c.masterToken != "" {
-	TRYAGAIN:
-		// check to see if it works
-		_, _, err := ac.TokenReadSelf(&api.QueryOptions{Token: c.masterToken})
-		if err != nil {
-			if strings.Index(err.Error(), "The ACL system is currently in legacy mode") != -1 {
-				c.logger.Warn("system is rebooting", "error", err)
-				time.Sleep(250 * time.Millisecond)
-				goto TRYAGAIN
+		var self *api.ACLToken
+		err := c.retryUntil("master token check", func() (bool, error) {
+			// check to see if it works
+			var err error
+			self, _, err = ac.TokenReadSelf(&api.QueryOptions{Token: c.masterToken})
+			if err != nil {
+				if isLegacyACLModeError(err) {
+					c.logger.Warn("system is rebooting", "error", err)
+					return false, nil
+				}
+				c.logger.Warn("master token doesn't work anymore", "error", err)
+				self = nil
+				return true, nil
 			}
-
-			c.logger.Warn("master token doesn't work anymore", "error", err)
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+		if self == nil {
 			return c.cache.DelValue("master-token")
 		}
-		c.logger.Info("current master token", "token", c.masterToken)
-		return nil
+		return c.recordMasterToken(self)
 	}
 
-TRYAGAIN2:
-	c.logger.Info("bootstrapping ACLs")
-	tok, _, err := ac.Bootstrap()
-	if err != nil {
-		if strings.Index(err.Error(), "The ACL system is currently in legacy mode") != -1 {
-			c.logger.Warn("system is rebooting", "error", err)
-			time.Sleep(250 * time.Millisecond)
-			goto TRYAGAIN2
+	var tok *api.ACLToken
+	err = c.retryUntil("acl bootstrap", func() (bool, error) {
+		c.logger.Info("bootstrapping ACLs")
+		var err error
+		tok, _, err = ac.Bootstrap()
+		if err != nil {
+			if isLegacyACLModeError(err) {
+				c.logger.Warn("system is rebooting", "error", err)
+				return false, nil
+			}
+			return false, err
 		}
+		return true, nil
+	})
+	if err != nil {
 		return err
 	}
 	c.masterToken = tok.SecretID
@@ -256,8 +360,32 @@ TRYAGAIN2:
 		return err
 	}
 
-	c.logger.Info("current master token", "token", c.masterToken)
+	return c.recordMasterToken(tok)
+}
+
+func (c *Core) recordMasterToken(token *api.ACLToken) error {
+	c.logger.Info("current master token", c.tokenLogArgs(token.AccessorID, token.SecretID)...)
+	return c.recordToken(newTokenRecord("master", "master", PrimaryDC, token))
+}
 
+// recordStaticTokens records the secrets that are picked before boot and
+// handed straight to the agents or vault, rather than minted through the ACL
+// system.
+func (c *Core) recordStaticTokens() error {
+	static := []*tokenRecord{
+		{Type: "agent-master", Name: "agent-master", SecretID: c.config.AgentMasterToken},
+	}
+	if c.config.VaultEnabled {
+		static = append(static,
+			&tokenRecord{Type: "vault", Name: "vault-root", SecretID: c.config.VaultRootToken},
+			&tokenRecord{Type: "vault", Name: "vault-connect", SecretID: c.config.VaultConnectToken},
+		)
+	}
+	for _, r := range static {
+		if err := c.recordToken(r); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -318,10 +446,10 @@ func (c *Core) createNamespaces() error {
 	return nil
 }
 
-func (c *Core) createReplicationToken() error {
-	const replicationName = "acl-replication"
+const replicationName = "acl-replication"
 
-	p := &api.ACLPolicy{
+func replicationPolicy() *api.ACLPolicy {
+	return &api.ACLPolicy{
 		Name:        replicationName,
 		Description: replicationName,
 		Rules: `
@@ -332,34 +460,36 @@ service_prefix "" {
 	intentions = "read"
 }`,
 	}
-	p, err := consulfunc.CreateOrUpdatePolicy(c.primaryClient(), p)
-	if err != nil {
-		return err
-	}
-
-	// c.logger.Info("replication policy", "name", p.Name, "id", p.ID)
+}
 
-	token := &api.ACLToken{
+func replicationToken() *api.ACLToken {
+	return &api.ACLToken{
 		Description: replicationName,
 		Local:       false,
-		Policies:    []*api.ACLTokenPolicyLink{{ID: p.ID}},
+		Policies:    []*api.ACLTokenPolicyLink{{Name: replicationName}},
+	}
+}
+
+func (c *Core) createReplicationToken() error {
+	if _, err := consulfunc.CreateOrUpdatePolicy(c.primaryClient(), replicationPolicy()); err != nil {
+		return err
 	}
 
-	token, err = consulfunc.CreateOrUpdateToken(c.primaryClient(), token)
+	token, err := consulfunc.CreateOrUpdateToken(c.primaryClient(), replicationToken())
 	if err != nil {
 		return err
 	}
 	c.setToken("replication", "", token.SecretID)
 
-	c.logger.Info("replication token", "secretID", token.SecretID)
+	c.logger.Info("replication token", c.tokenLogArgs(token.AccessorID, token.SecretID)...)
 
-	return nil
+	return c.recordToken(newTokenRecord("replication", replicationName, PrimaryDC, token))
 }
 
-func (c *Core) createMeshGatewayToken() error {
-	const meshGatewayName = "mesh-gateway"
+const meshGatewayName = "mesh-gateway"
 
-	p := &api.ACLPolicy{
+func meshGatewayPolicy() *api.ACLPolicy {
+	return &api.ACLPolicy{
 		Name:        meshGatewayName,
 		Description: meshGatewayName,
 		Rules: `
@@ -377,21 +507,33 @@ agent_prefix "" {
 }
 `,
 	}
-	p, err := consulfunc.CreateOrUpdatePolicy(c.primaryClient(), p)
-	if err != nil {
-		return err
+}
+
+func meshGatewayRole() *api.ACLRole {
+	return &api.ACLRole{
+		Name:        meshGatewayName,
+		Description: meshGatewayName,
+		Policies:    []*api.ACLRolePolicyLink{{Name: meshGatewayName}},
 	}
+}
 
-	token := &api.ACLToken{
+func meshGatewayToken() *api.ACLToken {
+	return &api.ACLToken{
 		Description: meshGatewayName,
 		Local:       false,
-		// ServiceIdentities: []*api.ACLServiceIdentity{
-		// 	{ServiceName: "mesh-gateway"},
-		// },
-		Policies: []*api.ACLTokenPolicyLink{{ID: p.ID}},
+		Roles:       []*api.ACLTokenRoleLink{{Name: meshGatewayName}},
+	}
+}
+
+func (c *Core) createMeshGatewayToken() error {
+	if _, err := consulfunc.CreateOrUpdatePolicy(c.primaryClient(), meshGatewayPolicy()); err != nil {
+		return err
+	}
+	if _, err := consulfunc.CreateOrUpdateRole(c.primaryClient(), meshGatewayRole()); err != nil {
+		return err
 	}
 
-	token, err = consulfunc.CreateOrUpdateToken(c.primaryClient(), token)
+	token, err := consulfunc.CreateOrUpdateToken(c.primaryClient(), meshGatewayToken())
 	if err != nil {
 		return err
 	}
@@ -402,9 +544,9 @@ agent_prefix "" {
 
 	c.setToken("mesh-gateway", "", token.SecretID)
 
-	c.logger.Info("mesh-gateway token", "secretID", token.SecretID)
+	c.logger.Info("mesh-gateway token", c.tokenLogArgs(token.AccessorID, token.SecretID)...)
 
-	return nil
+	return c.recordToken(newTokenRecord("mesh-gateway", meshGatewayName, PrimaryDC, token))
 }
 
 func (c *Core) injectReplicationToken() error {
@@ -412,7 +554,7 @@ func (c *Core) injectReplicationToken() error {
 
 	agentMasterToken := c.config.AgentMasterToken
 
-	return c.topology.Walk(func(node *Node) error {
+	return c.walkParallel(func(node *Node) error {
 		if node.Datacenter == PrimaryDC || !node.Server {
 			return nil
 		}
@@ -423,14 +565,18 @@ func (c *Core) injectReplicationToken() error {
 		}
 		ac := agentClient.Agent()
 
-	TRYAGAIN:
-		_, err = ac.UpdateReplicationACLToken(token, nil)
-		if err != nil {
-			if strings.Index(err.Error(), "Unexpected response code: 403 (ACL not found)") != -1 {
-				c.logger.Warn("system is coming up", "error", err)
-				time.Sleep(250 * time.Millisecond)
-				goto TRYAGAIN
+		err = c.retryUntil("replication token on "+node.Name, func() (bool, error) {
+			_, err := ac.UpdateReplicationACLToken(token, nil)
+			if err != nil {
+				if strings.Index(err.Error(), "Unexpected response code: 403 (ACL not found)") != -1 {
+					c.logger.Warn("system is coming up", "node", node.Name, "error", err)
+					return false, nil
+				}
+				return false, err
 			}
+			return true, nil
+		})
+		if err != nil {
 			return err
 		}
 		c.logger.Info("agent was given its replication token", "node", node.Name)
@@ -439,52 +585,108 @@ func (c *Core) injectReplicationToken() error {
 	})
 }
 
-// each agent will get a minimal policy configured
-func (c *Core) createAgentTokens() error {
-	return c.topology.Walk(func(node *Node) error {
-		policyName := "agent--" + node.Name
-
-		p := &api.ACLPolicy{
-			Name:        policyName,
-			Description: policyName,
-			Rules: `
-node "` + node.Name + `-pod" { policy = "write" }
-service_prefix "" { policy = "read" }
-`,
+// each agent gets a role granting the node identity of its pod
+func agentRole(node *Node) *api.ACLRole {
+	roleName := "agent--" + node.Name
+	return &api.ACLRole{
+		Name:        roleName,
+		Description: roleName,
+		NodeIdentities: []*api.ACLNodeIdentity{{
+			NodeName:   node.Name + "-pod",
+			Datacenter: node.Datacenter,
+		}},
+	}
+}
+
+// needsAgentToken reports whether boot mints an agent role and token for the
+// node. Clients under auto_config get theirs from the servers instead.
+func (c *Core) needsAgentToken(node *Node) bool {
+	return node.Server || c.config.ClientTLS != ClientTLSAutoConfig
+}
+
+func (c *Core) agentToken(node *Node) *api.ACLToken {
+	return &api.ACLToken{
+		Description: node.TokenName(),
+		SecretID:    c.config.PresetAgentTokens[node.Name],
+		Local:       false,
+		Roles:       []*api.ACLTokenRoleLink{{Name: "agent--" + node.Name}},
+	}
+}
+
+// legacyAgentPolicies returns the policies agents used to get, named like
+// their role, which are deleted once every agent token uses its role.
+func legacyAgentPolicies(policies map[string]string) map[string]string {
+	out := make(map[string]string)
+	for name, id := range policies {
+		if strings.HasPrefix(name, "agent--") {
+			out[name] = id
 		}
+	}
+	return out
+}
 
-		_, err := consulfunc.CreateOrUpdatePolicy(c.primaryClient(), p)
-		if err != nil {
+func (c *Core) createAgentTokens() error {
+	err := c.walkParallel(func(node *Node) error {
+		if !c.needsAgentToken(node) {
+			return nil
+		}
+		if _, err := consulfunc.CreateOrUpdateRole(c.primaryClient(), agentRole(node)); err != nil {
 			return err
 		}
-		// c.logger.Info("agent policy", "name", node.Name, "id", op.ID)
 
-		token := &api.ACLToken{
-			Description: node.TokenName(),
-			Local:       false,
-			Policies:    []*api.ACLTokenPolicyLink{{Name: policyName}},
-		}
+		preset := c.config.PresetAgentTokens[node.Name]
 
-		token, err = consulfunc.CreateOrUpdateToken(c.primaryClient(), token)
+		token, err := consulfunc.CreateOrUpdateToken(c.primaryClient(), c.agentToken(node))
 		if err != nil {
 			return err
 		}
 
-		c.logger.Info("agent token", "node", node.Name, "secretID", token.SecretID)
+		if preset != "" && token.SecretID != preset {
+			return fmt.Errorf("agent token for %s predates security.client_tls=%q; run 'devconsul down' first",
+				node.Name, c.config.ClientTLS)
+		}
+
+		c.logger.Info("agent token", append([]interface{}{"node", node.Name},
+			c.tokenLogArgs(token.AccessorID, token.SecretID)...)...)
 
 		c.setToken("agent", node.Name, token.SecretID)
 
-		return nil
+		return c.recordToken(newTokenRecord("agent", node.Name, node.Datacenter, token))
 	})
+	if err != nil {
+		return err
+	}
+
+	policies, err := consulfunc.ListExistingPoliciesByName(c.primaryClient())
+	if err != nil {
+		return err
+	}
+	for name, id := range legacyAgentPolicies(policies) {
+		if _, err := c.primaryClient().ACL().PolicyDelete(id, nil); err != nil {
+			return err
+		}
+		c.logger.Info("deleted legacy agent policy", "name", name)
+	}
+	return nil
 }
 
 // TALK TO EACH AGENT
-func (c *Core) injectAgentTokens(datacenter string) error {
+//
+// If only is non-nil, just the named nodes are given their tokens.
+func (c *Core) injectAgentTokens(datacenter string, only []string) error {
 	agentMasterToken := c.config.AgentMasterToken
-	return c.topology.Walk(func(node *Node) error {
+	return c.walkParallel(func(node *Node) error {
 		if node.Datacenter != datacenter {
 			return nil
 		}
+		if only != nil && !stringSliceContains(only, node.Name) {
+			return nil
+		}
+		if !node.Server && c.config.ClientTLS != ClientTLSStatic {
+			// These either already have their token baked in or get one
+			// through auto_config.
+			return nil
+		}
 		agentClient, err := consulfunc.GetClient(node.LocalAddress(), agentMasterToken)
 		if err != nil {
 			return err
@@ -506,21 +708,21 @@ func (c *Core) injectAgentTokens(datacenter string) error {
 	})
 }
 
-func (c *Core) waitForLeader(dc string) {
+func (c *Core) waitForLeader(dc string) error {
 	client := c.clients[dc]
-	for {
+	return c.retryUntil("leader in "+dc, func() (bool, error) {
 		leader, err := client.Status().Leader()
 		if leader != "" && err == nil {
 			c.logger.Info("datacenter has leader", "datacenter", dc, "leader_addr", leader)
-			break
+			return true, nil
 		}
 		c.logger.Info("datacenter has no leader yet", "datacenter", dc)
-		time.Sleep(500 * time.Millisecond)
-	}
+		return false, nil
+	})
 }
 
-func (c *Core) waitForUpgrade(dc string) {
-	c.waitForACLUpgrade(c.clients[dc], dc, dc+"-server1")
+func (c *Core) waitForUpgrade(dc string) error {
+	return c.waitForACLUpgrade(c.clients[dc], dc, dc+"-server1")
 }
 
 func (c *Core) waitForACLUpgrade(client *api.Client, dc, node string) error {
@@ -528,15 +730,17 @@ func (c *Core) waitForACLUpgrade(client *api.Client, dc, node string) error {
 		return nil
 	}
 
-	for {
+	err := c.retryUntil("acl upgrade on "+node, func() (bool, error) {
 		mode, err := consulfunc.GetACLMode(client, node)
 		if err == nil && mode == 1 {
 			c.logger.Info("acl mode is now in v2 mode", "node", node)
-			break
+			return true, nil
 		}
 		c.logger.Info("acl mode not upgraded to v2 yet", "node", node)
-
-		time.Sleep(500 * time.Millisecond)
+		return false, nil
+	})
+	if err != nil {
+		return err
 	}
 
 	c.markUpgradedACLs(dc, node)
@@ -544,6 +748,8 @@ func (c *Core) waitForACLUpgrade(client *api.Client, dc, node string) error {
 }
 
 func (c *Core) isUpgradedACLs(dc, node string) bool {
+	c.bootMu.Lock()
+	defer c.bootMu.Unlock()
 	if len(c.upgradedACLs) == 0 {
 		return false
 	}
@@ -556,6 +762,8 @@ func (c *Core) isUpgradedACLs(dc, node string) bool {
 }
 
 func (c *Core) markUpgradedACLs(dc, node string) {
+	c.bootMu.Lock()
+	defer c.bootMu.Unlock()
 	if c.upgradedACLs == nil {
 		c.upgradedACLs = make(map[string]map[string]struct{})
 	}
@@ -569,12 +777,8 @@ func (c *Core) markUpgradedACLs(dc, node string) {
 
 const anonymousTokenAccessorID = "00000000-0000-0000-0000-000000000002"
 
-func (c *Core) createAnonymousToken() error {
-	if err := c.createAnonymousPolicy(); err != nil {
-		return err
-	}
-
-	tok := &api.ACLToken{
+func anonymousToken() *api.ACLToken {
+	return &api.ACLToken{
 		AccessorID: anonymousTokenAccessorID,
 		// SecretID: "anonymous",
 		Description: "anonymous",
@@ -585,8 +789,14 @@ func (c *Core) createAnonymousToken() error {
 			},
 		},
 	}
+}
+
+func (c *Core) createAnonymousToken() error {
+	if err := c.createAnonymousPolicy(); err != nil {
+		return err
+	}
 
-	_, err := consulfunc.CreateOrUpdateToken(c.primaryClient(), tok)
+	_, err := consulfunc.CreateOrUpdateToken(c.primaryClient(), anonymousToken())
 	if err != nil {
 		return err
 	}
@@ -596,7 +806,7 @@ func (c *Core) createAnonymousToken() error {
 	return nil
 }
 
-func (c *Core) createAnonymousPolicy() error {
+func (c *Core) anonymousPolicy() *api.ACLPolicy {
 	p := &api.ACLPolicy{
 		Name:        "anonymous",
 		Description: "anonymous",
@@ -608,6 +818,11 @@ service_prefix "" { policy = "read" }
 	if c.config.EnterpriseEnabled {
 		p.Rules = `namespace_prefix "" { ` + p.Rules + ` }`
 	}
+	return p
+}
+
+func (c *Core) createAnonymousPolicy() error {
+	p := c.anonymousPolicy()
 
 	op, err := consulfunc.CreateOrUpdatePolicy(c.primaryClient(), p)
 	if err != nil {
@@ -619,12 +834,8 @@ service_prefix "" { policy = "read" }
 	return nil
 }
 
-func (c *Core) createCrossNamespaceCatalogReadPolicy() error {
-	if !c.config.EnterpriseEnabled {
-		return nil
-	}
-
-	p := &api.ACLPolicy{
+func crossNamespaceCatalogReadPolicy() *api.ACLPolicy {
+	return &api.ACLPolicy{
 		Name:        "cross-ns-catalog-read",
 		Description: "cross-ns-catalog-read",
 		Rules: `
@@ -634,6 +845,14 @@ namespace_prefix "" {
 }
 `,
 	}
+}
+
+func (c *Core) createCrossNamespaceCatalogReadPolicy() error {
+	if !c.config.EnterpriseEnabled {
+		return nil
+	}
+
+	p := crossNamespaceCatalogReadPolicy()
 
 	op, err := consulfunc.CreateOrUpdatePolicy(c.primaryClient(), p)
 	if err != nil {
@@ -645,6 +864,65 @@ namespace_prefix "" {
 	return nil
 }
 
+func serviceToken(svc *Service) *api.ACLToken {
+	return &api.ACLToken{
+		Description: "service--" + svc.Name,
+		Namespace:   svc.Namespace,
+		Local:       false,
+		ServiceIdentities: []*api.ACLServiceIdentity{
+			&api.ACLServiceIdentity{
+				ServiceName: svc.Name,
+			},
+		},
+	}
+}
+
+// desiredACLPolicies, desiredACLRoles and desiredACLTokens are everything
+// the primary acls and primary config phases create, for plan to compare
+// against.
+func (c *Core) desiredACLPolicies() []*api.ACLPolicy {
+	out := []*api.ACLPolicy{replicationPolicy(), meshGatewayPolicy(), c.anonymousPolicy()}
+	if c.config.EnterpriseEnabled {
+		out = append(out, crossNamespaceCatalogReadPolicy())
+	}
+	return append(out, c.config.ACLPolicies...)
+}
+
+func (c *Core) desiredACLRoles() []*api.ACLRole {
+	out := []*api.ACLRole{meshGatewayRole()}
+	c.topology.WalkSilent(func(n *Node) {
+		if c.needsAgentToken(n) {
+			out = append(out, agentRole(n))
+		}
+	})
+	return append(out, c.config.ACLRoles...)
+}
+
+func (c *Core) desiredACLTokens() []*api.ACLToken {
+	out := []*api.ACLToken{replicationToken(), meshGatewayToken()}
+	c.topology.WalkSilent(func(n *Node) {
+		if c.needsAgentToken(n) {
+			out = append(out, c.agentToken(n))
+		}
+	})
+	out = append(out, anonymousToken())
+	out = append(out, c.config.ACLTokens...)
+	if !c.config.KubernetesEnabled {
+		done := make(map[string]struct{})
+		c.topology.WalkSilent(func(n *Node) {
+			if n.Service == nil {
+				return
+			}
+			if _, ok := done[n.Service.Name]; ok {
+				return
+			}
+			done[n.Service.Name] = struct{}{}
+			out = append(out, serviceToken(n.Service))
+		})
+	}
+	return out
+}
+
 func (c *Core) createServiceTokens() error {
 	done := make(map[string]struct{})
 
@@ -656,29 +934,15 @@ func (c *Core) createServiceTokens() error {
 			return nil
 		}
 
-		token := &api.ACLToken{
-			Description: "service--" + n.Service.Name,
-			Local:       false,
-			ServiceIdentities: []*api.ACLServiceIdentity{
-				&api.ACLServiceIdentity{
-					ServiceName: n.Service.Name,
-				},
-			},
-		}
-		if n.Service.Namespace != "" {
-			token.Namespace = n.Service.Namespace
-		}
-
-		token, err := consulfunc.CreateOrUpdateToken(c.primaryClient(), token)
+		token, err := consulfunc.CreateOrUpdateToken(c.primaryClient(), serviceToken(n.Service))
 		if err != nil {
 			return err
 		}
 
-		c.logger.Info("service token created",
+		c.logger.Info("service token created", append([]interface{}{
 			"service", n.Service.Name,
 			"namespace", n.Service.Namespace,
-			"token", token.SecretID,
-		)
+		}, c.tokenLogArgs(token.AccessorID, token.SecretID)...)...)
 
 		if err := c.cache.SaveValue("service-token--"+n.Service.Name, token.SecretID); err != nil {
 			return err
@@ -686,6 +950,10 @@ func (c *Core) createServiceTokens() error {
 
 		c.setToken("service", n.Service.Name, token.SecretID)
 
+		if err := c.recordToken(newTokenRecord("service", n.Service.Name, PrimaryDC, token)); err != nil {
+			return err
+		}
+
 		done[n.Service.Name] = struct{}{}
 		return nil
 	})
@@ -695,13 +963,62 @@ func (c *Core) writeCentralConfigs() error {
 	// Configs live in the primary DC only.
 	client := c.clientForDC(PrimaryDC)
 
-	currentEntries, err := consulfunc.ListAllConfigEntries(client)
+	namespaced := c.config.EnterpriseEnabled
+
+	currentEntries, err := consulfunc.ListAllConfigEntries(client, knownConfigEntryKinds, namespaced)
 	if err != nil {
 		return err
 	}
 
 	ce := client.ConfigEntries()
 
+	entries, err := c.desiredConfigEntries()
+	if err != nil {
+		return err
+	}
+	c.warnUntracedGateways()
+
+	for _, entry := range entries {
+		if _, _, err := ce.Set(entry, nil); err != nil {
+			return err
+		}
+
+		ckn := consulfunc.NewConfigKindName(entry, namespaced)
+		delete(currentEntries, ckn)
+
+		c.logger.Info("config entry created", "entry", ckn.String())
+	}
+
+	// Loop over the kinds in the order that will make the graph happy during erasure.
+	for _, kind := range configEntryDeletionOrder {
+		var stale []consulfunc.ConfigKindName
+		for ckn := range currentEntries {
+			if ckn.Kind == kind {
+				stale = append(stale, ckn)
+			}
+		}
+		sort.Slice(stale, func(i, j int) bool {
+			return stale[i].String() < stale[j].String()
+		})
+
+		for _, ckn := range stale {
+			c.logger.Info("nuking config entry", "entry", ckn.String())
+
+			_, err = ce.Delete(ckn.Kind, ckn.Name, ckn.WriteOptions())
+			if err != nil {
+				return err
+			}
+
+			delete(currentEntries, ckn)
+		}
+	}
+
+	return nil
+}
+
+// desiredConfigEntries returns every config entry that boot should write,
+// which is the user supplied entries merged with the ones devconsul needs.
+func (c *Core) desiredConfigEntries() ([]api.ConfigEntry, error) {
 	type ServiceName struct {
 		Name      string
 		Namespace string
@@ -709,8 +1026,8 @@ func (c *Core) writeCentralConfigs() error {
 
 	// collect upstreams and downstreams
 	dm := make(map[ServiceName]map[ServiceName]struct{}) // dest -> src
-	err = c.topology.Walk(func(n *Node) error {
-		if n.Service == nil {
+	err := c.topology.Walk(func(n *Node) error {
+		if n.Service == nil || c.config.DisableDefaultIntentions {
 			return nil
 		}
 		svc := n.Service
@@ -739,22 +1056,48 @@ func (c *Core) writeCentralConfigs() error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var stockEntries []api.ConfigEntry
+
+	proxyConfig := make(map[string]interface{})
 	if c.config.PrometheusEnabled {
+		// hardcoded address of prometheus container
+		proxyConfig["envoy_prometheus_bind_addr"] = "0.0.0.0:9102"
+	}
+	if c.config.Tracing != "" {
+		tracingConfig, err := tracingProxyConfig(c.config.Tracing)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range tracingConfig {
+			proxyConfig[k] = v
+		}
+		stockEntries = append(stockEntries, c.tracingServiceDefaults()...)
+	}
+	if len(proxyConfig) > 0 {
 		stockEntries = append(stockEntries, &api.ProxyConfigEntry{
-			Kind: api.ProxyDefaults,
-			Name: api.ProxyConfigGlobal,
-			Config: map[string]interface{}{
-				// hardcoded address of prometheus container
-				"envoy_prometheus_bind_addr": "0.0.0.0:9102",
-			},
+			Kind:   api.ProxyDefaults,
+			Name:   api.ProxyConfigGlobal,
+			Config: proxyConfig,
 		})
 	}
 
-	for dst, sm := range dm {
+	dsts := make([]ServiceName, 0, len(dm))
+	for dst := range dm {
+		dsts = append(dsts, dst)
+	}
+	sort.Slice(dsts, func(i, j int) bool {
+		if dsts[i].Namespace != dsts[j].Namespace {
+			return dsts[i].Namespace < dsts[j].Namespace
+		}
+		return dsts[i].Name < dsts[j].Name
+	})
+
+	var intentions []*api.ServiceIntentionsConfigEntry
+	for _, dst := range dsts {
+		sm := dm[dst]
 		entry := &api.ServiceIntentionsConfigEntry{
 			Kind:      api.ServiceIntentions,
 			Name:      dst.Name,
@@ -767,10 +1110,14 @@ func (c *Core) writeCentralConfigs() error {
 				Action:    api.IntentionActionAllow,
 			})
 		}
+		sortIntentionSources(entry.Sources)
+		intentions = append(intentions, entry)
+	}
+	for _, entry := range mergeDeclaredIntentions(intentions, c.config.Intentions) {
 		stockEntries = append(stockEntries, entry)
 	}
 
-	entries := c.config.ConfigEntries
+	entries := append([]api.ConfigEntry(nil), c.config.ConfigEntries...)
 	for _, stockEntry := range stockEntries {
 		found := false
 		for i, entry := range entries {
@@ -793,10 +1140,10 @@ func (c *Core) writeCentralConfigs() error {
 					ce.Config[k] = v
 				}
 				entries[i] = ce
-			case api.ServiceIntentions:
+			case api.ServiceIntentions, api.ServiceDefaults:
 			// we deliberately do not merge these
 			default:
-				return fmt.Errorf("unsupported kind: %q", stockEntry.GetKind())
+				return nil, fmt.Errorf("unsupported kind: %q", stockEntry.GetKind())
 			}
 
 			found = true
@@ -807,54 +1154,12 @@ func (c *Core) writeCentralConfigs() error {
 		}
 	}
 
-	for _, entry := range entries {
-		if _, _, err := ce.Set(entry, nil); err != nil {
-			return err
-		}
-
-		ckn := consulfunc.ConfigKindName{
-			Kind: entry.GetKind(),
-			Name: entry.GetName(),
-		}
-		delete(currentEntries, ckn)
-
-		c.logger.Info("config entry created",
-			"kind", entry.GetKind(),
-			"name", entry.GetName(),
-		)
+	if err := validateConfigEntries(entries, c.topologyServiceNames(), c.config.EnterpriseEnabled); err != nil {
+		return nil, err
 	}
+	sortConfigEntriesForWrite(entries)
 
-	// Loop over the kinds in the order that will make the graph happy during erasure.
-	for _, kind := range []string{
-		api.ServiceIntentions,
-		api.IngressGateway,
-		api.TerminatingGateway,
-		api.ServiceRouter,
-		api.ServiceSplitter,
-		api.ServiceResolver,
-		api.ServiceDefaults,
-		api.ProxyDefaults,
-	} {
-		for ckn, _ := range currentEntries {
-			if ckn.Kind != kind {
-				continue
-			}
-
-			c.logger.Info("nuking config entry",
-				"kind", ckn.Kind,
-				"name", ckn.Name,
-			)
-
-			_, err = ce.Delete(ckn.Kind, ckn.Name, nil)
-			if err != nil {
-				return err
-			}
-
-			delete(currentEntries, ckn)
-		}
-	}
-
-	return nil
+	return entries, nil
 }
 
 func (c *Core) writeServiceRegistrationFiles() error {
@@ -870,11 +1175,8 @@ func (c *Core) writeServiceRegistrationFiles() error {
 		regHCL := buf.String()
 
 		filename := "servicereg__" + n.Name + "__" + n.Service.Name + ".hcl"
-		if err := c.cache.WriteStringFile(filename, regHCL); err != nil {
-			return err
-		}
-		c.logger.Info("Generated service registration", "filename", filename)
-		return nil
+		_, err := c.updateFileIfDifferent([]byte(regHCL), filepath.Join("cache", filename), 0644)
+		return err
 	})
 }
 
@@ -896,8 +1198,8 @@ func (c *Core) createBindingRulesForK8s() error {
 		AuthMethod:  "minikube",
 		Description: bindingRuleDescription,
 		Selector:    "",
-		BindType:    api.BindingRuleBindTypeService,
-		BindName:    "${serviceaccount.name}",
+		BindType:    c.config.KubernetesBindType,
+		BindName:    c.config.KubernetesBindName,
 	}
 
 	orule, err := consulfunc.CreateOrUpdateBindingRule(c.primaryClient(), rule)
@@ -905,7 +1207,12 @@ func (c *Core) createBindingRulesForK8s() error {
 		return err
 	}
 
-	c.logger.Info("binding rule created", "authMethod", rule.AuthMethod, "ID", orule.ID)
+	c.logger.Info("binding rule created",
+		"authMethod", rule.AuthMethod,
+		"bindType", rule.BindType,
+		"bindName", rule.BindName,
+		"ID", orule.ID,
+	)
 
 	return nil
 }
@@ -955,13 +1262,7 @@ services = [
     port = {{.Port}}
 
     checks = [
-      {
-        name     = "up"
-        http     = "http://localhost:{{.Port}}/healthz"
-        method   = "GET"
-        interval = "5s"
-        timeout  = "1s"
-      },
+{{- template "checks" .HealthChecks }}
     ]
 
     meta {
@@ -972,7 +1273,16 @@ services = [
 
     connect {
       sidecar_service {
+{{- if .SidecarChecks }}
+        checks = [
+{{- template "checks" .SidecarHealthChecks }}
+        ]
+{{- end }}
         proxy {
+{{- if .TransparentProxy }}
+          mode = "transparent"
+{{- end }}
+{{- if .ExplicitUpstream }}
           upstreams = [
             {
               destination_name = "{{.UpstreamName}}"
@@ -986,11 +1296,56 @@ services = [
 {{ .UpstreamExtraHCL }}
             },
           ]
+{{- end }}
         }
       }
     }
   },
 ]
+{{ define "checks" }}
+{{- range . }}
+      {
+        name     = {{ printf "%q" .Name }}
+{{- if .HTTP }}
+        http     = {{ printf "%q" .HTTP }}
+{{- end }}
+{{- if .Method }}
+        method   = {{ printf "%q" .Method }}
+{{- end }}
+{{- if .TCP }}
+        tcp      = {{ printf "%q" .TCP }}
+{{- end }}
+{{- if .GRPC }}
+        grpc     = {{ printf "%q" .GRPC }}
+{{- end }}
+{{- if .TTL }}
+        ttl      = {{ printf "%q" .TTL }}
+{{- end }}
+{{- if .DockerContainerID }}
+        docker_container_id = {{ printf "%q" .DockerContainerID }}
+        shell    = {{ printf "%q" .Shell }}
+{{- end }}
+{{- if .Args }}
+        args     = [{{ range $i, $a := .Args }}{{ if $i }}, {{ end }}{{ printf "%q" $a }}{{ end }}]
+{{- end }}
+{{- if .AliasService }}
+        alias_service = {{ printf "%q" .AliasService }}
+{{- end }}
+{{- if .Interval }}
+        interval = {{ printf "%q" .Interval }}
+{{- end }}
+{{- if .Timeout }}
+        timeout  = {{ printf "%q" .Timeout }}
+{{- end }}
+{{- if .Status }}
+        status   = {{ printf "%q" .Status }}
+{{- end }}
+{{- if .DeregisterCriticalServiceAfter }}
+        deregister_critical_service_after = {{ printf "%q" .DeregisterCriticalServiceAfter }}
+{{- end }}
+      },
+{{- end }}
+{{- end -}}
 `))
 
 func GetServiceRegistrationHCL(s Service) (string, error) {
@@ -1009,27 +1364,41 @@ func (c *Core) injectAgentTokensAndWaitForNodeUpdates(datacenter string) error {
 	}
 	cc := client.Catalog()
 
-	for {
-		if err := c.injectAgentTokens(datacenter); err != nil {
-			return fmt.Errorf("injectAgentTokens[%s]: %v", datacenter, err)
+	// Each straggler is listed in the progress reports until it catches up.
+	var released []func()
+	release := func() {
+		for _, f := range released {
+			f()
+		}
+		released = nil
+	}
+	defer release()
+
+	var stragglers []string // nil means everyone
+	return c.retryUntil("node updates in "+datacenter, func() (bool, error) {
+		// Only the stragglers get poked again.
+		if err := c.injectAgentTokens(datacenter, stragglers); err != nil {
+			return false, fmt.Errorf("injectAgentTokens[%s]: %v", datacenter, err)
 		}
 
 		// Injecting a token should bump the agent to do anti-entropy sync.
-		nodes, _, err := cc.Nodes(&api.QueryOptions{Datacenter: datacenter})
+		nodes, _, err := cc.Nodes((&api.QueryOptions{Datacenter: datacenter}).WithContext(c.bootContext()))
 		if err != nil {
 			nodes = nil
 		}
 
-		stragglers := c.determineNodeUpdateStragglers(nodes, datacenter)
+		stragglers = c.determineNodeUpdateStragglers(nodes, datacenter)
+		release()
 		if len(stragglers) == 0 {
 			c.logger.Info("all nodes have posted node updates, so agent acl tokens are working", "datacenter", datacenter)
-			return nil
+			return true, nil
+		}
+		for _, name := range stragglers {
+			released = append(released, c.progress.waiting(name))
 		}
 		c.logger.Info("not all client nodes have posted node updates yet", "datacenter", datacenter, "nodes", stragglers)
-
-		// takes like 90s to actually right itself
-		time.Sleep(5 * time.Second)
-	}
+		return false, nil
+	})
 }
 
 func (c *Core) determineNodeUpdateStragglers(nodes []*api.Node, datacenter string) []string {
@@ -1055,6 +1424,8 @@ func (c *Core) determineNodeUpdateStragglers(nodes []*api.Node, datacenter strin
 }
 
 func (c *Core) setToken(typ, k, v string) {
+	c.bootMu.Lock()
+	defer c.bootMu.Unlock()
 	if c.tokens == nil {
 		c.tokens = make(map[string]string)
 	}
@@ -1062,6 +1433,8 @@ func (c *Core) setToken(typ, k, v string) {
 }
 
 func (c *Core) getToken(typ, k string) string {
+	c.bootMu.Lock()
+	defer c.bootMu.Unlock()
 	if c.tokens == nil {
 		return ""
 	}
@@ -1071,6 +1444,8 @@ func (c *Core) getToken(typ, k string) string {
 func (c *Core) mustGetToken(typ, k string) string {
 	tok := c.getToken(typ, k)
 	if tok == "" {
+		c.bootMu.Lock()
+		defer c.bootMu.Unlock()
 		panic("token for '" + typ + "/" + k + "' not set:" + jsonPretty(c.tokens))
 	}
 	return tok
@@ -1082,3 +1457,7 @@ func defaultValue(v, def string) string {
 	}
 	return v
 }
+
+func isLegacyACLModeError(err error) bool {
+	return strings.Index(err.Error(), "The ACL system is currently in legacy mode") != -1
+}
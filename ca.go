@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/rboyer/devconsul/consulfunc"
+)
+
+func (c *Core) RunCA() error {
+	args := flag.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("Missing required ca subcommand: [show, rotate]")
+	}
+
+	switch args[0] {
+	case "show":
+		return c.runCAShow()
+	case "rotate":
+		return c.runCARotate(args[1:])
+	default:
+		return fmt.Errorf("unknown ca subcommand: %s", args[0])
+	}
+}
+
+// caRootList mirrors the /v1/connect/ca/roots response. The api package
+// leaves out the intermediates, which are half of what we want to look at.
+type caRootList struct {
+	ActiveRootID string
+	TrustDomain  string
+	Roots        []*caRoot
+}
+
+type caRoot struct {
+	ID                string
+	Name              string
+	SerialNumber      uint64
+	SigningKeyID      string
+	NotBefore         time.Time
+	NotAfter          time.Time
+	RootCert          string
+	IntermediateCerts []string
+	Active            bool
+	PrivateKeyType    string
+	PrivateKeyBits    int
+}
+
+func getCARoots(client *api.Client, dc string) (*caRootList, error) {
+	var out caRootList
+	_, err := client.Raw().Query("/v1/connect/ca/roots", &out, &api.QueryOptions{Datacenter: dc})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (l *caRootList) Active() *caRoot {
+	for _, r := range l.Roots {
+		if r.ID == l.ActiveRootID {
+			return r
+		}
+	}
+	return nil
+}
+
+func (c *Core) runCAShow() error {
+	client, err := c.debugPrimaryClient()
+	if err != nil {
+		return err
+	}
+
+	for _, dc := range c.topology.Datacenters() {
+		roots, err := getCARoots(client, dc.Name)
+		if err != nil {
+			return fmt.Errorf("error listing ca roots in dc=%s: %v", dc.Name, err)
+		}
+
+		fmt.Printf("==> %s (trust domain %s)\n", dc.Name, roots.TrustDomain)
+		for _, r := range roots.Roots {
+			status := "inactive"
+			if r.ID == roots.ActiveRootID {
+				status = "active"
+			}
+			fmt.Printf("  root %s [%s]\n", r.ID, status)
+			fmt.Printf("    name:        %s\n", r.Name)
+			fmt.Printf("    serial:      %x\n", r.SerialNumber)
+			fmt.Printf("    key:         %s %d\n", r.PrivateKeyType, r.PrivateKeyBits)
+			fmt.Printf("    valid:       %s to %s\n",
+				r.NotBefore.Format(time.RFC3339), r.NotAfter.Format(time.RFC3339))
+
+			for _, certPEM := range r.IntermediateCerts {
+				cert, err := parseCertPEM(certPEM)
+				if err != nil {
+					return fmt.Errorf("error parsing intermediate of root %s: %v", r.ID, err)
+				}
+				fmt.Printf("    intermediate %x\n", cert.SerialNumber)
+				fmt.Printf("      subject:   %s\n", cert.Subject.CommonName)
+				fmt.Printf("      issuer:    %s\n", cert.Issuer.CommonName)
+				fmt.Printf("      valid:     %s to %s\n",
+					cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Core) runCARotate(args []string) error {
+	var (
+		keyType string
+		keyBits int
+		timeout time.Duration
+	)
+	fs := flag.NewFlagSet("ca rotate", flag.ContinueOnError)
+	fs.StringVar(&keyType, "key-type", "", "key type of the new root: ec or rsa (default: unchanged)")
+	fs.IntVar(&keyBits, "key-bits", 0, "key size of the new root (default: unchanged, or the default for -key-type)")
+	fs.DurationVar(&timeout, "timeout", 5*time.Minute, "how long to wait for the new root to propagate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	masterToken, err := c.cache.LoadValue("master-token")
+	if err != nil {
+		return err
+	}
+	client, err := consulfunc.GetClient(c.topology.LeaderIP(PrimaryDC, false), masterToken)
+	if err != nil {
+		return err
+	}
+
+	conf, _, err := client.Connect().CAGetConfig(nil)
+	if err != nil {
+		return fmt.Errorf("error reading ca configuration: %v", err)
+	}
+
+	newConf, err := nextCAConfig(conf, keyType, keyBits, time.Now())
+	if err != nil {
+		return err
+	}
+
+	oldRoots, err := getCARoots(client, PrimaryDC)
+	if err != nil {
+		return fmt.Errorf("error listing ca roots: %v", err)
+	}
+
+	ctx, stop := c.interruptibleContext("ca rotation", timeout)
+	defer stop()
+
+	start := time.Now()
+
+	if _, err := client.Connect().CASetConfig(newConf, nil); err != nil {
+		return fmt.Errorf("error updating ca configuration: %v", err)
+	}
+	c.logger.Info("updated ca configuration",
+		"provider", newConf.Provider,
+		"key_type", newConf.Config["PrivateKeyType"],
+		"key_bits", newConf.Config["PrivateKeyBits"],
+	)
+
+	var newRoot *caRoot
+	err = retryFor(ctx, "the new root to become active", func() (bool, error) {
+		roots, err := getCARoots(client, PrimaryDC)
+		if err != nil {
+			c.logger.Warn("error listing ca roots", "error", err)
+			return false, nil
+		}
+		if roots.ActiveRootID == oldRoots.ActiveRootID {
+			return false, nil
+		}
+		newRoot = roots.Active()
+		return newRoot != nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	c.logger.Info("new root is active", "root", newRoot.ID, "elapsed", time.Since(start))
+
+	for _, dc := range c.topology.Datacenters() {
+		err := retryFor(ctx, "the new root to become active in dc="+dc.Name, func() (bool, error) {
+			roots, err := getCARoots(client, dc.Name)
+			if err != nil {
+				c.logger.Warn("error listing ca roots", "datacenter", dc.Name, "error", err)
+				return false, nil
+			}
+			return roots.ActiveRootID == newRoot.ID, nil
+		})
+		if err != nil {
+			return err
+		}
+		c.logger.Info("datacenter switched to the new root", "datacenter", dc.Name, "elapsed", time.Since(start))
+	}
+
+	for _, node := range c.topology.Nodes() {
+		if node.MeshGateway {
+			if err := c.waitForGatewayRoot(ctx, node, newRoot); err != nil {
+				return err
+			}
+			c.logger.Info("mesh gateway is using the new root", "node", node.Name, "elapsed", time.Since(start))
+		}
+		if node.Service == nil {
+			continue
+		}
+		if node.UseBuiltinProxy {
+			c.logger.Info("skipping the envoy check for the builtin proxy; only its agent leaf is checked", "node", node.Name)
+		}
+		if err := c.waitForSidecarLeaf(ctx, node, masterToken, newRoot.ID); err != nil {
+			return err
+		}
+		c.logger.Info("sidecar is using a leaf from the new root", "node", node.Name, "elapsed", time.Since(start))
+	}
+
+	c.logger.Info("ca rotation complete", "elapsed", time.Since(start))
+	return nil
+}
+
+// nextCAConfig returns a copy of the CA configuration that is guaranteed to
+// produce a new root when it is applied.
+func nextCAConfig(conf *api.CAConfig, keyType string, keyBits int, now time.Time) (*api.CAConfig, error) {
+	newConf := &api.CAConfig{
+		Provider: conf.Provider,
+		Config:   make(map[string]interface{}),
+	}
+	for k, v := range conf.Config {
+		newConf.Config[k] = v
+	}
+
+	if keyType == "" {
+		keyType, _ = newConf.Config["PrivateKeyType"].(string)
+		if keyType == "" {
+			keyType = "ec"
+		}
+		if keyBits == 0 {
+			if bits, ok := newConf.Config["PrivateKeyBits"].(float64); ok {
+				keyBits = int(bits)
+			}
+		}
+	}
+	if keyBits == 0 {
+		keyBits = defaultKeyBits(keyType)
+	}
+	newConf.Config["PrivateKeyType"] = keyType
+	newConf.Config["PrivateKeyBits"] = keyBits
+
+	switch conf.Provider {
+	case "consul":
+		// Without a fresh key the provider happily regenerates the same root.
+		key, err := generateCAPrivateKey(keyType, keyBits)
+		if err != nil {
+			return nil, err
+		}
+		newConf.Config["PrivateKey"] = key
+		delete(newConf.Config, "RootCert")
+	case "vault":
+		newConf.Config["RootPKIPath"] = vaultRootPKIPath + "-" + strconv.FormatInt(now.Unix(), 10)
+	default:
+		return nil, fmt.Errorf("rotating the %q ca provider is not supported", conf.Provider)
+	}
+
+	return newConf, nil
+}
+
+func generateCAPrivateKey(keyType string, keyBits int) (string, error) {
+	signer, err := generatePrivateKey(keyType, keyBits)
+	if err != nil {
+		return "", err
+	}
+	return encodePrivateKey(signer)
+}
+
+// waitForSidecarLeaf waits until the node's agent hands out a leaf that
+// chains to the given root and envoy has actually loaded that leaf. The
+// builtin proxy has no admin API, so only the agent leaf is checked for it.
+func (c *Core) waitForSidecarLeaf(ctx context.Context, node *Node, token, rootID string) error {
+	agentClient, err := consulfunc.GetClient(node.LocalAddress(), token)
+	if err != nil {
+		return err
+	}
+
+	what := "the sidecar on " + node.Name + " to pick up a leaf from the new root"
+	return retryFor(ctx, what, func() (bool, error) {
+		roots, err := getCARoots(agentClient, "")
+		if err != nil {
+			c.logger.Warn("error listing ca roots", "node", node.Name, "error", err)
+			return false, nil
+		}
+		root := roots.Active()
+		if root == nil || root.ID != rootID {
+			return false, nil
+		}
+
+		leaf, _, err := agentClient.Agent().ConnectCALeaf(node.Service.Name, &api.QueryOptions{
+			Namespace: node.Service.Namespace,
+		})
+		if err != nil {
+			c.logger.Warn("error fetching leaf", "node", node.Name, "error", err)
+			return false, nil
+		}
+		if err := verifyLeafChain(leaf.CertPEM, root); err != nil {
+			c.logger.Debug("leaf does not chain to the new root yet", "node", node.Name, "error", err)
+			return false, nil
+		}
+		if node.UseBuiltinProxy {
+			return true, nil
+		}
+
+		serials, err := envoyCertSerials(node.LocalAddress() + ":19000")
+		if err != nil {
+			c.logger.Warn("error fetching certs from envoy", "node", node.Name, "error", err)
+			return false, nil
+		}
+		return serials[normalizeSerial(leaf.SerialNumber)], nil
+	})
+}
+
+// waitForGatewayRoot waits until the mesh gateway's envoy has loaded the new
+// root. Gateways that route purely by SNI hold no certificates at all, in
+// which case there is nothing to wait for.
+func (c *Core) waitForGatewayRoot(ctx context.Context, node *Node, root *caRoot) error {
+	what := "the mesh gateway on " + node.Name + " to pick up the new root"
+	serial := normalizeSerial(fmt.Sprintf("%x", root.SerialNumber))
+	return retryFor(ctx, what, func() (bool, error) {
+		serials, err := envoyCertSerials(node.LocalAddress() + ":19000")
+		if err != nil {
+			c.logger.Warn("error fetching certs from envoy", "node", node.Name, "error", err)
+			return false, nil
+		}
+		if len(serials) == 0 {
+			c.logger.Debug("mesh gateway holds no certificates", "node", node.Name)
+			return true, nil
+		}
+		return serials[serial], nil
+	})
+}
+
+func verifyLeafChain(leafPEM string, root *caRoot) error {
+	leaf, err := parseCertPEM(leafPEM)
+	if err != nil {
+		return err
+	}
+
+	rootPool := x509.NewCertPool()
+	if !rootPool.AppendCertsFromPEM([]byte(root.RootCert)) {
+		return fmt.Errorf("could not parse root certificate")
+	}
+	intermediatePool := x509.NewCertPool()
+	for _, certPEM := range root.IntermediateCerts {
+		intermediatePool.AppendCertsFromPEM([]byte(certPEM))
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// envoyCertSerials returns the serial numbers of every certificate chain and
+// CA certificate currently loaded into the envoy at the given admin address.
+func envoyCertSerials(adminAddr string) (map[string]bool, error) {
+	resp, err := cleanhttp.DefaultClient().Get("http://" + adminAddr + "/certs")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+
+	var certs struct {
+		Certificates []struct {
+			CACert []struct {
+				SerialNumber string `json:"serial_number"`
+			} `json:"ca_cert"`
+			CertChain []struct {
+				SerialNumber string `json:"serial_number"`
+			} `json:"cert_chain"`
+		} `json:"certificates"`
+	}
+	if err := json.Unmarshal(body, &certs); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]bool)
+	for _, c := range certs.Certificates {
+		for _, cert := range c.CACert {
+			out[normalizeSerial(cert.SerialNumber)] = true
+		}
+		for _, cert := range c.CertChain {
+			out[normalizeSerial(cert.SerialNumber)] = true
+		}
+	}
+	return out, nil
+}
+
+// normalizeSerial maps both consul's colon separated form and envoy's plain
+// hex form of a serial number to the same string.
+func normalizeSerial(s string) string {
+	s = strings.ToLower(strings.Replace(s, ":", "", -1))
+	s = strings.TrimLeft(s, "0")
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+func parseCertPEM(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextCAConfig(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	t.Run("consul keeps key type", func(t *testing.T) {
+		conf := &api.CAConfig{
+			Provider: "consul",
+			Config: map[string]interface{}{
+				"LeafCertTTL":    "72h",
+				"PrivateKeyType": "rsa",
+				"PrivateKeyBits": float64(2048),
+				"RootCert":       "old-root",
+			},
+		}
+		got, err := nextCAConfig(conf, "", 0, now)
+		require.NoError(t, err)
+		require.Equal(t, "consul", got.Provider)
+		require.Equal(t, "72h", got.Config["LeafCertTTL"])
+		require.Equal(t, "rsa", got.Config["PrivateKeyType"])
+		require.Equal(t, 2048, got.Config["PrivateKeyBits"])
+		require.Contains(t, got.Config["PrivateKey"], "RSA PRIVATE KEY")
+		require.NotContains(t, got.Config, "RootCert")
+
+		// the original is untouched
+		require.Equal(t, "old-root", conf.Config["RootCert"])
+	})
+
+	t.Run("consul switch to ec", func(t *testing.T) {
+		conf := &api.CAConfig{
+			Provider: "consul",
+			Config: map[string]interface{}{
+				"PrivateKeyType": "rsa",
+				"PrivateKeyBits": float64(4096),
+			},
+		}
+		got, err := nextCAConfig(conf, "ec", 0, now)
+		require.NoError(t, err)
+		require.Equal(t, "ec", got.Config["PrivateKeyType"])
+		require.Equal(t, 256, got.Config["PrivateKeyBits"])
+		require.Contains(t, got.Config["PrivateKey"], "EC PRIVATE KEY")
+	})
+
+	t.Run("vault moves root mount", func(t *testing.T) {
+		conf := &api.CAConfig{
+			Provider: "vault",
+			Config: map[string]interface{}{
+				"RootPKIPath":         "connect-root",
+				"IntermediatePKIPath": "connect-intermediate-dc1",
+			},
+		}
+		got, err := nextCAConfig(conf, "ec", 384, now)
+		require.NoError(t, err)
+		require.Equal(t, "connect-root-1600000000", got.Config["RootPKIPath"])
+		require.Equal(t, "connect-intermediate-dc1", got.Config["IntermediatePKIPath"])
+		require.Equal(t, 384, got.Config["PrivateKeyBits"])
+		require.NotContains(t, got.Config, "PrivateKey")
+	})
+
+	t.Run("unsupported provider", func(t *testing.T) {
+		_, err := nextCAConfig(&api.CAConfig{Provider: "aws-pca"}, "", 0, now)
+		require.Error(t, err)
+	})
+}
+
+func TestNormalizeSerial(t *testing.T) {
+	require.Equal(t, "a1b2", normalizeSerial("00:a1:B2"))
+	require.Equal(t, "a1b2", normalizeSerial("a1b2"))
+	require.Equal(t, "0", normalizeSerial("00"))
+}
+
+func TestEnvoyCertSerials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/certs", r.URL.Path)
+		w.Write([]byte(`{"certificates": [{
+			"ca_cert": [{"serial_number": "0a"}],
+			"cert_chain": [{"serial_number": "b1"}]
+		}]}`))
+	}))
+	defer srv.Close()
+
+	got, err := envoyCertSerials(strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"a": true, "b1": true}, got)
+}
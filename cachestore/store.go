@@ -1,6 +1,7 @@
 package cachestore
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -11,8 +12,12 @@ import (
 
 type Store struct {
 	cacheDir string
+	readOnly bool
 }
 
+// ErrReadOnly is returned by every write to a store opened with OpenReadOnly.
+var ErrReadOnly = errors.New("cache is read-only")
+
 func New(cacheDir string) (*Store, error) {
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
 		return nil, err
@@ -23,6 +28,12 @@ func New(cacheDir string) (*Store, error) {
 	return s, nil
 }
 
+// OpenReadOnly is like New, except the cache directory is not created and
+// nothing can be written to it. A missing directory reads as empty.
+func OpenReadOnly(cacheDir string) *Store {
+	return &Store{cacheDir: cacheDir, readOnly: true}
+}
+
 func (s *Store) LoadOrSaveValue(name string, fetchFn func() (string, error)) (string, error) {
 	val, err := s.LoadValue(name)
 	if err != nil {
@@ -56,12 +67,18 @@ func (s *Store) LoadValue(name string) (string, error) {
 }
 
 func (s *Store) SaveValue(name, value string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
 	fn := filepath.Join(s.cacheDir, name+".val")
 	_, err := safeio.WriteToFile(strings.NewReader(value), fn, 0644)
 	return err
 }
 
 func (s *Store) DelValue(name string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
 	fn := filepath.Join(s.cacheDir, name+".val")
 	err := os.Remove(fn)
 	if os.IsNotExist(err) {
@@ -82,6 +99,9 @@ func (s *Store) LoadStringFile(filename string) (string, error) {
 }
 
 func (s *Store) WriteStringFile(filename, contents string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
 	fn := filepath.Join(s.cacheDir, filename)
 	_, err := safeio.WriteToFile(strings.NewReader(contents), fn, 0644)
 	return err
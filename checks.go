@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// sidecarPublicPort is the first port consul hands out to sidecars, and every
+// pod only has the one.
+const sidecarPublicPort = 21000
+
+// ServiceCheck is a single health check in a service registration. Only the
+// fields that apply to its Type are set.
+type ServiceCheck struct {
+	Name string
+	Type string
+
+	HTTP              string
+	Method            string
+	TCP               string
+	GRPC              string
+	TTL               string
+	DockerContainerID string
+	Shell             string
+	Args              []string
+	AliasService      string
+
+	Interval                       string
+	Timeout                        string
+	Status                         string
+	DeregisterCriticalServiceAfter string
+}
+
+// HealthChecks returns the checks to register with the service, which is a
+// plain HTTP check against /healthz unless some were configured.
+func (s *Service) HealthChecks() []*ServiceCheck {
+	if len(s.Checks) > 0 {
+		return s.Checks
+	}
+	return []*ServiceCheck{{
+		Name:     "up",
+		Type:     "http",
+		HTTP:     "http://localhost:" + strconv.Itoa(s.Port) + "/healthz",
+		Method:   "GET",
+		Interval: "5s",
+		Timeout:  "1s",
+	}}
+}
+
+// SidecarHealthChecks returns the checks to register with the sidecar once
+// some were configured. Any checks on a sidecar_service replace the ones
+// consul would add itself, so those are kept in front of the configured ones.
+func (s *Service) SidecarHealthChecks() []*ServiceCheck {
+	if len(s.SidecarChecks) == 0 {
+		return nil
+	}
+	out := []*ServiceCheck{
+		{
+			Name:     "Connect Sidecar Listening",
+			Type:     "tcp",
+			TCP:      "127.0.0.1:" + strconv.Itoa(sidecarPublicPort),
+			Interval: "10s",
+		},
+		{
+			Name:         "Connect Sidecar Aliasing " + s.Name,
+			Type:         "alias",
+			AliasService: s.Name,
+		},
+	}
+	return append(out, s.SidecarChecks...)
+}
+
+func (s *Service) allChecks() []*ServiceCheck {
+	out := append([]*ServiceCheck(nil), s.HealthChecks()...)
+	return append(out, s.SidecarChecks...)
+}
+
+// NeedsScriptChecks is true if the agent has to allow script checks for this
+// service. Registration goes through the HTTP API, so enabling just local
+// script checks is not enough.
+func (s *Service) NeedsScriptChecks() bool {
+	for _, check := range s.allChecks() {
+		if check.Type == "script" || check.Type == "docker" {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsDockerSocket is true if the agent has to reach the docker daemon to
+// run this service's checks.
+func (s *Service) NeedsDockerSocket() bool {
+	for _, check := range s.allChecks() {
+		if check.Type == "docker" {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) NeedsDockerSocket() bool {
+	return n.Service != nil && n.Service.NeedsDockerSocket()
+}
+
+// buildServiceChecks turns the configured checks into ones that can be
+// rendered. Network checks target localhost on the given port unless they
+// say otherwise, and docker checks exec into the given container.
+func buildServiceChecks(
+	checks []*userConfigServiceCheck,
+	serviceName string,
+	port int,
+	containerName string,
+) ([]*ServiceCheck, error) {
+	var out []*ServiceCheck
+	seen := make(map[string]struct{})
+	for _, uc := range checks {
+		if _, ok := seen[uc.Name]; ok {
+			return nil, fmt.Errorf("check %q is defined more than once", uc.Name)
+		}
+		seen[uc.Name] = struct{}{}
+
+		check, err := buildServiceCheck(uc, serviceName, port, containerName)
+		if err != nil {
+			return nil, fmt.Errorf("check %q: %v", uc.Name, err)
+		}
+		out = append(out, check)
+	}
+	return out, nil
+}
+
+func buildServiceCheck(uc *userConfigServiceCheck, serviceName string, port int, containerName string) (*ServiceCheck, error) {
+	check := &ServiceCheck{
+		Name:                           uc.Name,
+		Type:                           uc.Type,
+		Interval:                       uc.Interval,
+		Timeout:                        uc.Timeout,
+		Status:                         uc.Status,
+		DeregisterCriticalServiceAfter: uc.DeregisterCriticalServiceAfter,
+	}
+
+	if uc.Port != 0 {
+		port = uc.Port
+	}
+	addr := "localhost:" + strconv.Itoa(port)
+
+	periodic := true
+	switch uc.Type {
+	case "http":
+		path := defaultValue(uc.Path, "/healthz")
+		if path[0] != '/' {
+			return nil, fmt.Errorf("path must start with a slash")
+		}
+		check.HTTP = "http://" + addr + path
+		check.Method = defaultValue(uc.Method, "GET")
+	case "tcp":
+		check.TCP = addr
+	case "grpc":
+		check.GRPC = addr
+	case "ttl":
+		if uc.TTL == "" {
+			return nil, fmt.Errorf("ttl checks require ttl")
+		}
+		check.TTL = uc.TTL
+		periodic = false
+	case "script":
+		if len(uc.Args) == 0 {
+			return nil, fmt.Errorf("script checks require args")
+		}
+		check.Args = uc.Args
+	case "docker":
+		if len(uc.Args) == 0 {
+			return nil, fmt.Errorf("docker checks require args")
+		}
+		if containerName == "" {
+			return nil, fmt.Errorf("docker checks need a container to run in")
+		}
+		check.DockerContainerID = containerName
+		check.Shell = defaultValue(uc.Shell, "/bin/sh")
+		check.Args = uc.Args
+	case "alias":
+		check.AliasService = defaultValue(uc.AliasService, serviceName)
+		periodic = false
+	case "":
+		return nil, fmt.Errorf("type is required")
+	default:
+		return nil, fmt.Errorf("unknown type %q", uc.Type)
+	}
+
+	if uc.Path != "" && uc.Type != "http" {
+		return nil, fmt.Errorf("path only applies to http checks")
+	}
+	if uc.Method != "" && uc.Type != "http" {
+		return nil, fmt.Errorf("method only applies to http checks")
+	}
+
+	if periodic {
+		check.Interval = defaultValue(check.Interval, "5s")
+		if uc.Type != "script" && uc.Type != "docker" {
+			check.Timeout = defaultValue(check.Timeout, "1s")
+		}
+	} else if uc.Interval != "" || uc.Timeout != "" {
+		return nil, fmt.Errorf("interval and timeout do not apply to %s checks", uc.Type)
+	}
+
+	for _, d := range []struct{ name, val string }{
+		{"interval", check.Interval},
+		{"timeout", check.Timeout},
+		{"ttl", check.TTL},
+		{"deregister_critical_service_after", check.DeregisterCriticalServiceAfter},
+	} {
+		if d.val == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d.val); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", d.name, err)
+		}
+	}
+
+	switch uc.Status {
+	case "", "passing", "warning", "critical":
+	default:
+		return nil, fmt.Errorf("unknown status %q", uc.Status)
+	}
+
+	return check, nil
+}
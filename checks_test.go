@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceChecks(t *testing.T) {
+	body := `
+		topology {
+			datacenter "dc1" {
+				servers = 1
+				clients = 2
+			}
+			node "dc1-client1" {
+				check "ready" {
+					type   = "http"
+					path   = "/ready"
+					method = "HEAD"
+				}
+				check "heartbeat" {
+					type   = "ttl"
+					ttl    = "30s"
+					status = "critical"
+					deregister_critical_service_after = "1m"
+				}
+				check "poke" {
+					type = "docker"
+					args = ["/bin/pingpong", "-check"]
+				}
+				sidecar_check "envoy-ready" {
+					type = "http"
+					port = 19000
+					path = "/ready"
+				}
+				sidecar_check "app" {
+					type = "alias"
+				}
+			}
+		}
+	`
+	cfg, topo, err := parseConfig([]byte(body))
+	require.NoError(t, err)
+
+	svc := topo.Node("dc1-client1").Service
+	require.Equal(t, []*ServiceCheck{
+		{
+			Name:     "ready",
+			Type:     "http",
+			HTTP:     "http://localhost:8080/ready",
+			Method:   "HEAD",
+			Interval: "5s",
+			Timeout:  "1s",
+		},
+		{
+			Name:                           "heartbeat",
+			Type:                           "ttl",
+			TTL:                            "30s",
+			Status:                         "critical",
+			DeregisterCriticalServiceAfter: "1m",
+		},
+		{
+			Name:              "poke",
+			Type:              "docker",
+			DockerContainerID: "dc1-client1-ping",
+			Shell:             "/bin/sh",
+			Args:              []string{"/bin/pingpong", "-check"},
+			Interval:          "5s",
+		},
+	}, svc.Checks)
+	require.Equal(t, "http://localhost:19000/ready", svc.SidecarChecks[0].HTTP)
+	require.Equal(t, "ping", svc.SidecarChecks[1].AliasService)
+
+	require.True(t, topo.Node("dc1-client1").NeedsDockerSocket())
+	require.False(t, topo.Node("dc1-client2").NeedsDockerSocket())
+
+	c := &Core{config: cfg, topology: topo}
+	require.True(t, c.agentConfigInfo(topo.Node("dc1-client1")).EnableScriptChecks)
+	require.False(t, c.agentConfigInfo(topo.Node("dc1-client2")).EnableScriptChecks)
+
+	regHCL, err := GetServiceRegistrationHCL(*svc)
+	require.NoError(t, err)
+	// ignore alignment
+	regHCL = strings.Join(strings.Fields(regHCL), " ")
+	require.Contains(t, regHCL, `args = ["/bin/pingpong", "-check"]`)
+	// Configured sidecar checks replace consul's defaults, so those are
+	// rendered too.
+	require.Contains(t, regHCL, `sidecar_service { checks = [ { name = "Connect Sidecar Listening" tcp = "127.0.0.1:21000" interval = "10s" },`+
+		` { name = "Connect Sidecar Aliasing ping" alias_service = "ping" },`+
+		` { name = "envoy-ready"`)
+	require.NotContains(t, regHCL, "/healthz")
+
+	// Everyone else keeps the stock check.
+	regHCL, err = GetServiceRegistrationHCL(*topo.Node("dc1-client2").Service)
+	require.NoError(t, err)
+	require.Contains(t, regHCL, `http     = "http://localhost:8080/healthz"`)
+	require.NotContains(t, regHCL, "Connect Sidecar")
+}
+
+func TestServiceChecks_Quoting(t *testing.T) {
+	svc := Service{
+		Name: "ping",
+		Port: 8080,
+		Checks: []*ServiceCheck{{
+			Name:     `say "hi" \ bye`,
+			Type:     "http",
+			HTTP:     `http://localhost:8080/a"b`,
+			Interval: "5s",
+		}},
+	}
+	regHCL, err := GetServiceRegistrationHCL(svc)
+	require.NoError(t, err)
+	require.Contains(t, regHCL, `name     = "say \"hi\" \\ bye"`)
+	require.Contains(t, regHCL, `http     = "http://localhost:8080/a\"b"`)
+}
+
+func TestServiceChecks_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"no type":         `check "a" { type = "" }`,
+		"unknown type":    `check "a" { type = "smoke-signal" }`,
+		"ttl without ttl": `check "a" { type = "ttl" }`,
+		"ttl interval":    `check "a" { type = "ttl" ttl = "10s" interval = "5s" }`,
+		"path on tcp":     `check "a" { type = "tcp" path = "/x" }`,
+		"bad interval":    `check "a" { type = "tcp" interval = "often" }`,
+		"bad status":      `check "a" { type = "tcp" status = "meh" }`,
+		"script no args":  `check "a" { type = "script" }`,
+		"duplicate":       `check "a" { type = "tcp" } check "a" { type = "grpc" }`,
+	}
+	for name, checks := range cases {
+		t.Run(name, func(t *testing.T) {
+			body := `
+				topology {
+					datacenter "dc1" {
+						servers = 1
+						clients = 1
+					}
+					node "dc1-client1" {
+						` + checks + `
+					}
+				}
+			`
+			_, _, err := parseConfig([]byte(body))
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rboyer/devconsul/consulfunc"
+)
+
+// configEntryWriteOrder is knownConfigEntryKinds ordered so that every entry
+// is written after the ones it refers to: protocols are set before anything
+// that depends on them, and subsets exist before anything routes to them.
+var configEntryWriteOrder = []string{
+	api.ProxyDefaults,
+	api.ServiceDefaults,
+	api.ServiceResolver,
+	api.ServiceSplitter,
+	api.ServiceRouter,
+	api.TerminatingGateway,
+	api.IngressGateway,
+	api.ServiceIntentions,
+}
+
+// sortConfigEntriesForWrite orders entries by configEntryWriteOrder, keeping
+// the config file order within a kind.
+func sortConfigEntriesForWrite(entries []api.ConfigEntry) {
+	rank := make(map[string]int)
+	for i, kind := range configEntryWriteOrder {
+		rank[kind] = i
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return rank[entries[i].GetKind()] < rank[entries[j].GetKind()]
+	})
+}
+
+type configServiceName struct {
+	Namespace string
+	Name      string
+}
+
+// configEntryRefs resolves the services that config entries refer to.
+type configEntryRefs struct {
+	namespaced bool
+	services   map[configServiceName]struct{}
+	subsets    map[configServiceName]map[string]struct{} // from resolvers
+}
+
+func (r *configEntryRefs) serviceName(name, namespace, entryNamespace string) configServiceName {
+	if !r.namespaced {
+		return configServiceName{Name: name}
+	}
+	return configServiceName{
+		Namespace: defaultValue(namespace, defaultValue(entryNamespace, "default")),
+		Name:      name,
+	}
+}
+
+func (sn configServiceName) String() string {
+	if sn.Namespace == "" {
+		return sn.Name
+	}
+	return sn.Namespace + "/" + sn.Name
+}
+
+// check reports a reference to an undefined service, or to a subset its
+// resolver does not define.
+func (r *configEntryRefs) check(sn configServiceName, subset string) error {
+	if _, ok := r.services[sn]; !ok {
+		return fmt.Errorf("refers to undefined service %q", sn)
+	}
+	if subset == "" {
+		return nil
+	}
+	if _, ok := r.subsets[sn][subset]; !ok {
+		return fmt.Errorf("refers to undefined subset %q of service %q", subset, sn)
+	}
+	return nil
+}
+
+// validateConfigEntries finds references to services and subsets that
+// neither the topology nor the entries themselves define. The services in
+// the topology are given in services.
+func validateConfigEntries(entries []api.ConfigEntry, services []configServiceName, namespaced bool) error {
+	refs := &configEntryRefs{
+		namespaced: namespaced,
+		services:   make(map[configServiceName]struct{}),
+		subsets:    make(map[configServiceName]map[string]struct{}),
+	}
+	for _, sn := range services {
+		refs.services[sn] = struct{}{}
+	}
+	for _, entry := range entries {
+		switch entry.GetKind() {
+		case api.ServiceDefaults, api.ServiceResolver, api.ServiceSplitter, api.ServiceRouter:
+			refs.services[refs.serviceName(entry.GetName(), "", entry.GetNamespace())] = struct{}{}
+		}
+		if resolver, ok := entry.(*api.ServiceResolverConfigEntry); ok {
+			sn := refs.serviceName(resolver.Name, "", resolver.Namespace)
+			subsets := make(map[string]struct{})
+			for name := range resolver.Subsets {
+				subsets[name] = struct{}{}
+			}
+			refs.subsets[sn] = subsets
+		}
+	}
+
+	var merr *multierror.Error
+	fail := func(entry api.ConfigEntry, what string, err error) {
+		merr = multierror.Append(merr, fmt.Errorf("%s/%s: %s %v",
+			entry.GetKind(), entry.GetName(), what, err))
+	}
+
+	for _, entry := range entries {
+		switch e := entry.(type) {
+		case *api.ServiceResolverConfigEntry:
+			self := refs.serviceName(e.Name, "", e.Namespace)
+			if e.DefaultSubset != "" {
+				if err := refs.check(self, e.DefaultSubset); err != nil {
+					fail(e, "default_subset", err)
+				}
+			}
+			if rd := e.Redirect; rd != nil && rd.Datacenter == "" {
+				sn := refs.serviceName(defaultValue(rd.Service, e.Name), rd.Namespace, e.Namespace)
+				if err := refs.check(sn, rd.ServiceSubset); err != nil {
+					fail(e, "redirect", err)
+				}
+			}
+			keys := make([]string, 0, len(e.Failover))
+			for k := range e.Failover {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if k != "*" {
+					if err := refs.check(self, k); err != nil {
+						fail(e, "failover", err)
+					}
+				}
+				fo := e.Failover[k]
+				if fo.Service == "" && fo.ServiceSubset == "" {
+					continue
+				}
+				sn := refs.serviceName(defaultValue(fo.Service, e.Name), fo.Namespace, e.Namespace)
+				if err := refs.check(sn, fo.ServiceSubset); err != nil {
+					fail(e, fmt.Sprintf("failover %q", k), err)
+				}
+			}
+		case *api.ServiceSplitterConfigEntry:
+			for i, split := range e.Splits {
+				sn := refs.serviceName(defaultValue(split.Service, e.Name), split.Namespace, e.Namespace)
+				if err := refs.check(sn, split.ServiceSubset); err != nil {
+					fail(e, fmt.Sprintf("split %d", i), err)
+				}
+			}
+		case *api.ServiceRouterConfigEntry:
+			for i, route := range e.Routes {
+				dest := route.Destination
+				if dest == nil {
+					continue
+				}
+				sn := refs.serviceName(defaultValue(dest.Service, e.Name), dest.Namespace, e.Namespace)
+				if err := refs.check(sn, dest.ServiceSubset); err != nil {
+					fail(e, fmt.Sprintf("route %d", i), err)
+				}
+			}
+		case *api.IngressGatewayConfigEntry:
+			for _, l := range e.Listeners {
+				for _, svc := range l.Services {
+					if svc.Name == "*" {
+						continue
+					}
+					sn := refs.serviceName(svc.Name, svc.Namespace, e.Namespace)
+					if err := refs.check(sn, ""); err != nil {
+						fail(e, fmt.Sprintf("listener %d", l.Port), err)
+					}
+				}
+			}
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// topologyServiceNames lists the services that run in the topology.
+func (c *Core) topologyServiceNames() []configServiceName {
+	var out []configServiceName
+	c.topology.WalkSilent(func(n *Node) {
+		if n.Service == nil {
+			return
+		}
+		sn := configServiceName{Name: n.Service.Name}
+		if c.config.EnterpriseEnabled {
+			sn.Namespace = defaultValue(n.Service.Namespace, "default")
+		}
+		out = append(out, sn)
+	})
+	return out
+}
+
+// configEntryServerFields are filled in by the servers and never differ in a
+// way that matters.
+var configEntryServerFields = []string{"CreateIndex", "ModifyIndex"}
+
+// normalizeConfigEntry turns an entry into plain JSON values with the server
+// populated fields and every zero value removed. The namespace is dropped
+// too, since it is part of how entries are keyed. Meta is only kept when
+// keepMeta is set.
+func normalizeConfigEntry(entry api.ConfigEntry, keepMeta bool) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	if err := roundTripJSON(entry, &m); err != nil {
+		return nil, err
+	}
+	for _, field := range configEntryServerFields {
+		delete(m, field)
+	}
+	delete(m, "Namespace")
+	if !keepMeta {
+		delete(m, "Meta")
+	}
+	pruneZeroJSON(m)
+	return m, nil
+}
+
+func pruneZeroJSON(v interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range x {
+			pruneZeroJSON(sub)
+			if isZeroJSON(sub) {
+				delete(x, k)
+			}
+		}
+	case []interface{}:
+		for _, sub := range x {
+			pruneZeroJSON(sub)
+		}
+	}
+}
+
+// formatConfigEntryJSON renders a normalized entry with Kind, Namespace and
+// Name leading and everything else sorted.
+func formatConfigEntryJSON(m map[string]interface{}) (string, error) {
+	var keys []string
+	for _, k := range []string{"Kind", "Namespace", "Name"} {
+		if _, ok := m[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	var rest []string
+	for k := range m {
+		switch k {
+		case "Kind", "Namespace", "Name":
+		default:
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	keys = append(keys, rest...)
+
+	var buf strings.Builder
+	buf.WriteString("{\n")
+	for i, k := range keys {
+		v, err := json.MarshalIndent(m[k], "  ", "  ")
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&buf, "  %q: %s", k, v)
+		if i < len(keys)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+	return buf.String(), nil
+}
+
+// diffConfigEntries returns a unified diff from the live entries to the
+// desired ones, one entry at a time.
+func diffConfigEntries(live, desired map[consulfunc.ConfigKindName]api.ConfigEntry) (string, error) {
+	keys := make(map[consulfunc.ConfigKindName]struct{})
+	for ckn := range live {
+		keys[ckn] = struct{}{}
+	}
+	for ckn := range desired {
+		keys[ckn] = struct{}{}
+	}
+	sorted := make([]consulfunc.ConfigKindName, 0, len(keys))
+	for ckn := range keys {
+		sorted = append(sorted, ckn)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].String() < sorted[j].String()
+	})
+
+	var buf strings.Builder
+	for _, ckn := range sorted {
+		// Meta only counts when config.hcl sets it.
+		keepMeta := desired[ckn] != nil && len(desired[ckn].GetMeta()) > 0
+
+		var a, b string
+		for _, side := range []struct {
+			entry api.ConfigEntry
+			out   *string
+		}{
+			{live[ckn], &a},
+			{desired[ckn], &b},
+		} {
+			if side.entry == nil {
+				continue
+			}
+			m, err := normalizeConfigEntry(side.entry, keepMeta)
+			if err != nil {
+				return "", fmt.Errorf("%s: %v", ckn, err)
+			}
+			if *side.out, err = formatConfigEntryJSON(m); err != nil {
+				return "", fmt.Errorf("%s: %v", ckn, err)
+			}
+		}
+
+		buf.WriteString(unifiedDiff(
+			"live/"+ckn.String(),
+			"config.hcl/"+ckn.String(),
+			a, b, 3,
+		))
+	}
+	return buf.String(), nil
+}
+
+// exportConfigEntries renders entries as a config_entries attribute that
+// can be pasted into config.hcl.
+func exportConfigEntries(entries []api.ConfigEntry, namespaced bool) (string, error) {
+	entries = append([]api.ConfigEntry(nil), entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		a := consulfunc.NewConfigKindName(entries[i], namespaced)
+		b := consulfunc.NewConfigKindName(entries[j], namespaced)
+		return a.String() < b.String()
+	})
+	sortConfigEntriesForWrite(entries)
+
+	var buf strings.Builder
+	buf.WriteString("config_entries = [\n")
+	for _, entry := range entries {
+		m, err := normalizeConfigEntry(entry, true)
+		if err != nil {
+			return "", err
+		}
+		if ns := entry.GetNamespace(); namespaced && ns != "" && ns != "default" {
+			m["Namespace"] = ns
+		}
+		body, err := formatConfigEntryJSON(m)
+		if err != nil {
+			return "", err
+		}
+		// Keep HCL from treating anything in the heredoc as a template.
+		body = strings.NewReplacer("${", "$${", "%{", "%%{").Replace(body)
+
+		buf.WriteString("  <<EOF\n")
+		buf.WriteString(body)
+		buf.WriteString("EOF\n")
+		buf.WriteString("  ,\n")
+	}
+	buf.WriteString("]\n")
+	return buf.String(), nil
+}
+
+func (c *Core) runConfigEntriesDiff(client *api.Client) error {
+	namespaced := c.config.EnterpriseEnabled
+
+	live, err := consulfunc.ListAllConfigEntries(client, knownConfigEntryKinds, namespaced)
+	if err != nil {
+		return err
+	}
+
+	entries, err := c.desiredConfigEntries()
+	if err != nil {
+		return err
+	}
+	desired := make(map[consulfunc.ConfigKindName]api.ConfigEntry)
+	for _, entry := range entries {
+		desired[consulfunc.NewConfigKindName(entry, namespaced)] = entry
+	}
+
+	out, err := diffConfigEntries(live, desired)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		fmt.Println("no differences")
+		return nil
+	}
+	fmt.Print(out)
+	return nil
+}
+
+func (c *Core) runConfigEntriesExport(client *api.Client) error {
+	namespaced := c.config.EnterpriseEnabled
+
+	live, err := consulfunc.ListAllConfigEntries(client, knownConfigEntryKinds, namespaced)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]api.ConfigEntry, 0, len(live))
+	for _, entry := range live {
+		entries = append(entries, entry)
+	}
+
+	out, err := exportConfigEntries(entries, namespaced)
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	return nil
+}
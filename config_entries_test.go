@@ -0,0 +1,205 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/rboyer/devconsul/consulfunc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigEntryWriteOrder(t *testing.T) {
+	require.ElementsMatch(t, knownConfigEntryKinds, configEntryWriteOrder)
+
+	entries := []api.ConfigEntry{
+		&api.ServiceRouterConfigEntry{Kind: api.ServiceRouter, Name: "pong"},
+		&api.ServiceResolverConfigEntry{Kind: api.ServiceResolver, Name: "pong"},
+		&api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "pong"},
+		&api.ServiceResolverConfigEntry{Kind: api.ServiceResolver, Name: "ping"},
+		&api.ProxyConfigEntry{Kind: api.ProxyDefaults, Name: api.ProxyConfigGlobal},
+	}
+	sortConfigEntriesForWrite(entries)
+
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.GetKind()+"/"+entry.GetName())
+	}
+	require.Equal(t, []string{
+		"proxy-defaults/global",
+		"service-defaults/pong",
+		"service-resolver/pong",
+		"service-resolver/ping",
+		"service-router/pong",
+	}, got)
+}
+
+func TestValidateConfigEntries(t *testing.T) {
+	services := []configServiceName{{Name: "ping"}, {Name: "pong"}}
+
+	resolver := &api.ServiceResolverConfigEntry{
+		Kind:          api.ServiceResolver,
+		Name:          "pong",
+		DefaultSubset: "v1",
+		Subsets: map[string]api.ServiceResolverSubset{
+			"v1": {Filter: "Service.Meta.version == v1"},
+			"v2": {Filter: "Service.Meta.version == v2"},
+		},
+	}
+
+	require.NoError(t, validateConfigEntries([]api.ConfigEntry{
+		&api.ServiceRouterConfigEntry{
+			Kind: api.ServiceRouter,
+			Name: "pong",
+			Routes: []api.ServiceRoute{
+				{Destination: &api.ServiceRouteDestination{ServiceSubset: "v2"}},
+			},
+		},
+		resolver,
+		&api.ServiceSplitterConfigEntry{
+			Kind: api.ServiceSplitter,
+			Name: "pong-virtual",
+			Splits: []api.ServiceSplit{
+				{Weight: 50, Service: "pong", ServiceSubset: "v1"},
+				{Weight: 50, Service: "pong", ServiceSubset: "v2"},
+			},
+		},
+		&api.IngressGatewayConfigEntry{
+			Kind: api.IngressGateway,
+			Name: "ingress",
+			Listeners: []api.IngressListener{{
+				Port:     8080,
+				Services: []api.IngressService{{Name: "pong-virtual"}, {Name: "*"}},
+			}},
+		},
+	}, services, false))
+
+	err := validateConfigEntries([]api.ConfigEntry{
+		resolver,
+		&api.ServiceRouterConfigEntry{
+			Kind: api.ServiceRouter,
+			Name: "pong",
+			Routes: []api.ServiceRoute{
+				{Destination: &api.ServiceRouteDestination{ServiceSubset: "v3"}},
+			},
+		},
+		&api.ServiceSplitterConfigEntry{
+			Kind: api.ServiceSplitter,
+			Name: "ping",
+			Splits: []api.ServiceSplit{
+				{Weight: 100, Service: "pang"},
+			},
+		},
+		&api.ServiceResolverConfigEntry{
+			Kind:          api.ServiceResolver,
+			Name:          "ping",
+			DefaultSubset: "v1",
+		},
+	}, services, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `service-router/pong: route 0 refers to undefined subset "v3" of service "pong"`)
+	require.Contains(t, err.Error(), `service-splitter/ping: split 0 refers to undefined service "pang"`)
+	require.Contains(t, err.Error(), `service-resolver/ping: default_subset refers to undefined subset "v1" of service "ping"`)
+}
+
+func TestValidateConfigEntries_Namespaces(t *testing.T) {
+	services := []configServiceName{{Namespace: "default", Name: "ping"}, {Namespace: "foo", Name: "pong"}}
+
+	route := func(ns string) api.ConfigEntry {
+		return &api.ServiceRouterConfigEntry{
+			Kind: api.ServiceRouter,
+			Name: "ping",
+			Routes: []api.ServiceRoute{
+				{Destination: &api.ServiceRouteDestination{Service: "pong", Namespace: ns}},
+			},
+		}
+	}
+
+	require.NoError(t, validateConfigEntries([]api.ConfigEntry{route("foo")}, services, true))
+	require.EqualError(t, validateConfigEntries([]api.ConfigEntry{route("")}, services, true),
+		"1 error occurred:\n\t* service-router/ping: route 0 refers to undefined service \"default/pong\"\n\n")
+}
+
+func TestDiffConfigEntries(t *testing.T) {
+	ckn := consulfunc.ConfigKindName{Kind: api.ServiceDefaults, Name: "ping"}
+
+	desired := &api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "ping", Protocol: "http"}
+	live := &api.ServiceConfigEntry{
+		Kind:        api.ServiceDefaults,
+		Name:        "ping",
+		Protocol:    "http",
+		Meta:        map[string]string{"touched": "by-hand"},
+		CreateIndex: 10,
+		ModifyIndex: 12,
+	}
+
+	out, err := diffConfigEntries(
+		map[consulfunc.ConfigKindName]api.ConfigEntry{ckn: live},
+		map[consulfunc.ConfigKindName]api.ConfigEntry{ckn: desired},
+	)
+	require.NoError(t, err)
+	require.Empty(t, out)
+
+	live.Protocol = "tcp"
+	out, err = diffConfigEntries(
+		map[consulfunc.ConfigKindName]api.ConfigEntry{ckn: live},
+		map[consulfunc.ConfigKindName]api.ConfigEntry{ckn: desired},
+	)
+	require.NoError(t, err)
+	require.Equal(t, `--- live/service-defaults/ping
++++ config.hcl/service-defaults/ping
+@@ -1,5 +1,5 @@
+ {
+   "Kind": "service-defaults",
+   "Name": "ping",
+-  "Protocol": "tcp"
++  "Protocol": "http"
+ }
+`, out)
+}
+
+func TestExportConfigEntries(t *testing.T) {
+	out, err := exportConfigEntries([]api.ConfigEntry{
+		&api.ServiceConfigEntry{
+			Kind:        api.ServiceDefaults,
+			Name:        "ping",
+			Protocol:    "http",
+			Meta:        map[string]string{"note": "${oops}"},
+			ModifyIndex: 7,
+		},
+		&api.ProxyConfigEntry{
+			Kind:   api.ProxyDefaults,
+			Name:   api.ProxyConfigGlobal,
+			Config: map[string]interface{}{"protocol": "http"},
+		},
+	}, false)
+	require.NoError(t, err)
+	require.Equal(t, `config_entries = [
+  <<EOF
+{
+  "Kind": "proxy-defaults",
+  "Name": "global",
+  "Config": {
+    "protocol": "http"
+  }
+}
+EOF
+  ,
+  <<EOF
+{
+  "Kind": "service-defaults",
+  "Name": "ping",
+  "Meta": {
+    "note": "$${oops}"
+  },
+  "Protocol": "http"
+}
+EOF
+  ,
+]
+`, out)
+
+	config, _, err := parseConfigPartial([]byte(out))
+	require.NoError(t, err)
+	require.Len(t, config.ConfigEntries, 2)
+	require.Equal(t, "${oops}", config.ConfigEntries[1].GetMeta()["note"])
+}
@@ -81,6 +81,15 @@ func ListExistingPoliciesByName(client *api.Client) (map[string]string, error) {
 	return m, nil
 }
 
+func GetRoleByName(client *api.Client, name string) (*api.ACLRole, error) {
+	ac := client.ACL()
+	role, _, err := ac.RoleReadByName(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
 func ListExistingBindingRuleIDsForAuthMethod(client *api.Client, authMethod string) (map[string]string, error) {
 	ac := client.ACL()
 	all, _, err := ac.BindingRuleList(authMethod, nil)
@@ -192,6 +201,31 @@ func CreateOrUpdatePolicy(client *api.Client, p *api.ACLPolicy) (*api.ACLPolicy,
 	return op, nil
 }
 
+func CreateOrUpdateRole(client *api.Client, r *api.ACLRole) (*api.ACLRole, error) {
+	ac := client.ACL()
+
+	currentRole, err := GetRoleByName(client, r.Name)
+	if err != nil {
+		return nil, err
+	} else if currentRole != nil {
+		r.ID = currentRole.ID
+	}
+
+	if r.ID != "" {
+		or, _, err := ac.RoleUpdate(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		return or, nil
+	}
+
+	or, _, err := ac.RoleCreate(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return or, nil
+}
+
 func CreateOrUpdateAuthMethod(client *api.Client, am *api.ACLAuthMethod) (*api.ACLAuthMethod, error) {
 	ac := client.ACL()
 
@@ -5,34 +5,78 @@ import (
 )
 
 type ConfigKindName struct {
-	Kind string
-	Name string
+	Kind      string
+	Namespace string // empty unless namespaces are in use
+	Name      string
 }
 
-var kinds = []string{
-	api.ServiceDefaults,
-	api.ProxyDefaults,
-	api.ServiceRouter,
-	api.ServiceSplitter,
-	api.ServiceResolver,
+// NewConfigKindName keys an entry. When namespaces are in use an entry that
+// does not name one is in the default namespace.
+func NewConfigKindName(entry api.ConfigEntry, namespaced bool) ConfigKindName {
+	ckn := ConfigKindName{
+		Kind: entry.GetKind(),
+		Name: entry.GetName(),
+	}
+	if namespaced {
+		ckn.Namespace = entry.GetNamespace()
+		if ckn.Namespace == "" {
+			ckn.Namespace = "default"
+		}
+	}
+	return ckn
+}
+
+func (ckn ConfigKindName) String() string {
+	if ckn.Namespace == "" {
+		return ckn.Kind + "/" + ckn.Name
+	}
+	return ckn.Kind + "/" + ckn.Namespace + "/" + ckn.Name
+}
+
+// WriteOptions targets the namespace of the entry, if any.
+func (ckn ConfigKindName) WriteOptions() *api.WriteOptions {
+	if ckn.Namespace == "" {
+		return nil
+	}
+	return &api.WriteOptions{Namespace: ckn.Namespace}
 }
 
-func ListAllConfigEntries(client *api.Client) (map[ConfigKindName]api.ConfigEntry, error) {
+// ListAllConfigEntries lists every entry of the given kinds. When namespaced
+// is set every namespace is listed, not just the default one.
+func ListAllConfigEntries(client *api.Client, kinds []string, namespaced bool) (map[ConfigKindName]api.ConfigEntry, error) {
 	ce := client.ConfigEntries()
 
-	m := make(map[ConfigKindName]api.ConfigEntry)
-	for _, kind := range kinds {
-		entries, _, err := ce.List(kind, nil)
+	namespaces := []string{""}
+	if namespaced {
+		all, _, err := client.Namespaces().List(nil)
 		if err != nil {
 			return nil, err
 		}
+		namespaces = namespaces[:0]
+		for _, ns := range all {
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+
+	m := make(map[ConfigKindName]api.ConfigEntry)
+	for _, ns := range namespaces {
+		var opts *api.QueryOptions
+		if ns != "" {
+			opts = &api.QueryOptions{Namespace: ns}
+		}
+		for _, kind := range kinds {
+			entries, _, err := ce.List(kind, opts)
+			if err != nil {
+				return nil, err
+			}
 
-		for _, entry := range entries {
-			ckn := ConfigKindName{
-				Kind: entry.GetKind(),
-				Name: entry.GetName(),
+			for _, entry := range entries {
+				ckn := NewConfigKindName(entry, namespaced)
+				if namespaced && entry.GetNamespace() == "" {
+					ckn.Namespace = ns
+				}
+				m[ckn] = entry
 			}
-			m[ckn] = entry
 		}
 	}
 
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"sort"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-cleanhttp"
@@ -20,27 +22,49 @@ var knownConfigEntryKinds = []string{
 	api.ServiceIntentions,
 }
 
+// configEntryDeletionOrder is knownConfigEntryKinds ordered so that nothing
+// is deleted while another entry still refers to it.
+var configEntryDeletionOrder = []string{
+	api.ServiceIntentions,
+	api.IngressGateway,
+	api.TerminatingGateway,
+	api.ServiceRouter,
+	api.ServiceSplitter,
+	api.ServiceResolver,
+	api.ServiceDefaults,
+	api.ProxyDefaults,
+}
+
 func (c *Core) RunDebugListConfigs() error {
 	client, err := c.debugPrimaryClient()
 	if err != nil {
 		return err
 	}
-	_ = client
 
-	configClient := client.ConfigEntries()
-	for _, kind := range knownConfigEntryKinds {
-		entries, _, err := configClient.List(kind, nil)
-		if err != nil {
-			return err
-		}
-		for _, entry := range entries {
-			if c.config.EnterpriseEnabled {
-				fmt.Printf("%s/%s/%s\n", entry.GetKind(), entry.GetNamespace(), entry.GetName())
-			} else {
-				fmt.Printf("%s/%s\n", entry.GetKind(), entry.GetName())
-			}
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "diff":
+			return c.runConfigEntriesDiff(client)
+		case "export":
+			return c.runConfigEntriesExport(client)
+		default:
+			return fmt.Errorf("unknown config-entries subcommand: %s", args[0])
 		}
 	}
+
+	entries, err := consulfunc.ListAllConfigEntries(client, knownConfigEntryKinds, c.config.EnterpriseEnabled)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for ckn := range entries {
+		names = append(names, ckn.String())
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(name)
+	}
 	return nil
 }
 
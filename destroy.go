@@ -20,6 +20,7 @@ func (c *Core) destroy(_ bool) error {
 		"cache/grafana-prometheus.yml",
 		"cache/grafana.ini",
 		"cache/prometheus.yml",
+		"cache/" + tokenRegistryFile,
 	}
 
 	for _, patt := range []string{
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffCells bounds the size of the LCS table used by unifiedDiff. Past that
+// the changed region is just reported as a wholesale replacement.
+const maxDiffCells = 16 * 1024 * 1024
+
+type diffLine struct {
+	Op   byte // ' ', '-', or '+'
+	Text string
+}
+
+// unifiedDiff returns a unified diff with the given number of context lines
+// that turns a into b, or the empty string if they are the same.
+func unifiedDiff(aName, bName, a, b string, context int) string {
+	if a == b {
+		return ""
+	}
+
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n", aName)
+	fmt.Fprintf(&buf, "+++ %s\n", bName)
+
+	// Walk the edit script locating runs of changes and expanding each one by
+	// the context, merging any that overlap.
+	for i := 0; i < len(lines); {
+		if lines[i].Op == ' ' {
+			i++
+			continue
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		end := i
+		for end < len(lines) {
+			if lines[end].Op != ' ' {
+				end++
+				continue
+			}
+			// Count how far the next change is.
+			next := end
+			for next < len(lines) && lines[next].Op == ' ' {
+				next++
+			}
+			if next == len(lines) || next-end > 2*context {
+				end += context
+				if end > len(lines) {
+					end = len(lines)
+				}
+				break
+			}
+			end = next
+		}
+
+		aStart, bStart := 1, 1
+		for _, l := range lines[:start] {
+			if l.Op != '+' {
+				aStart++
+			}
+			if l.Op != '-' {
+				bStart++
+			}
+		}
+		var aLen, bLen int
+		for _, l := range lines[start:end] {
+			if l.Op != '+' {
+				aLen++
+			}
+			if l.Op != '-' {
+				bLen++
+			}
+		}
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, l := range lines[start:end] {
+			buf.WriteByte(l.Op)
+			buf.WriteString(l.Text)
+			buf.WriteByte('\n')
+		}
+
+		i = end
+	}
+
+	return buf.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines produces a full edit script turning a into b.
+func diffLines(a, b []string) []diffLine {
+	// Trim the common prefix and suffix so the LCS table only has to cover
+	// the region that actually changed.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var out []diffLine
+	for _, l := range a[:prefix] {
+		out = append(out, diffLine{' ', l})
+	}
+
+	am := a[prefix : len(a)-suffix]
+	bm := b[prefix : len(b)-suffix]
+
+	if (len(am)+1)*(len(bm)+1) > maxDiffCells {
+		for _, l := range am {
+			out = append(out, diffLine{'-', l})
+		}
+		for _, l := range bm {
+			out = append(out, diffLine{'+', l})
+		}
+	} else {
+		out = append(out, lcsDiff(am, bm)...)
+	}
+
+	for _, l := range a[len(a)-suffix:] {
+		out = append(out, diffLine{' ', l})
+	}
+	return out
+}
+
+func lcsDiff(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+
+	// table[i][j] is the LCS length of a[i:] and b[j:]
+	table := make([][]int, n+1)
+	for i := range table {
+		table[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else if table[i+1][j] >= table[i][j+1] {
+				table[i][j] = table[i+1][j]
+			} else {
+				table[i][j] = table[i][j+1]
+			}
+		}
+	}
+
+	var out []diffLine
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, diffLine{' ', a[i]})
+			i++
+			j++
+		case table[i+1][j] >= table[i][j+1]:
+			out = append(out, diffLine{'-', a[i]})
+			i++
+		default:
+			out = append(out, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		out = append(out, diffLine{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		out = append(out, diffLine{'+', b[j]})
+	}
+	return out
+}
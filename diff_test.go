@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	type testcase struct {
+		a, b   string
+		expect string
+	}
+
+	cases := map[string]testcase{
+		"same": {
+			a:      "a\nb\nc\n",
+			b:      "a\nb\nc\n",
+			expect: "",
+		},
+		"created": {
+			a: "",
+			b: "a\nb\n",
+			expect: `--- old
++++ new
+@@ -0,0 +1,2 @@
++a
++b
+`,
+		},
+		"change-in-middle": {
+			a: "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b: "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			expect: `--- old
++++ new
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+`,
+		},
+		"separate-hunks": {
+			a: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			b: "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			expect: `--- old
++++ new
+@@ -1,4 +1,4 @@
+-1
++one
+ 2
+ 3
+ 4
+@@ -9,4 +9,4 @@
+ 9
+ 10
+ 11
+-12
++twelve
+`,
+		},
+		"insert-and-delete": {
+			a: "a\nb\nc\n",
+			b: "a\nc\nd\n",
+			expect: `--- old
++++ new
+@@ -1,3 +1,3 @@
+ a
+-b
+ c
++d
+`,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			got := unifiedDiff("old", "new", tc.a, tc.b, 3)
+			require.Equal(t, tc.expect, got)
+		})
+	}
+}
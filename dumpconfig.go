@@ -55,14 +55,17 @@ func (c *Core) RunConfigDump() error {
 	for dc, n := range clients {
 		m["topology.clients."+dc] = n
 	}
+	for name, url := range c.exposedURLs() {
+		m["url."+name] = url
+	}
 
 	if len(args) == 0 {
 		fmt.Printf(jsonPretty(m) + "\n")
 		return nil
 	}
 
-	v := m[args[0]]
-	if v != "" {
+	v, ok := m[args[0]]
+	if ok && v != "" {
 		fmt.Println(v)
 	}
 	return nil
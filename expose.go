@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Host ports handed out when expose.enabled=true. Servers get
+// base + dcIndex*10 + serverIndex and clients get
+// base + dcIndex*100 + clientIndex, so dc2-server1 serves HTTP on 8520 and
+// dc1-client3 has its envoy admin on 19102.
+const (
+	exposeBaseHTTP        = 8500
+	exposeBaseHTTPS       = 8600
+	exposeBaseMeshGateway = 18000
+	exposeBaseEnvoyAdmin  = 19000
+)
+
+type exposedPort struct {
+	Name     string // e.g. "http", "https", "envoy-admin", "mesh-gateway"
+	Scheme   string
+	Internal int
+	External int
+}
+
+func (p *exposedPort) URL() string {
+	return p.Scheme + "://localhost:" + strconv.Itoa(p.External)
+}
+
+// exposedPorts returns the host port mappings that should be published on
+// the node's pod, if any.
+func (c *Core) exposedPorts(node *Node) []exposedPort {
+	if !c.config.ExposeEnabled {
+		return nil
+	}
+
+	dc := c.topology.DC(node.Datacenter)
+	if dc == nil {
+		panic("no such datacenter: " + node.Datacenter)
+	}
+
+	var ports []exposedPort
+	if node.Server {
+		offset := dc.Index*10 + node.Index
+		ports = append(ports, exposedPort{
+			Name:     "http",
+			Scheme:   "http",
+			Internal: 8500,
+			External: exposeBaseHTTP + offset,
+		})
+		if c.config.EncryptionTLSAPI {
+			ports = append(ports, exposedPort{
+				Name:     "https",
+				Scheme:   "https",
+				Internal: 8501,
+				External: exposeBaseHTTPS + offset,
+			})
+		}
+		return ports
+	}
+
+	offset := dc.Index*100 + node.Index
+	if node.MeshGateway {
+		ports = append(ports, exposedPort{
+			Name:     "mesh-gateway",
+			Scheme:   "tcp",
+			Internal: 8443,
+			External: exposeBaseMeshGateway + offset,
+		})
+	}
+	if node.MeshGateway || (node.Service != nil && !node.UseBuiltinProxy) {
+		ports = append(ports, exposedPort{
+			Name:     "envoy-admin",
+			Scheme:   "http",
+			Internal: 19000,
+			External: exposeBaseEnvoyAdmin + offset,
+		})
+	}
+	return ports
+}
+
+// exposedURLs maps "<node>.<port name>" to the URL reachable from the host.
+func (c *Core) exposedURLs() map[string]string {
+	urls := make(map[string]string)
+	c.topology.WalkSilent(func(n *Node) {
+		for _, p := range c.exposedPorts(n) {
+			urls[fmt.Sprintf("%s.%s", n.Name, p.Name)] = p.URL()
+		}
+	})
+	if c.config.ExposeEnabled && c.config.VaultEnabled {
+		p := exposedPort{Name: "http", Scheme: "http", Internal: 8200, External: 8200}
+		urls["vault."+p.Name] = p.URL()
+	}
+	return urls
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExposedURLs(t *testing.T) {
+	body := `
+		security {
+			encryption {
+				tls     = true
+				tls_api = true
+			}
+		}
+		expose {
+			enabled = true
+		}
+		topology {
+			datacenter "dc1" {
+				servers       = 2
+				clients       = 3
+				mesh_gateways = 1
+			}
+			datacenter "dc2" {
+				servers = 1
+				clients = 1
+			}
+		}
+	`
+	cfg, topo, err := parseConfig([]byte(body))
+	require.NoError(t, err)
+
+	c := &Core{config: cfg, topology: topo}
+
+	expect := map[string]string{
+		"dc1-server1.http":         "http://localhost:8510",
+		"dc1-server1.https":        "https://localhost:8610",
+		"dc1-server2.http":         "http://localhost:8511",
+		"dc1-server2.https":        "https://localhost:8611",
+		"dc1-client1.envoy-admin":  "http://localhost:19100",
+		"dc1-client2.envoy-admin":  "http://localhost:19101",
+		"dc1-client3.envoy-admin":  "http://localhost:19102",
+		"dc1-client4.mesh-gateway": "tcp://localhost:18103",
+		"dc1-client4.envoy-admin":  "http://localhost:19103",
+		"dc2-server1.http":         "http://localhost:8520",
+		"dc2-server1.https":        "https://localhost:8620",
+		"dc2-client1.envoy-admin":  "http://localhost:19200",
+	}
+	require.Equal(t, expect, c.exposedURLs())
+}
+
+func TestExposeVault(t *testing.T) {
+	for _, expose := range []bool{false, true} {
+		cfg, topo, err := parseConfig([]byte(`
+			vault {
+				enabled = true
+			}
+			topology {
+				network_shape = "flat"
+			}
+		`))
+		require.NoError(t, err)
+		cfg.ExposeEnabled = expose
+
+		c := &Core{config: cfg, topology: topo}
+
+		vaultRes, err := stringTemplate(tfVaultT, cfg)
+		require.NoError(t, err)
+		if expose {
+			require.Contains(t, vaultRes, "external = 8200")
+			require.Equal(t, "http://localhost:8200", c.exposedURLs()["vault.http"])
+		} else {
+			require.NotContains(t, vaultRes, "ports {")
+			require.NotContains(t, c.exposedURLs(), "vault.http")
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// seededKVFlags marks the KV entries that boot seeds, so that it only
+	// ever prunes its own.
+	seededKVFlags uint64 = 0xdc5eed
+
+	// reservedKVPrefix is where boot keeps its own bookkeeping in KV.
+	reservedKVPrefix = "devconsul/"
+
+	// seededQueriesKey lists the prepared queries boot created in a
+	// datacenter, so the ones no longer in config can be deleted.
+	seededQueriesKey = reservedKVPrefix + "prepared-queries"
+)
+
+type userConfigKV struct {
+	Path       string `hcl:"path"`
+	Value      string `hcl:"value"`
+	Datacenter string `hcl:"datacenter,optional"`
+}
+
+type userConfigPreparedQuery struct {
+	Name        string                           `hcl:"name,label"`
+	Datacenter  string                           `hcl:"datacenter,optional"`
+	Service     string                           `hcl:"service"`
+	Tags        []string                         `hcl:"tags,optional"`
+	OnlyPassing bool                             `hcl:"only_passing,optional"`
+	Near        string                           `hcl:"near,optional"`
+	Failover    *userConfigPreparedQueryFailover `hcl:"failover,block"`
+}
+
+type userConfigPreparedQueryFailover struct {
+	NearestN    int      `hcl:"nearest_n,optional"`
+	Datacenters []string `hcl:"datacenters,optional"`
+}
+
+type seededKV struct {
+	Datacenter string
+	Key        string
+	Value      string
+}
+
+type seededQuery struct {
+	Datacenter string
+	Query      *api.PreparedQueryDefinition
+}
+
+func parseSeededKV(uc []*userConfigKV) ([]*seededKV, error) {
+	var out []*seededKV
+	seen := make(map[string]struct{})
+	for _, kv := range uc {
+		if err := validateSeededKVKey(kv.Path); err != nil {
+			return nil, fmt.Errorf("kv %q: %v", kv.Path, err)
+		}
+		dc := defaultValue(kv.Datacenter, PrimaryDC)
+		if _, ok := seen[dc+"/"+kv.Path]; ok {
+			return nil, fmt.Errorf("kv %q is defined more than once in %s", kv.Path, dc)
+		}
+		seen[dc+"/"+kv.Path] = struct{}{}
+
+		out = append(out, &seededKV{
+			Datacenter: dc,
+			Key:        kv.Path,
+			Value:      kv.Value,
+		})
+	}
+	return out, nil
+}
+
+func validateSeededKVKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("path is required")
+	case strings.HasPrefix(key, "/"):
+		return fmt.Errorf("path must not begin with a /")
+	case strings.HasSuffix(key, "/"):
+		return fmt.Errorf("path must not end with a /")
+	case strings.HasPrefix(key, reservedKVPrefix):
+		return fmt.Errorf("paths under %s are reserved for devconsul", reservedKVPrefix)
+	}
+	return nil
+}
+
+func parseSeededQueries(uc []*userConfigPreparedQuery) ([]*seededQuery, error) {
+	var out []*seededQuery
+	seen := make(map[string]struct{})
+	for _, q := range uc {
+		dc := defaultValue(q.Datacenter, PrimaryDC)
+		if _, ok := seen[dc+"/"+q.Name]; ok {
+			return nil, fmt.Errorf("prepared_query %q is defined more than once in %s", q.Name, dc)
+		}
+		seen[dc+"/"+q.Name] = struct{}{}
+
+		if q.Service == "" {
+			return nil, fmt.Errorf("prepared_query %q: service is required", q.Name)
+		}
+
+		def := &api.PreparedQueryDefinition{
+			Name: q.Name,
+			Service: api.ServiceQuery{
+				Service:     q.Service,
+				Tags:        q.Tags,
+				OnlyPassing: q.OnlyPassing,
+				Near:        q.Near,
+			},
+		}
+		if f := q.Failover; f != nil {
+			if f.NearestN < 0 {
+				return nil, fmt.Errorf("prepared_query %q: failover.nearest_n cannot be negative", q.Name)
+			}
+			def.Service.Failover = api.QueryDatacenterOptions{
+				NearestN:    f.NearestN,
+				Datacenters: f.Datacenters,
+			}
+		}
+
+		out = append(out, &seededQuery{Datacenter: dc, Query: def})
+	}
+	return out, nil
+}
+
+// validateSeededDatacenters makes sure every seeded entry targets a
+// datacenter in the topology.
+func validateSeededDatacenters(cfg *FlatConfig, topology *Topology) error {
+	known := make(map[string]struct{})
+	for _, dc := range topology.Datacenters() {
+		known[dc.Name] = struct{}{}
+	}
+	check := func(what, dc string) error {
+		if _, ok := known[dc]; !ok {
+			return fmt.Errorf("%s refers to unknown datacenter %q", what, dc)
+		}
+		return nil
+	}
+	for _, kv := range cfg.SeededKV {
+		if err := check(fmt.Sprintf("kv %q", kv.Key), kv.Datacenter); err != nil {
+			return err
+		}
+	}
+	for _, q := range cfg.SeededQueries {
+		what := fmt.Sprintf("prepared_query %q", q.Query.Name)
+		if err := check(what, q.Datacenter); err != nil {
+			return err
+		}
+		for _, dc := range q.Query.Service.Failover.Datacenters {
+			if err := check(what+" failover", dc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadKVDir reads every file under dir as a KV entry keyed by its path
+// relative to dir. Dotfiles are skipped. A relative dir is resolved from the
+// directory holding config.hcl, which is where devconsul runs.
+func loadKVDir(dir string) (map[string]string, error) {
+	out := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if err := validateSeededKVKey(key); err != nil {
+			return fmt.Errorf("kv_dir file %q: %v", key, err)
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		out[key] = string(b)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not load kv_dir: %v", err)
+	}
+	return out, nil
+}
+
+// desiredSeededKV returns what KV should hold in each datacenter. Entries
+// from kv blocks win over the same keys from kv_dir.
+func (c *Core) desiredSeededKV() (map[string]map[string]string, error) {
+	out := make(map[string]map[string]string)
+	dcKV := func(dc string) map[string]string {
+		m, ok := out[dc]
+		if !ok {
+			m = make(map[string]string)
+			out[dc] = m
+		}
+		return m
+	}
+
+	if c.config.KVDir != "" {
+		fromDir, err := loadKVDir(c.config.KVDir)
+		if err != nil {
+			return nil, err
+		}
+		m := dcKV(PrimaryDC)
+		for k, v := range fromDir {
+			m[k] = v
+		}
+	}
+
+	for _, kv := range c.config.SeededKV {
+		dcKV(kv.Datacenter)[kv.Key] = kv.Value
+	}
+	return out, nil
+}
+
+// diffSeededKV works out which keys to write and which seeded keys to
+// delete. Keys that were not seeded by boot are never deleted.
+func diffSeededKV(existing api.KVPairs, desired map[string]string) (put, del []string) {
+	current := make(map[string]*api.KVPair)
+	for _, pair := range existing {
+		current[pair.Key] = pair
+	}
+
+	for key, val := range desired {
+		pair, ok := current[key]
+		if ok && pair.Flags == seededKVFlags && string(pair.Value) == val {
+			continue
+		}
+		put = append(put, key)
+	}
+	for _, pair := range existing {
+		if _, ok := desired[pair.Key]; ok || pair.Flags != seededKVFlags {
+			continue
+		}
+		del = append(del, pair.Key)
+	}
+
+	sort.Strings(put)
+	sort.Strings(del)
+	return put, del
+}
+
+// seedFixtures writes the configured KV entries and prepared queries, and
+// removes the ones that were taken out of config.
+func (c *Core) seedFixtures() error {
+	kvByDC, err := c.desiredSeededKV()
+	if err != nil {
+		return err
+	}
+
+	queriesByDC := make(map[string][]*api.PreparedQueryDefinition)
+	for _, q := range c.config.SeededQueries {
+		def := *q.Query
+		queriesByDC[q.Datacenter] = append(queriesByDC[q.Datacenter], &def)
+	}
+
+	var dcs []Datacenter
+	for _, dc := range c.topology.Datacenters() {
+		if c.primaryOnly && !dc.Primary {
+			if len(kvByDC[dc.Name]) > 0 || len(queriesByDC[dc.Name]) > 0 {
+				c.logger.Warn("skipping kv and prepared queries for datacenter that is not being booted", "dc", dc.Name)
+			}
+			continue
+		}
+		dcs = append(dcs, dc)
+	}
+
+	return c.eachDatacenter(dcs, func(dc Datacenter) error {
+		if err := c.seedKV(dc.Name, kvByDC[dc.Name]); err != nil {
+			return fmt.Errorf("kv in %s: %v", dc.Name, err)
+		}
+		if err := c.seedPreparedQueries(dc.Name, queriesByDC[dc.Name]); err != nil {
+			return fmt.Errorf("prepared queries in %s: %v", dc.Name, err)
+		}
+		return nil
+	})
+}
+
+func (c *Core) seedKV(dc string, desired map[string]string) error {
+	kv := c.primaryClient().KV()
+	qo := &api.QueryOptions{Datacenter: dc}
+	wo := &api.WriteOptions{Datacenter: dc}
+
+	existing, _, err := kv.List("", qo)
+	if err != nil {
+		return err
+	}
+
+	put, del := diffSeededKV(existing, desired)
+	for _, key := range put {
+		_, err := kv.Put(&api.KVPair{
+			Key:   key,
+			Value: []byte(desired[key]),
+			Flags: seededKVFlags,
+		}, wo)
+		if err != nil {
+			return err
+		}
+		c.logger.Info("seeded kv", "dc", dc, "key", key)
+	}
+	for _, key := range del {
+		if _, err := kv.Delete(key, wo); err != nil {
+			return err
+		}
+		c.logger.Info("deleted seeded kv", "dc", dc, "key", key)
+	}
+	return nil
+}
+
+func (c *Core) seedPreparedQueries(dc string, desired []*api.PreparedQueryDefinition) error {
+	client := c.primaryClient()
+	pq := client.PreparedQuery()
+	kv := client.KV()
+	qo := &api.QueryOptions{Datacenter: dc}
+	wo := &api.WriteOptions{Datacenter: dc}
+
+	existing, _, err := pq.List(qo)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]*api.PreparedQueryDefinition)
+	for _, q := range existing {
+		if q.Name != "" {
+			byName[q.Name] = q
+		}
+	}
+
+	var seeded []string
+	pair, _, err := kv.Get(seededQueriesKey, qo)
+	if err != nil {
+		return err
+	}
+	if pair != nil {
+		if err := json.Unmarshal(pair.Value, &seeded); err != nil {
+			return fmt.Errorf("could not decode %s: %v", seededQueriesKey, err)
+		}
+	}
+
+	var names []string
+	for _, def := range desired {
+		if current, ok := byName[def.Name]; ok {
+			def.ID = current.ID
+			if _, err := pq.Update(def, wo); err != nil {
+				return err
+			}
+		} else {
+			if _, _, err := pq.Create(def, wo); err != nil {
+				return err
+			}
+		}
+		names = append(names, def.Name)
+		c.logger.Info("seeded prepared query", "dc", dc, "name", def.Name)
+	}
+	sort.Strings(names)
+
+	for _, name := range seeded {
+		if stringSliceContains(names, name) {
+			continue
+		}
+		current, ok := byName[name]
+		if !ok {
+			continue
+		}
+		if _, err := pq.Delete(current.ID, wo); err != nil {
+			return err
+		}
+		c.logger.Info("deleted seeded prepared query", "dc", dc, "name", name)
+	}
+
+	if len(names) == 0 {
+		if pair != nil {
+			_, err := kv.Delete(seededQueriesKey, wo)
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(&api.KVPair{Key: seededQueriesKey, Value: b}, wo)
+	return err
+}
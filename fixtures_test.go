@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig_InvalidFixtures(t *testing.T) {
+	cases := map[string]struct {
+		body   string
+		expect string
+	}{
+		"leading slash": {
+			body: `
+				kv {
+					path  = "/config/ping"
+					value = "x"
+				}`,
+			expect: `kv "/config/ping": path must not begin with a /`,
+		},
+		"reserved prefix": {
+			body: `
+				kv {
+					path  = "devconsul/prepared-queries"
+					value = "x"
+				}`,
+			expect: `kv "devconsul/prepared-queries": paths under devconsul/ are reserved for devconsul`,
+		},
+		"duplicate kv": {
+			body: `
+				kv {
+					path  = "config/ping"
+					value = "x"
+				}
+				kv {
+					path  = "config/ping"
+					value = "y"
+				}`,
+			expect: `kv "config/ping" is defined more than once in dc1`,
+		},
+		"unknown kv datacenter": {
+			body: `
+				kv {
+					path       = "config/ping"
+					value      = "x"
+					datacenter = "dc2"
+				}`,
+			expect: `kv "config/ping" refers to unknown datacenter "dc2"`,
+		},
+		"duplicate query": {
+			body: `
+				prepared_query "pong" {
+					service = "pong"
+				}
+				prepared_query "pong" {
+					service = "pong"
+				}`,
+			expect: `prepared_query "pong" is defined more than once in dc1`,
+		},
+		"unknown failover datacenter": {
+			body: `
+				prepared_query "pong" {
+					service = "pong"
+					failover {
+						datacenters = ["dc3"]
+					}
+				}`,
+			expect: `prepared_query "pong" failover refers to unknown datacenter "dc3"`,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, _, err := parseConfig([]byte(tc.body))
+			require.EqualError(t, err, tc.expect)
+		})
+	}
+}
+
+func TestDiffSeededKV(t *testing.T) {
+	existing := api.KVPairs{
+		{Key: "config/a", Value: []byte("1"), Flags: seededKVFlags},
+		{Key: "config/b", Value: []byte("1"), Flags: seededKVFlags},
+		{Key: "config/c", Value: []byte("1"), Flags: seededKVFlags},
+		{Key: "config/d", Value: []byte("1")},
+		{Key: "test-from-dc1-to-dc2", Value: []byte("1")},
+	}
+	desired := map[string]string{
+		"config/a": "1",
+		"config/b": "2",
+		"config/d": "1",
+		"config/e": "1",
+	}
+
+	put, del := diffSeededKV(existing, desired)
+	require.Equal(t, []string{"config/b", "config/d", "config/e"}, put)
+	require.Equal(t, []string{"config/c"}, del)
+}
+
+func TestLoadKVDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devconsul-kv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, body string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(body), 0644))
+	}
+	write("config/ping/greeting", "hello")
+	write("config/pong.json", `{"port": 8080}`)
+	write(".gitkeep", "")
+	write(".hidden/secret", "nope")
+
+	got, err := loadKVDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"config/ping/greeting": "hello",
+		"config/pong.json":     `{"port": 8080}`,
+	}, got)
+
+	write("devconsul/prepared-queries", "[]")
+	_, err = loadKVDir(dir)
+	require.EqualError(t, err, `could not load kv_dir: kv_dir file "devconsul/prepared-queries": paths under devconsul/ are reserved for devconsul`)
+}
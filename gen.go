@@ -60,6 +60,7 @@ func (c *Core) generateConfigs(primaryOnly bool) error {
 		Node    *Node
 		HCL     string
 		Labels  map[string]string
+		Ports   []exposedPort
 	}
 
 	var (
@@ -112,10 +113,11 @@ resource "docker_image" %[1]q {
 		pod := terraformPod{
 			PodName: podName,
 			Node:    node,
-			HCL:     podHCL,
+			HCL:     escapeTerraformTemplate(podHCL),
 			Labels:  map[string]string{
 				//
 			},
+			Ports: c.exposedPorts(node),
 		}
 		node.AddLabels(pod.Labels)
 
@@ -176,10 +178,32 @@ resource "docker_image" %[1]q {
 	if c.config.PrometheusEnabled {
 		addImage("prometheus", "prom/prometheus:latest")
 		addImage("grafana", "grafana/grafana:latest")
-		containers = append(containers, tfPrometheusContainer)
+		prometheusRes, err := stringTemplate(tfPrometheusT, c.prometheusAddresses())
+		if err != nil {
+			return err
+		}
+		containers = append(containers, prometheusRes)
 		containers = append(containers, tfGrafanaContainer)
 	}
 
+	if c.config.Tracing != "" {
+		addImage("jaeger", jaegerImage)
+		jaegerRes, err := stringTemplate(tfJaegerT, c.tracingAddresses())
+		if err != nil {
+			return err
+		}
+		containers = append(containers, jaegerRes)
+	}
+
+	if c.config.VaultEnabled {
+		addImage("vault", c.config.VaultImage)
+		vaultRes, err := stringTemplate(tfVaultT, c.config)
+		if err != nil {
+			return err
+		}
+		containers = append(containers, vaultRes)
+	}
+
 	var res []string
 	res = append(res, networks...)
 	res = append(res, volumes...)
@@ -214,6 +238,10 @@ resource "docker_network" %[1]q {
 
 	// You will need to do a full down/up cycle to switch network_shape.
 	if updateResult == UpdateResultModified {
+		if c.plan != nil {
+			c.plan.addNote("networking changed significantly, so 'devconsul down' is required before 'up'")
+			return res, nil
+		}
 		return nil, fmt.Errorf("Networking changed significantly, so you'll have to destroy everything first with 'devconsul down'")
 	}
 	return res, nil
@@ -225,7 +253,7 @@ resource "docker_container" "{{.PodName}}" {
   image = docker_image.pause.latest
   hostname = "{{.PodName}}"
   restart  = "always"
-  dns      = ["8.8.8.8"]
+  dns      = ["{{.Node.DNSServer}}"]
 
   labels {
     label = "devconsul"
@@ -248,6 +276,14 @@ networks_advanced {
   ipv4_address = "{{.IPAddress}}"
 }
 {{- end }}
+
+{{- range .Ports }}
+ports {
+  internal = {{.Internal}}
+  external = {{.External}}
+  ip       = "127.0.0.1"
+}
+{{- end }}
 }
 `))
 
@@ -290,6 +326,12 @@ EOT
     container_path = "/tls"
     read_only      = true
   }
+{{- if .Node.NeedsDockerSocket }}
+  volumes {
+    host_path      = "/var/run/docker.sock"
+    container_path = "/var/run/docker.sock"
+  }
+{{- end }}
 }
 `))
 
@@ -425,6 +467,10 @@ func (c *Core) generatePingPongContainers(podName string, node *Node) ([]string,
 		UseBuiltinProxy    bool
 		EnvoyLogLevel      string
 		EnvoyImageResource string
+		Labels             map[string]string
+		UpstreamDial       string
+		TransparentProxy   bool
+		AppUID             int
 	}
 
 	ppi := pingpongInfo{
@@ -434,32 +480,63 @@ func (c *Core) generatePingPongContainers(podName string, node *Node) ([]string,
 		UseBuiltinProxy:    node.UseBuiltinProxy,
 		EnvoyLogLevel:      c.config.EnvoyLogLevel,
 		EnvoyImageResource: "docker_image.consul-envoy.latest",
+		Labels:             map[string]string{},
+		UpstreamDial:       svc.UpstreamDialAddress(),
+		TransparentProxy:   svc.TransparentProxy,
+		AppUID:             appUID,
 	}
+	node.AddLabels(ppi.Labels)
 	if node.Canary {
 		ppi.EnvoyImageResource = "docker_image.consul-envoy-canary.latest"
 	}
-	if len(svc.Meta) > 0 {
-		var kvs []struct{ K, V string }
-		for k, v := range svc.Meta {
-			kvs = append(kvs, struct{ K, V string }{k, v})
-		}
-		sort.Slice(kvs, func(i, j int) bool {
-			return kvs[i].K < kvs[j].K
-		})
-		var parts []string
-		for _, kv := range kvs {
-			parts = append(parts, kv.K+"-"+kv.V)
-		}
-		ppi.MetaString = strings.Join(parts, "--")
+	ppi.MetaString = serviceMetaString(svc.Meta)
+
+	ppi.SidecarBootArgs = c.sidecarBootArgs(node, c.config.KubernetesEnabled)
+
+	appRes, err := stringTemplate(tfPingPongAppT, &ppi)
+	if err != nil {
+		return nil, err
+	}
+	sidecarRes, err := stringTemplate(tfPingPongSidecarT, &ppi)
+	if err != nil {
+		return nil, err
 	}
 
+	return []string{appRes, sidecarRes}, nil
+}
+
+func serviceMetaString(meta map[string]string) string {
+	if len(meta) == 0 {
+		return ""
+	}
+	var kvs []struct{ K, V string }
+	for k, v := range meta {
+		kvs = append(kvs, struct{ K, V string }{k, v})
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].K < kvs[j].K
+	})
+	var parts []string
+	for _, kv := range kvs {
+		parts = append(parts, kv.K+"-"+kv.V)
+	}
+	return strings.Join(parts, "--")
+}
+
+// sidecarBootArgs returns the arguments for sidecar-boot.sh for the service
+// on the node. If k8sLogin is set the sidecar obtains its token by logging in
+// with the minikube auth method.
+func (c *Core) sidecarBootArgs(node *Node, k8sLogin bool) []string {
+	svc := node.Service
+
 	proxyType := "envoy"
 	if node.UseBuiltinProxy {
 		proxyType = "builtin"
 	}
 
-	if c.config.KubernetesEnabled {
-		ppi.SidecarBootArgs = []string{
+	var args []string
+	if k8sLogin {
+		args = []string{
 			"/secrets/ready.val",
 			proxyType,
 			"login",
@@ -471,7 +548,7 @@ func (c *Core) generatePingPongContainers(podName string, node *Node) ([]string,
 			"/secrets/servicereg__" + node.Name + "__" + svc.Name + ".hcl",
 		}
 	} else {
-		ppi.SidecarBootArgs = []string{
+		args = []string{
 			"/secrets/ready.val",
 			proxyType,
 			"direct",
@@ -483,19 +560,9 @@ func (c *Core) generatePingPongContainers(podName string, node *Node) ([]string,
 	}
 
 	if c.config.EncryptionTLSAPI {
-		ppi.SidecarBootArgs = append(ppi.SidecarBootArgs, "-e")
+		args = append(args, "-e")
 	}
-
-	appRes, err := stringTemplate(tfPingPongAppT, &ppi)
-	if err != nil {
-		return nil, err
-	}
-	sidecarRes, err := stringTemplate(tfPingPongSidecarT, &ppi)
-	if err != nil {
-		return nil, err
-	}
-
-	return []string{appRes, sidecarRes}, nil
+	return append(args, redirectTrafficArgs(node)...)
 }
 
 // TODO: make chaos opt-in
@@ -505,6 +572,9 @@ resource "docker_container" "{{.NodeName}}-{{.PingPong}}" {
     network_mode = "container:${docker_container.{{.PodName}}.id}"
 	image        = docker_image.pingpong.latest
     restart  = "on-failure"
+{{- if .TransparentProxy }}
+    user     = "{{.AppUID}}"
+{{- end }}
 
   labels {
     label = "devconsul"
@@ -514,12 +584,18 @@ resource "docker_container" "{{.NodeName}}-{{.PingPong}}" {
     label = "devconsul.type"
     value = "app"
   }
+{{- range $k, $v := .Labels }}
+  labels {
+    label = "{{ $k }}"
+    value = "{{ $v }}"
+  }
+{{- end }}
 
   command = [
       "-bind",
       "0.0.0.0:8080",
       "-dial",
-      "127.0.0.1:9090",
+      "{{.UpstreamDial}}",
       "-pong-chaos",
       "-dialfreq",
       "250ms",
@@ -534,6 +610,15 @@ resource "docker_container" "{{.NodeName}}-{{.PingPong}}-sidecar" {
     network_mode = "container:${docker_container.{{.PodName}}.id}"
 	image        = {{ .EnvoyImageResource }}
     restart  = "on-failure"
+{{- if .TransparentProxy }}
+
+  # redirect-traffic needs to edit the pod's iptables, and only traffic from
+  # the proxy's user escapes the redirect
+  capabilities {
+    add = ["NET_ADMIN"]
+  }
+  env = ["ENVOY_UID=0"]
+{{- end }}
 
   labels {
     label = "devconsul"
@@ -543,6 +628,12 @@ resource "docker_container" "{{.NodeName}}-{{.PingPong}}-sidecar" {
     label = "devconsul.type"
     value = "sidecar"
   }
+{{- range $k, $v := .Labels }}
+  labels {
+    label = "{{ $k }}"
+    value = "{{ $v }}"
+  }
+{{- end }}
 
   volumes {
     host_path      = abspath("cache")
@@ -581,7 +672,7 @@ resource "docker_container" "{{.NodeName}}-{{.PingPong}}-sidecar" {
 }
 `))
 
-const tfPrometheusContainer = `
+var tfPrometheusT = template.Must(template.New("tf-prometheus").Parse(`
 resource "docker_container" "prometheus" {
   name  = "prometheus"
   image = docker_image.prometheus.latest
@@ -604,10 +695,12 @@ resource "docker_container" "prometheus" {
     container_path = "/etc/prometheus/prometheus.yml"
     read_only      = true
    }
+{{- range . }}
   networks_advanced {
-    name         = docker_network.devconsul-lan.name
-    ipv4_address = "10.0.100.100"
+    name         = docker_network.devconsul-{{.Network}}.name
+    ipv4_address = "{{.IPAddress}}"
    }
+{{- end }}
 
   ports {
     internal = 9090
@@ -617,7 +710,7 @@ resource "docker_container" "prometheus" {
     internal = 3000
     external = 3000
   }
-} `
+} `))
 
 const tfGrafanaContainer = `
 resource "docker_container" "grafana" {
@@ -649,29 +742,111 @@ resource "docker_container" "grafana" {
   }
 } `
 
+var tfJaegerT = template.Must(template.New("tf-jaeger").Parse(`
+resource "docker_container" "jaeger" {
+  name  = "jaeger"
+  image = docker_image.jaeger.latest
+  labels {
+    label = "devconsul"
+    value = "1"
+  }
+  labels {
+    label = "devconsul.type"
+    value = "infra"
+  }
+  restart = "always"
+  env     = ["COLLECTOR_ZIPKIN_HTTP_PORT=9411"]
+{{- range . }}
+  networks_advanced {
+    name         = docker_network.devconsul-{{.Network}}.name
+    ipv4_address = "{{.IPAddress}}"
+  }
+{{- end }}
+
+  ports {
+    internal = 16686
+    external = 16686
+  }
+}
+`))
+
+var tfVaultT = template.Must(template.New("tf-vault").Parse(`
+resource "docker_container" "vault" {
+  name  = "vault"
+  image = docker_image.vault.latest
+  labels {
+    label = "devconsul"
+    value = "1"
+  }
+  labels {
+    label = "devconsul.type"
+    value = "infra"
+  }
+  restart = "always"
+  command = [
+    "server",
+    "-dev",
+    "-dev-root-token-id={{.VaultRootToken}}",
+    "-dev-listen-address=0.0.0.0:8200",
+  ]
+  capabilities {
+    add = ["IPC_LOCK"]
+  }
+  networks_advanced {
+    name         = docker_network.devconsul-lan.name
+    ipv4_address = "` + vaultIP + `"
+  }
+{{- if .ExposeEnabled }}
+  ports {
+    internal = 8200
+    external = 8200
+    ip       = "127.0.0.1"
+  }
+{{- end }}
+}
+`))
+
 func (c *Core) generateAgentHCL(node *Node) (string, error) {
-	type consulAgentConfigInfo struct {
-		AdvertiseAddr    string
-		AdvertiseAddrWAN string
-		RetryJoin        string
-		RetryJoinWAN     string
-		Datacenter       string
-		SecondaryServer  bool
-		MasterToken      string
-		AgentMasterToken string
-		Server           bool
-		BootstrapExpect  int
-		GossipKey        string
-		TLS              bool
-		TLSAPI           bool
-		TLSFilePrefix    string
-		Prometheus       bool
-
-		FederateViaGateway  bool
-		PrimaryGateways     string
-		DisableWANBootstrap bool
-	}
+	configInfo := c.agentConfigInfo(node)
+	return renderAgentHCL(&configInfo)
+}
 
+type consulAgentConfigInfo struct {
+	AdvertiseAddr    string
+	AdvertiseAddrWAN string
+	RetryJoin        string
+	RetryJoinWAN     string
+	Datacenter       string
+	SecondaryServer  bool
+	MasterToken      string
+	AgentMasterToken string
+	AgentToken       string
+	Server           bool
+	BootstrapExpect  int
+	GossipKey        string
+	TLS              bool
+	TLSAPI           bool
+	TLSFilePrefix    string
+	Prometheus       bool
+	PrometheusIP     string
+
+	EnableScriptChecks bool
+	DNSRecursors       bool
+	VaultAddress       string
+	VaultToken         string
+
+	NoAgentCert          bool
+	AutoEncryptAllowTLS  bool
+	AutoEncryptTLS       bool
+	AutoConfigIntroToken string
+	AutoConfigPublicKey  string // quoted
+
+	FederateViaGateway  bool
+	PrimaryGateways     string
+	DisableWANBootstrap bool
+}
+
+func (c *Core) agentConfigInfo(node *Node) consulAgentConfigInfo {
 	configInfo := consulAgentConfigInfo{
 		AdvertiseAddr:    node.LocalAddress(),
 		RetryJoin:        `"` + strings.Join(c.topology.ServerIPs(node.Datacenter), `", "`) + `"`,
@@ -684,6 +859,14 @@ func (c *Core) generateAgentHCL(node *Node) (string, error) {
 		Prometheus:       c.config.PrometheusEnabled,
 	}
 
+	if c.config.PrometheusEnabled {
+		configInfo.PrometheusIP = c.prometheusIP(node)
+	}
+	if node.Service != nil {
+		configInfo.EnableScriptChecks = node.Service.NeedsScriptChecks()
+		configInfo.DNSRecursors = node.TransparentProxy()
+	}
+
 	if node.Server {
 		configInfo.MasterToken = c.config.InitialMasterToken
 
@@ -725,12 +908,38 @@ func (c *Core) generateAgentHCL(node *Node) (string, error) {
 		configInfo.BootstrapExpect = len(c.topology.ServerIPs(node.Datacenter))
 
 		configInfo.TLSFilePrefix = node.Datacenter + "-server-consul-" + strconv.Itoa(node.Index)
+
+		if c.config.VaultEnabled {
+			configInfo.VaultAddress = vaultAddress
+			configInfo.VaultToken = c.config.VaultConnectToken
+		}
+
+		switch c.config.ClientTLS {
+		case ClientTLSAutoEncrypt:
+			configInfo.AutoEncryptAllowTLS = true
+		case ClientTLSAutoConfig:
+			configInfo.AutoConfigPublicKey = strconv.Quote(c.config.AutoConfigPublicKey)
+		}
 	} else {
 		configInfo.TLSFilePrefix = node.Datacenter + "-client-consul-" + strconv.Itoa(node.Index)
+
+		switch c.config.ClientTLS {
+		case ClientTLSAutoEncrypt:
+			configInfo.NoAgentCert = true
+			configInfo.AutoEncryptTLS = true
+			configInfo.AgentToken = c.config.PresetAgentTokens[node.Name]
+		case ClientTLSAutoConfig:
+			configInfo.NoAgentCert = true
+			configInfo.AutoConfigIntroToken = c.config.AutoConfigIntroTokens[node.Name]
+		}
 	}
 
+	return configInfo
+}
+
+func renderAgentHCL(configInfo *consulAgentConfigInfo) (string, error) {
 	var buf bytes.Buffer
-	if err := consulAgentConfigT.Execute(&buf, &configInfo); err != nil {
+	if err := consulAgentConfigT.Execute(&buf, configInfo); err != nil {
 		return "", err
 	}
 
@@ -755,6 +964,14 @@ disable_update_check   = true
 log_level              = "trace"
 
 enable_debug                  = true
+{{- if .EnableScriptChecks }}
+enable_script_checks          = true
+{{- end }}
+{{- if .DNSRecursors }}
+
+# the pod resolves everything through this agent
+recursors                     = ["8.8.8.8"]
+{{- end }}
 
 # gossip_lan {
 #   retransmit_mult = 0
@@ -790,7 +1007,7 @@ ui_config {
 {{ if .Prometheus }}
   metrics_provider = "prometheus"
   metrics_proxy {
-	base_url = "http://prometheus:9090"
+	base_url = "http://{{.PrometheusIP}}:9090"
   }
 {{ end }}
 }
@@ -806,13 +1023,54 @@ encrypt                = "{{.GossipKey}}"
 
 {{ if .TLS }}
 ca_file                = "/tls/consul-agent-ca.pem"
+{{- if not .NoAgentCert }}
 cert_file              = "/tls/{{.TLSFilePrefix}}.pem"
 key_file               = "/tls/{{.TLSFilePrefix}}-key.pem"
+{{- end }}
 {{ if .Server }}
 verify_incoming        = true
 verify_server_hostname = true
 {{- end }}
 verify_outgoing        = true
+{{- if .AutoEncryptAllowTLS }}
+
+auto_encrypt {
+  allow_tls = true
+}
+{{- end }}
+{{- if .AutoEncryptTLS }}
+
+auto_encrypt {
+  tls = true
+}
+{{- end }}
+{{- if .AutoConfigIntroToken }}
+
+auto_config {
+  enabled          = true
+  intro_token      = "{{.AutoConfigIntroToken}}"
+  server_addresses = [ {{.RetryJoin}} ]
+}
+{{- end }}
+{{- if .AutoConfigPublicKey }}
+
+auto_config {
+  authorization {
+    enabled = true
+    static {
+      jwt_validation_pub_keys = [ {{.AutoConfigPublicKey}} ]
+      bound_issuer            = "` + autoConfigIssuer + `"
+      bound_audiences         = [ "` + autoConfigAudience + `" ]
+      claim_mappings {
+        node = "node_name"
+      }
+      claim_assertions = [
+        "value.node_name == \"${node}\"",
+      ]
+    }
+  }
+}
+{{- end }}
 {{ end }}
 
 {{ if not .SecondaryServer }}
@@ -840,6 +1098,15 @@ connect {
   {{ if .FederateViaGateway -}}
   enable_mesh_gateway_wan_federation = true
   {{- end}}
+{{- if .VaultAddress }}
+  ca_provider = "vault"
+  ca_config {
+    address               = "{{.VaultAddress}}"
+    token                 = "{{.VaultToken}}"
+    root_pki_path         = "` + vaultRootPKIPath + `"
+    intermediate_pki_path = "` + vaultIntermediatePKIPathPrefix + `{{.Datacenter}}"
+  }
+{{- end }}
 }
 
 ports {
@@ -864,6 +1131,9 @@ acl {
     master       = "{{.MasterToken}}"
     {{- end }}
     agent_master = "{{.AgentMasterToken}}"
+{{- if .AgentToken }}
+    agent        = "{{.AgentToken}}"
+{{- end }}
   }
 }
 `))
@@ -887,6 +1157,41 @@ func indent(s string, n int) string {
 	return buf.String()
 }
 
+// prometheusAddresses returns where the prometheus container sits on each
+// network that has agents on it, so it can scrape them directly.
+func (c *Core) prometheusAddresses() []Address {
+	return c.infraAddresses("10.0.100.100", "250")
+}
+
+// infraAddresses places an infra container at flatIP on a flat network, or
+// at the given last octet of every datacenter network otherwise.
+func (c *Core) infraAddresses(flatIP, octet string) []Address {
+	if c.topology.NetworkShape == NetworkShapeFlat {
+		return []Address{{Network: "lan", IPAddress: flatIP}}
+	}
+
+	var out []Address
+	for _, dc := range c.topology.Datacenters() {
+		out = append(out, Address{
+			Network:   dc.Name,
+			IPAddress: dc.BaseIP + "." + octet,
+		})
+	}
+	return out
+}
+
+// prometheusIP returns the address of the prometheus container on the
+// node's local network.
+func (c *Core) prometheusIP(node *Node) string {
+	network := c.topology.NetworkShape.GetNetworkName(node.Datacenter)
+	for _, addr := range c.prometheusAddresses() {
+		if addr.Network == network {
+			return addr.IPAddress
+		}
+	}
+	panic("prometheus has no address on network " + network)
+}
+
 func (c *Core) generatePrometheusConfigFile() error {
 	type kv struct {
 		Key, Val string
@@ -1120,21 +1425,36 @@ func (c *Core) updateFileIfDifferent(body []byte, path string, perm os.FileMode)
 		if !os.IsNotExist(err) {
 			return result, err
 		}
-		c.logger.Info("writing new file", "path", path)
 		result = UpdateResultCreated
+	} else if bytes.Equal(body, prev) {
+		return result, nil
 	} else {
-		// loaded
-		if bytes.Equal(body, prev) {
-			return result, nil
-		}
-		c.logger.Info("file has changed", "path", path)
 		result = UpdateResultModified
 	}
 
+	if c.plan != nil {
+		c.plan.recordFile(path, prev, body)
+		return result, nil
+	}
+
+	if result == UpdateResultCreated {
+		c.logger.Info("writing new file", "path", path)
+	} else {
+		c.logger.Info("file has changed", "path", path)
+	}
+
 	_, err = safeio.WriteToFile(bytes.NewReader(body), path, perm)
 	return result, err
 }
 
+// escapeTerraformTemplate keeps terraform from interpreting anything that
+// looks like interpolation when s is embedded in a heredoc.
+func escapeTerraformTemplate(s string) string {
+	s = strings.Replace(s, "${", "$${", -1)
+	s = strings.Replace(s, "%{", "%%{", -1)
+	return s
+}
+
 func stringTemplate(t *template.Template, data interface{}) (string, error) {
 	var res bytes.Buffer
 	if err := t.Execute(&res, data); err != nil {
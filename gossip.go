@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func (c *Core) RunGossip() error {
+	args := flag.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("Missing required gossip subcommand: [rotate]")
+	}
+
+	switch args[0] {
+	case "rotate":
+		return c.runGossipRotate(args[1:])
+	default:
+		return fmt.Errorf("unknown gossip subcommand: %s", args[0])
+	}
+}
+
+func (c *Core) runGossipRotate(args []string) error {
+	var timeout time.Duration
+	fs := flag.NewFlagSet("gossip rotate", flag.ContinueOnError)
+	fs.DurationVar(&timeout, "timeout", 2*time.Minute, "how long to wait for each keyring change to reach every member")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if !c.config.EncryptionGossip {
+		return fmt.Errorf("gossip rotate requires security.encryption.gossip = true")
+	}
+
+	client, err := c.debugPrimaryClient()
+	if err != nil {
+		return err
+	}
+
+	newKey, err := generateGossipKey()
+	if err != nil {
+		return err
+	}
+
+	var dcs []string
+	for _, dc := range c.topology.Datacenters() {
+		dcs = append(dcs, dc.Name)
+	}
+
+	ctx, stop := c.interruptibleContext("gossip rotation", 0)
+	defer stop()
+
+	start := time.Now()
+
+	// Keyring operations made against the primary fan out to the WAN pool
+	// and to the LAN pool of every datacenter, so each step is one call.
+	if err := client.Operator().KeyringInstall(newKey, nil); err != nil {
+		return fmt.Errorf("error installing new gossip key: %v", err)
+	}
+	if err := c.waitForKeyrings(ctx, client, dcs, newKey, keyInstalled, timeout); err != nil {
+		return err
+	}
+	c.logger.Info("new gossip key installed everywhere", "elapsed", time.Since(start))
+
+	if err := client.Operator().KeyringUse(newKey, nil); err != nil {
+		return fmt.Errorf("error switching to the new gossip key: %v", err)
+	}
+	if err := c.waitForKeyrings(ctx, client, dcs, newKey, keyPrimary, timeout); err != nil {
+		return err
+	}
+	c.logger.Info("new gossip key is primary everywhere", "elapsed", time.Since(start))
+
+	// Agents rendered from now on have to start out with the new key.
+	if err := c.cache.SaveValue("gossip-key", newKey); err != nil {
+		return err
+	}
+	c.config.GossipKey = newKey
+
+	rings, err := client.Operator().KeyringList(nil)
+	if err != nil {
+		return fmt.Errorf("error listing gossip keys: %v", err)
+	}
+	oldKeys := make(map[string]struct{})
+	for _, r := range rings {
+		for key := range r.Keys {
+			if key != newKey {
+				oldKeys[key] = struct{}{}
+			}
+		}
+	}
+	for oldKey := range oldKeys {
+		if err := client.Operator().KeyringRemove(oldKey, nil); err != nil {
+			return fmt.Errorf("error removing old gossip key: %v", err)
+		}
+		if err := c.waitForKeyrings(ctx, client, dcs, oldKey, keyRemoved, timeout); err != nil {
+			return err
+		}
+	}
+	c.logger.Info("old gossip keys removed", "count", len(oldKeys), "elapsed", time.Since(start))
+
+	c.logger.Info("gossip rotation complete", "elapsed", time.Since(start))
+	return nil
+}
+
+type keyringState int
+
+const (
+	keyInstalled keyringState = iota
+	keyPrimary
+	keyRemoved
+)
+
+func (c *Core) waitForKeyrings(ctx context.Context, client *api.Client, dcs []string, key string, state keyringState, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return retryFor(ctx, "gossip keyrings to converge", func() (bool, error) {
+		rings, err := client.Operator().KeyringList(nil)
+		if err != nil {
+			c.logger.Warn("error listing gossip keys", "error", err)
+			return false, nil
+		}
+		if err := keyringConverged(rings, dcs, key, state); err != nil {
+			c.logger.Info("gossip keyrings have not converged yet", "reason", err)
+			return false, nil
+		}
+		return true, nil
+	})
+}
+
+// keyringConverged returns an error describing the first pool whose members
+// do not all agree on the given key being in the given state.
+func keyringConverged(rings []*api.KeyringResponse, dcs []string, key string, state keyringState) error {
+	var seenWAN bool
+	seenLAN := make(map[string]bool)
+	for _, r := range rings {
+		name := r.Datacenter + " LAN"
+		if r.WAN {
+			name = "WAN"
+			seenWAN = true
+		} else {
+			seenLAN[r.Datacenter] = true
+		}
+
+		for node, msg := range r.Messages {
+			return fmt.Errorf("%s pool: %s: %s", name, node, msg)
+		}
+
+		switch state {
+		case keyInstalled:
+			if r.Keys[key] != r.NumNodes {
+				return fmt.Errorf("%s pool: key installed on %d of %d members", name, r.Keys[key], r.NumNodes)
+			}
+		case keyPrimary:
+			if r.PrimaryKeys[key] != r.NumNodes {
+				return fmt.Errorf("%s pool: key is primary on %d of %d members", name, r.PrimaryKeys[key], r.NumNodes)
+			}
+		case keyRemoved:
+			if n := r.Keys[key]; n != 0 {
+				return fmt.Errorf("%s pool: key still installed on %d members", name, n)
+			}
+		}
+	}
+
+	if !seenWAN {
+		return fmt.Errorf("no response from the WAN pool")
+	}
+	for _, dc := range dcs {
+		if !seenLAN[dc] {
+			return fmt.Errorf("no response from the %s LAN pool", dc)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyringConverged(t *testing.T) {
+	const (
+		oldKey = "b2xkLWtleS1vbGQta2V5MQ=="
+		newKey = "bmV3LWtleS1uZXcta2V5MQ=="
+	)
+	dcs := []string{"dc1", "dc2"}
+
+	rings := func(installed, primary int) []*api.KeyringResponse {
+		return []*api.KeyringResponse{
+			{
+				WAN:         true,
+				Datacenter:  "dc1",
+				Keys:        map[string]int{oldKey: 2, newKey: installed},
+				PrimaryKeys: map[string]int{oldKey: 2 - primary, newKey: primary},
+				NumNodes:    2,
+			},
+			{
+				Datacenter:  "dc1",
+				Keys:        map[string]int{oldKey: 2, newKey: installed},
+				PrimaryKeys: map[string]int{oldKey: 2 - primary, newKey: primary},
+				NumNodes:    2,
+			},
+			{
+				Datacenter:  "dc2",
+				Keys:        map[string]int{oldKey: 2, newKey: 2},
+				PrimaryKeys: map[string]int{newKey: 2},
+				NumNodes:    2,
+			},
+		}
+	}
+
+	require.Error(t, keyringConverged(rings(1, 0), dcs, newKey, keyInstalled))
+	require.NoError(t, keyringConverged(rings(2, 0), dcs, newKey, keyInstalled))
+	require.Error(t, keyringConverged(rings(2, 1), dcs, newKey, keyPrimary))
+	require.NoError(t, keyringConverged(rings(2, 2), dcs, newKey, keyPrimary))
+	require.Error(t, keyringConverged(rings(2, 2), dcs, oldKey, keyRemoved))
+
+	removed := rings(2, 2)
+	for _, r := range removed {
+		delete(r.Keys, oldKey)
+	}
+	require.NoError(t, keyringConverged(removed, dcs, oldKey, keyRemoved))
+
+	// A datacenter that did not answer is not converged.
+	require.EqualError(t,
+		keyringConverged(removed[:2], dcs, oldKey, keyRemoved),
+		"no response from the dc2 LAN pool",
+	)
+
+	withErrors := rings(2, 2)
+	withErrors[1].Messages = map[string]string{"dc1-server1": "key not found"}
+	require.Error(t, keyringConverged(withErrors, dcs, newKey, keyPrimary))
+}
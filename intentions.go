@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+type userConfigIntentions struct {
+	// DisableDefaultAllow skips the allow intentions generated for every
+	// upstream, so that only declared sources are let through.
+	DisableDefaultAllow bool                          `hcl:"disable_default_allow,optional"`
+	Services            []*userConfigIntentionService `hcl:"service,block"`
+}
+
+type userConfigIntentionService struct {
+	Name      string                       `hcl:"name,label"`
+	Namespace string                       `hcl:"namespace,optional"`
+	Sources   []*userConfigIntentionSource `hcl:"source,block"`
+}
+
+type userConfigIntentionSource struct {
+	Name        string                           `hcl:"name,label"`
+	Namespace   string                           `hcl:"namespace,optional"`
+	Action      string                           `hcl:"action,optional"`
+	Description string                           `hcl:"description,optional"`
+	Permissions []*userConfigIntentionPermission `hcl:"permission,block"`
+}
+
+type userConfigIntentionPermission struct {
+	Action     string                       `hcl:"action"`
+	PathExact  string                       `hcl:"path_exact,optional"`
+	PathPrefix string                       `hcl:"path_prefix,optional"`
+	PathRegex  string                       `hcl:"path_regex,optional"`
+	Methods    []string                     `hcl:"methods,optional"`
+	Headers    []*userConfigIntentionHeader `hcl:"header,block"`
+}
+
+type userConfigIntentionHeader struct {
+	Name    string `hcl:"name,label"`
+	Present bool   `hcl:"present,optional"`
+	Exact   string `hcl:"exact,optional"`
+	Prefix  string `hcl:"prefix,optional"`
+	Suffix  string `hcl:"suffix,optional"`
+	Regex   string `hcl:"regex,optional"`
+	Invert  bool   `hcl:"invert,optional"`
+}
+
+var intentionHTTPMethods = []string{
+	"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE",
+}
+
+// parseDeclaredIntentions turns the intentions block into one
+// service-intentions entry per destination service.
+func parseDeclaredIntentions(uc *userConfigIntentions, enterprise bool) ([]*api.ServiceIntentionsConfigEntry, error) {
+	namespace := func(ns string) (string, error) {
+		if !enterprise {
+			if ns != "" {
+				return "", fmt.Errorf("namespace cannot be set when enterprise.enabled=false")
+			}
+			return "", nil
+		}
+		return defaultValue(ns, "default"), nil
+	}
+
+	var out []*api.ServiceIntentionsConfigEntry
+	seen := make(map[string]struct{})
+	for _, svc := range uc.Services {
+		ns, err := namespace(svc.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("intentions for %q: %v", svc.Name, err)
+		}
+		dst := intentionName(ns, svc.Name)
+		if _, ok := seen[dst]; ok {
+			return nil, fmt.Errorf("intentions for %q are defined more than once", dst)
+		}
+		seen[dst] = struct{}{}
+
+		entry := &api.ServiceIntentionsConfigEntry{
+			Kind:      api.ServiceIntentions,
+			Name:      svc.Name,
+			Namespace: ns,
+		}
+
+		seenSrc := make(map[string]struct{})
+		for _, src := range svc.Sources {
+			srcNS, err := namespace(src.Namespace)
+			if err != nil {
+				return nil, fmt.Errorf("intentions for %q: source %q: %v", dst, src.Name, err)
+			}
+			name := intentionName(srcNS, src.Name)
+			if _, ok := seenSrc[name]; ok {
+				return nil, fmt.Errorf("intentions for %q: source %q is defined more than once", dst, name)
+			}
+			seenSrc[name] = struct{}{}
+
+			si, err := parseIntentionSource(src)
+			if err != nil {
+				return nil, fmt.Errorf("intentions for %q: source %q: %v", dst, name, err)
+			}
+			si.Namespace = srcNS
+			entry.Sources = append(entry.Sources, si)
+		}
+		sortIntentionSources(entry.Sources)
+
+		out = append(out, entry)
+	}
+	return out, nil
+}
+
+func parseIntentionSource(src *userConfigIntentionSource) (*api.SourceIntention, error) {
+	si := &api.SourceIntention{
+		Name:        src.Name,
+		Description: src.Description,
+	}
+
+	switch {
+	case src.Action != "" && len(src.Permissions) > 0:
+		return nil, fmt.Errorf("action and permission blocks are mutually exclusive")
+	case src.Action == "" && len(src.Permissions) == 0:
+		return nil, fmt.Errorf("either action or at least one permission block is required")
+	case src.Action != "":
+		action, err := parseIntentionAction(src.Action)
+		if err != nil {
+			return nil, err
+		}
+		si.Action = action
+		return si, nil
+	}
+
+	for i, p := range src.Permissions {
+		perm, err := parseIntentionPermission(p)
+		if err != nil {
+			return nil, fmt.Errorf("permission %d: %v", i, err)
+		}
+		si.Permissions = append(si.Permissions, perm)
+	}
+	return si, nil
+}
+
+func parseIntentionAction(action string) (api.IntentionAction, error) {
+	switch api.IntentionAction(action) {
+	case api.IntentionActionAllow, api.IntentionActionDeny:
+		return api.IntentionAction(action), nil
+	default:
+		return "", fmt.Errorf("action must be %q or %q, not %q",
+			api.IntentionActionAllow, api.IntentionActionDeny, action)
+	}
+}
+
+func parseIntentionPermission(p *userConfigIntentionPermission) (*api.IntentionPermission, error) {
+	action, err := parseIntentionAction(p.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := 0
+	for _, path := range []string{p.PathExact, p.PathPrefix, p.PathRegex} {
+		if path != "" {
+			paths++
+		}
+	}
+	if paths > 1 {
+		return nil, fmt.Errorf("only one of path_exact, path_prefix and path_regex may be set")
+	}
+	for _, path := range []string{p.PathExact, p.PathPrefix} {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path %q must begin with a /", path)
+		}
+	}
+
+	http := &api.IntentionHTTPPermission{
+		PathExact:  p.PathExact,
+		PathPrefix: p.PathPrefix,
+		PathRegex:  p.PathRegex,
+	}
+	for _, m := range p.Methods {
+		if !stringSliceContains(intentionHTTPMethods, m) {
+			return nil, fmt.Errorf("unknown http method %q", m)
+		}
+		http.Methods = append(http.Methods, m)
+	}
+	for _, h := range p.Headers {
+		matchers := 0
+		if h.Present {
+			matchers++
+		}
+		for _, v := range []string{h.Exact, h.Prefix, h.Suffix, h.Regex} {
+			if v != "" {
+				matchers++
+			}
+		}
+		if matchers != 1 {
+			return nil, fmt.Errorf("header %q needs exactly one of present, exact, prefix, suffix and regex", h.Name)
+		}
+		http.Header = append(http.Header, api.IntentionHTTPHeaderPermission{
+			Name:    h.Name,
+			Present: h.Present,
+			Exact:   h.Exact,
+			Prefix:  h.Prefix,
+			Suffix:  h.Suffix,
+			Regex:   h.Regex,
+			Invert:  h.Invert,
+		})
+	}
+
+	perm := &api.IntentionPermission{Action: action}
+	if paths > 0 || len(http.Methods) > 0 || len(http.Header) > 0 {
+		perm.HTTP = http
+	}
+	return perm, nil
+}
+
+func intentionName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+func sortIntentionSources(sources []*api.SourceIntention) {
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Namespace != sources[j].Namespace {
+			return sources[i].Namespace < sources[j].Namespace
+		}
+		return sources[i].Name < sources[j].Name
+	})
+}
+
+// mergeDeclaredIntentions lays the declared intentions over the generated
+// ones. A declared source replaces the generated source of the same name,
+// and the generated sources it does not mention are kept.
+func mergeDeclaredIntentions(generated, declared []*api.ServiceIntentionsConfigEntry) []*api.ServiceIntentionsConfigEntry {
+	byName := make(map[string]*api.ServiceIntentionsConfigEntry)
+	out := make([]*api.ServiceIntentionsConfigEntry, 0, len(generated)+len(declared))
+	for _, g := range generated {
+		byName[intentionName(g.Namespace, g.Name)] = g
+		out = append(out, g)
+	}
+
+	for _, d := range declared {
+		g, ok := byName[intentionName(d.Namespace, d.Name)]
+		if !ok {
+			out = append(out, d)
+			continue
+		}
+
+		overridden := make(map[string]struct{})
+		for _, src := range d.Sources {
+			overridden[intentionName(src.Namespace, src.Name)] = struct{}{}
+		}
+		sources := append([]*api.SourceIntention(nil), d.Sources...)
+		for _, src := range g.Sources {
+			if _, ok := overridden[intentionName(src.Namespace, src.Name)]; !ok {
+				sources = append(sources, src)
+			}
+		}
+		sortIntentionSources(sources)
+		g.Sources = sources
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Namespace != out[j].Namespace {
+			return out[i].Namespace < out[j].Namespace
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeclaredIntentions_Invalid(t *testing.T) {
+	cases := map[string]struct {
+		body   string
+		expect string
+	}{
+		"action and permission": {
+			body: `
+				intentions {
+					service "pong" {
+						source "ping" {
+							action = "allow"
+							permission {
+								action = "deny"
+							}
+						}
+					}
+				}`,
+			expect: `intentions for "pong": source "ping": action and permission blocks are mutually exclusive`,
+		},
+		"no action": {
+			body: `
+				intentions {
+					service "pong" {
+						source "ping" {}
+					}
+				}`,
+			expect: `intentions for "pong": source "ping": either action or at least one permission block is required`,
+		},
+		"bad method": {
+			body: `
+				intentions {
+					service "pong" {
+						source "ping" {
+							permission {
+								action  = "allow"
+								methods = ["get"]
+							}
+						}
+					}
+				}`,
+			expect: `intentions for "pong": source "ping": permission 0: unknown http method "get"`,
+		},
+		"two paths": {
+			body: `
+				intentions {
+					service "pong" {
+						source "ping" {
+							permission {
+								action      = "allow"
+								path_exact  = "/a"
+								path_prefix = "/b"
+							}
+						}
+					}
+				}`,
+			expect: `intentions for "pong": source "ping": permission 0: only one of path_exact, path_prefix and path_regex may be set`,
+		},
+		"header without matcher": {
+			body: `
+				intentions {
+					service "pong" {
+						source "ping" {
+							permission {
+								action = "deny"
+								header "x-debug" {}
+							}
+						}
+					}
+				}`,
+			expect: `intentions for "pong": source "ping": permission 0: header "x-debug" needs exactly one of present, exact, prefix, suffix and regex`,
+		},
+		"namespace without enterprise": {
+			body: `
+				intentions {
+					service "pong" {
+						namespace = "foo"
+					}
+				}`,
+			expect: `intentions for "pong": namespace cannot be set when enterprise.enabled=false`,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, _, err := parseConfigPartial([]byte(tc.body))
+			require.EqualError(t, err, tc.expect)
+		})
+	}
+}
+
+func TestMergeDeclaredIntentions(t *testing.T) {
+	generated := []*api.ServiceIntentionsConfigEntry{{
+		Kind: api.ServiceIntentions,
+		Name: "pong",
+		Sources: []*api.SourceIntention{
+			{Name: "ping", Action: api.IntentionActionAllow},
+			{Name: "pang", Action: api.IntentionActionAllow},
+		},
+	}}
+	declared := []*api.ServiceIntentionsConfigEntry{
+		{
+			Kind: api.ServiceIntentions,
+			Name: "pong",
+			Sources: []*api.SourceIntention{
+				{Name: "ping", Action: api.IntentionActionDeny},
+				{Name: "*", Action: api.IntentionActionDeny},
+			},
+		},
+		{
+			Kind: api.ServiceIntentions,
+			Name: "ping",
+			Sources: []*api.SourceIntention{
+				{Name: "*", Action: api.IntentionActionDeny},
+			},
+		},
+	}
+
+	got := mergeDeclaredIntentions(generated, declared)
+	require.Equal(t, []*api.ServiceIntentionsConfigEntry{
+		{
+			Kind: api.ServiceIntentions,
+			Name: "ping",
+			Sources: []*api.SourceIntention{
+				{Name: "*", Action: api.IntentionActionDeny},
+			},
+		},
+		{
+			Kind: api.ServiceIntentions,
+			Name: "pong",
+			Sources: []*api.SourceIntention{
+				{Name: "*", Action: api.IntentionActionDeny},
+				{Name: "pang", Action: api.IntentionActionAllow},
+				{Name: "ping", Action: api.IntentionActionDeny},
+			},
+		},
+	}, got)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+func (c *Core) RunExport() error {
+	args := flag.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("Missing required export type: [k8s]")
+	}
+
+	switch args[0] {
+	case "k8s":
+		out, err := c.generateK8SManifests()
+		if err != nil {
+			return err
+		}
+		c.logger.Warn("every agent, mesh gateway and service token in the exported devconsul-tokens secret is the master token")
+		fmt.Print(out)
+		return nil
+	default:
+		return fmt.Errorf("unknown export type: %s", args[0])
+	}
+}
+
+// generateK8SManifests renders the entire topology as kubernetes manifests.
+//
+// Each devconsul pod becomes a real Pod fronted by a headless Service of the
+// same name as the node, so agents can find each other by DNS instead of by
+// the fixed docker addresses.
+//
+// The exported cluster is never booted by devconsul, so the usual ACL setup
+// doesn't happen there. Consul's agent config can only set the master token,
+// not create tokens with narrower policies, so the master token is pinned on
+// the primary servers and reused as every other token the agents and
+// sidecars need.
+func (c *Core) generateK8SManifests() (string, error) {
+	if c.topology.NetworkShape != NetworkShapeFlat {
+		return "", fmt.Errorf("exporting kubernetes manifests currently requires network_shape=flat")
+	}
+	if c.config.VaultEnabled {
+		return "", fmt.Errorf("exporting kubernetes manifests does not support vault.enabled=true")
+	}
+	if c.config.ClientTLS != ClientTLSStatic {
+		return "", fmt.Errorf("exporting kubernetes manifests does not support security.client_tls=%q", c.config.ClientTLS)
+	}
+
+	masterToken, err := c.cache.LoadValue("master-token")
+	if err != nil {
+		return "", err
+	}
+	if masterToken == "" {
+		masterToken = c.config.InitialMasterToken
+	}
+	if masterToken == "" {
+		return "", fmt.Errorf("no master token is known yet; run 'devconsul up' first or set security.initial_master_token")
+	}
+
+	info := k8sManifestInfo{
+		TLS:           c.config.EncryptionTLS,
+		Tokens:        map[string]string{"ready.val": "1"},
+		TLSFiles:      make(map[string]string),
+		Scripts:       make(map[string]string),
+		ConsulImage:   c.config.ConsulImage,
+		EnvoyLogLevel: c.config.EnvoyLogLevel,
+	}
+
+	for _, name := range []string{"sidecar-boot.sh", "mesh-gateway-sidecar-boot.sh"} {
+		b, err := ioutil.ReadFile(filepath.Join(c.rootDir, name))
+		if err != nil {
+			return "", err
+		}
+		info.Scripts[name] = string(b)
+	}
+
+	if c.config.EncryptionTLS {
+		ca, err := c.cache.LoadStringFile("tls/consul-agent-ca.pem")
+		if err != nil {
+			return "", err
+		}
+		info.TLSFiles["consul-agent-ca.pem"] = ca
+	}
+
+	err = c.topology.Walk(func(node *Node) error {
+		agentInfo := c.agentConfigInfo(node)
+		agentInfo.AdvertiseAddr = `{{ GetPrivateIP }}`
+		agentInfo.RetryJoin = `"` + strings.Join(c.k8sServerNames(node.Datacenter), `", "`) + `"`
+		agentInfo.AgentToken = masterToken
+		agentInfo.Prometheus = false
+		if node.Server {
+			var names []string
+			for _, dc := range c.topology.Datacenters() {
+				names = append(names, c.k8sServerNames(dc.Name)[0])
+			}
+			agentInfo.RetryJoinWAN = `"` + strings.Join(names, `", "`) + `"`
+			if !agentInfo.SecondaryServer {
+				agentInfo.MasterToken = masterToken
+			}
+		}
+
+		agentHCL, err := renderAgentHCL(&agentInfo)
+		if err != nil {
+			return err
+		}
+
+		pod := &k8sPod{
+			Name:     node.Name + "-pod",
+			NodeName: node.Name,
+			Labels: map[string]string{
+				"devconsul": "1",
+			},
+			Config: map[string]string{
+				"agent.hcl": agentHCL,
+			},
+			Ports: []k8sPort{
+				{"serf-lan-tcp", 8301, "TCP"},
+				{"serf-lan-udp", 8301, "UDP"},
+				{"http", 8500, "TCP"},
+			},
+			Gateway:    node.MeshGateway,
+			EnvoyImage: "local/consul-envoy:latest",
+		}
+		node.AddLabels(pod.Labels)
+
+		if node.Canary {
+			pod.EnvoyImage = "local/consul-envoy-canary:latest"
+		}
+
+		if c.config.EncryptionTLSAPI {
+			pod.Ports = append(pod.Ports, k8sPort{"https", 8501, "TCP"})
+		}
+
+		if c.config.EncryptionTLS {
+			for _, suffix := range []string{".pem", "-key.pem"} {
+				name := agentInfo.TLSFilePrefix + suffix
+				contents, err := c.cache.LoadStringFile("tls/" + name)
+				if err != nil {
+					return err
+				}
+				info.TLSFiles[name] = contents
+			}
+		}
+
+		if node.Server {
+			pod.Ports = append(pod.Ports,
+				k8sPort{"server", 8300, "TCP"},
+				k8sPort{"serf-wan-tcp", 8302, "TCP"},
+				k8sPort{"serf-wan-udp", 8302, "UDP"},
+			)
+		} else {
+			pod.Ports = append(pod.Ports, k8sPort{"grpc", 8502, "TCP"})
+		}
+
+		if node.MeshGateway {
+			info.Tokens["mesh-gateway.val"] = masterToken
+			pod.Ports = append(pod.Ports,
+				k8sPort{"mesh-gateway", 8443, "TCP"},
+				k8sPort{"envoy-admin", 19000, "TCP"},
+			)
+			pod.GatewayArgs = []string{
+				"/secrets/ready.val",
+				"-t",
+				"/secrets/mesh-gateway.val",
+			}
+			if c.config.EncryptionTLSAPI {
+				pod.GatewayArgs = append(pod.GatewayArgs, "-e")
+			}
+		}
+
+		if svc := node.Service; svc != nil {
+			if svc.TransparentProxy {
+				return fmt.Errorf("%s: transparent proxies cannot be exported to kubernetes", node.Name)
+			}
+
+			info.Tokens["service-token--"+svc.Name+".val"] = masterToken
+
+			regHCL, err := GetServiceRegistrationHCL(*svc)
+			if err != nil {
+				return err
+			}
+			pod.ServiceRegFile = "servicereg__" + node.Name + "__" + svc.Name + ".hcl"
+			pod.Config[pod.ServiceRegFile] = regHCL
+
+			pod.Service = svc
+			pod.AppName = svc.Name + serviceMetaString(svc.Meta)
+			pod.UseBuiltinProxy = node.UseBuiltinProxy
+			pod.SidecarArgs = c.sidecarBootArgs(node, false)
+			pod.Ports = append(pod.Ports, k8sPort{"app", svc.Port, "TCP"})
+			if !node.UseBuiltinProxy {
+				pod.Ports = append(pod.Ports, k8sPort{"envoy-admin", 19000, "TCP"})
+			}
+		}
+
+		info.Pods = append(info.Pods, pod)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return stringTemplate(k8sManifestT, &info)
+}
+
+// k8sServerNames returns the service names of the servers in the datacenter.
+func (c *Core) k8sServerNames(dc string) []string {
+	var out []string
+	for _, n := range c.topology.DatacenterNodes(dc) {
+		if n.Server {
+			out = append(out, n.Name)
+		}
+	}
+	return out
+}
+
+type k8sManifestInfo struct {
+	TLS           bool
+	Tokens        map[string]string // filename -> contents
+	TLSFiles      map[string]string // filename -> contents
+	Scripts       map[string]string // filename -> contents
+	ConsulImage   string
+	EnvoyLogLevel string
+	Pods          []*k8sPod
+}
+
+type k8sPod struct {
+	Name            string
+	NodeName        string
+	Labels          map[string]string
+	Config          map[string]string // filename -> contents
+	Ports           []k8sPort
+	Gateway         bool
+	GatewayArgs     []string
+	Service         *Service
+	ServiceRegFile  string
+	AppName         string
+	UseBuiltinProxy bool
+	SidecarArgs     []string
+	EnvoyImage      string
+}
+
+type k8sPort struct {
+	Name     string
+	Port     int
+	Protocol string
+}
+
+var k8sManifestT = template.Must(template.New("k8s-manifest").Funcs(template.FuncMap{
+	"quote": func(s string) string {
+		b, err := json.Marshal(s)
+		if err != nil {
+			panic("impossible to quote: " + err.Error())
+		}
+		return string(b)
+	},
+	"indent": func(s string, n int) string {
+		return strings.TrimRight(indent(s, n), "\n")
+	},
+}).Parse(`
+{{- define "labels" }}
+{{- range $k, $v := . }}
+    {{ $k }}: {{ quote $v }}
+{{- end }}
+{{- end }}
+{{- define "block" -}}
+|
+{{ indent . 4 -}}
+{{- end -}}
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: devconsul-tokens
+  labels:
+    devconsul: "1"
+type: Opaque
+stringData:
+{{- range $k, $v := .Tokens }}
+  {{ $k }}: {{ quote $v }}
+{{- end }}
+{{- if .TLS }}
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: devconsul-tls
+  labels:
+    devconsul: "1"
+type: Opaque
+stringData:
+{{- range $k, $v := .TLSFiles }}
+  {{ $k }}: {{ template "block" $v }}
+{{- end }}
+{{- end }}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: devconsul-scripts
+  labels:
+    devconsul: "1"
+data:
+{{- range $k, $v := .Scripts }}
+  {{ $k }}: {{ template "block" $v }}
+{{- end }}
+{{- $root := . }}
+{{- range .Pods }}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .NodeName }}-config
+  labels:
+{{- template "labels" .Labels }}
+data:
+{{- range $k, $v := .Config }}
+  {{ $k }}: {{ template "block" $v }}
+{{- end }}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .NodeName }}
+  labels:
+{{- template "labels" .Labels }}
+spec:
+  clusterIP: None
+  publishNotReadyAddresses: true
+  selector:
+    devconsul.node: {{ quote .NodeName }}
+  ports:
+{{- range .Ports }}
+    - name: {{ .Name }}
+      port: {{ .Port }}
+      protocol: {{ .Protocol }}
+{{- end }}
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: {{ .Name }}
+  labels:
+{{- template "labels" .Labels }}
+spec:
+  hostname: {{ .Name }}
+  containers:
+    - name: consul
+      image: {{ quote $root.ConsulImage }}
+      imagePullPolicy: IfNotPresent
+      args:
+        - "agent"
+        - "-config-file=/etc/devconsul/agent.hcl"
+      volumeMounts:
+        - name: config
+          mountPath: /etc/devconsul
+          readOnly: true
+        - name: data
+          mountPath: /consul/data
+{{- if $root.TLS }}
+        - name: tls
+          mountPath: /tls
+          readOnly: true
+{{- end }}
+{{- if .Gateway }}
+    - name: mesh-gateway
+      image: {{ quote .EnvoyImage }}
+      imagePullPolicy: IfNotPresent
+      command:
+        - "/bin/mesh-gateway-sidecar-boot.sh"
+{{- range .GatewayArgs }}
+        - {{ quote . }}
+{{- end }}
+        - "--"
+        - "-admin-bind"
+        - "0.0.0.0:19000"
+        - "--"
+        - "-l"
+        - {{ quote $root.EnvoyLogLevel }}
+      volumeMounts:
+        - name: secrets
+          mountPath: /secrets
+          readOnly: true
+        - name: scripts
+          mountPath: /bin/mesh-gateway-sidecar-boot.sh
+          subPath: mesh-gateway-sidecar-boot.sh
+{{- if $root.TLS }}
+        - name: tls
+          mountPath: /tls
+          readOnly: true
+{{- end }}
+{{- end }}
+{{- if .Service }}
+    - name: {{ .Service.Name }}
+      image: "rboyer/pingpong:latest"
+      imagePullPolicy: IfNotPresent
+      args:
+        - "-bind"
+        - "0.0.0.0:{{ .Service.Port }}"
+        - "-dial"
+        - "{{ .Service.UpstreamDialAddress }}"
+        - "-pong-chaos"
+        - "-dialfreq"
+        - "250ms"
+        - "-name"
+        - {{ quote .AppName }}
+    - name: {{ .Service.Name }}-sidecar
+      image: {{ quote .EnvoyImage }}
+      imagePullPolicy: IfNotPresent
+      command:
+        - "/bin/sidecar-boot.sh"
+{{- range .SidecarArgs }}
+        - {{ quote . }}
+{{- end }}
+        - "--"
+        - "-sidecar-for"
+        - {{ quote .Service.Name }}
+{{- if not .UseBuiltinProxy }}
+        - "-admin-bind"
+        - "0.0.0.0:19000"
+        - "--"
+        - "-l"
+        - {{ quote $root.EnvoyLogLevel }}
+{{- end }}
+      volumeMounts:
+        - name: secrets
+          mountPath: /secrets
+          readOnly: true
+        - name: scripts
+          mountPath: /bin/sidecar-boot.sh
+          subPath: sidecar-boot.sh
+{{- if $root.TLS }}
+        - name: tls
+          mountPath: /tls
+          readOnly: true
+{{- end }}
+{{- end }}
+  volumes:
+    - name: config
+      configMap:
+        name: {{ .NodeName }}-config
+    - name: data
+      emptyDir: {}
+{{- if $root.TLS }}
+    - name: tls
+      secret:
+        secretName: devconsul-tls
+{{- end }}
+    - name: scripts
+      configMap:
+        name: devconsul-scripts
+        defaultMode: 0755
+    - name: secrets
+      projected:
+        sources:
+          - secret:
+              name: devconsul-tokens
+{{- if .ServiceRegFile }}
+          - configMap:
+              name: {{ .NodeName }}-config
+              items:
+                - key: {{ .ServiceRegFile }}
+                  path: {{ .ServiceRegFile }}
+{{- end }}
+{{- end }}
+`))
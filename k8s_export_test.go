@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rboyer/devconsul/cachestore"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func TestGenerateK8SManifests(t *testing.T) {
+	body := `
+		security {
+			encryption {
+				tls    = true
+				gossip = true
+			}
+			initial_master_token = "root"
+		}
+		topology {
+			datacenter "dc1" {
+				servers       = 1
+				clients       = 2
+				mesh_gateways = 1
+			}
+		}
+	`
+	cfg, topo, err := parseConfig([]byte(body))
+	require.NoError(t, err)
+	cfg.GossipKey = "gossip-key"
+	cfg.AgentMasterToken = "agent-master-token"
+
+	cacheDir, err := ioutil.TempDir("", "devconsul-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := cachestore.New(cacheDir)
+	require.NoError(t, err)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "tls"), 0755))
+	for _, name := range []string{
+		"consul-agent-ca.pem",
+		"dc1-server-consul-0.pem",
+		"dc1-server-consul-0-key.pem",
+		"dc1-client-consul-0.pem",
+		"dc1-client-consul-0-key.pem",
+		"dc1-client-consul-1.pem",
+		"dc1-client-consul-1-key.pem",
+		"dc1-client-consul-2.pem",
+		"dc1-client-consul-2-key.pem",
+	} {
+		require.NoError(t, cache.WriteStringFile("tls/"+name, "<"+name+">"))
+	}
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	c := &Core{
+		logger:   hclog.NewNullLogger(),
+		rootDir:  cwd,
+		cache:    cache,
+		config:   cfg,
+		topology: topo,
+	}
+
+	out, err := c.generateK8SManifests()
+	require.NoError(t, err)
+
+	goldenFile := filepath.Join("testdata", "k8s-manifests.golden.yml")
+	if *updateGolden {
+		require.NoError(t, ioutil.WriteFile(goldenFile, []byte(out), 0644))
+	}
+
+	expect, err := ioutil.ReadFile(goldenFile)
+	require.NoError(t, err)
+	require.Equal(t, string(expect), out)
+}
+
+func TestGenerateK8SManifests_CanaryGateway(t *testing.T) {
+	cfg, topo, err := parseConfig([]byte(`
+		security {
+			initial_master_token = "root"
+		}
+		topology {
+			datacenter "dc1" {
+				servers       = 1
+				clients       = 1
+				mesh_gateways = 1
+			}
+		}
+	`))
+	require.NoError(t, err)
+
+	var gateway *Node
+	topo.WalkSilent(func(n *Node) {
+		if n.MeshGateway {
+			gateway = n
+		}
+	})
+	require.NotNil(t, gateway)
+	gateway.Canary = true
+
+	cacheDir, err := ioutil.TempDir("", "devconsul-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := cachestore.New(cacheDir)
+	require.NoError(t, err)
+
+	c := &Core{
+		logger:   hclog.NewNullLogger(),
+		cache:    cache,
+		config:   cfg,
+		topology: topo,
+	}
+
+	out, err := c.generateK8SManifests()
+	require.NoError(t, err)
+	require.Contains(t, out, "- name: mesh-gateway\n      image: \"local/consul-envoy-canary:latest\"")
+}
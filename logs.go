@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (c *Core) RunLogs() error {
+	var (
+		dcs, nodes, types string
+		since, grep       string
+		follow            bool
+	)
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	fs.StringVar(&dcs, "dc", "", "comma separated list of datacenters to show")
+	fs.StringVar(&nodes, "node", "", "comma separated list of nodes to show")
+	fs.StringVar(&types, "type", "", "comma separated list of container types to show: consul, sidecar, gateway, app, infra")
+	fs.StringVar(&since, "since", "", "only show logs since this timestamp or relative duration (e.g. 10m)")
+	fs.StringVar(&grep, "grep", "", "only show lines matching this regular expression")
+	fs.BoolVar(&follow, "f", false, "follow log output")
+	if err := fs.Parse(flag.Args()); err != nil {
+		return err
+	}
+
+	filter := &logFilter{
+		Datacenters: splitList(dcs),
+		Nodes:       splitList(nodes),
+		Types:       splitList(types),
+	}
+	for _, typ := range filter.Types {
+		switch typ {
+		case "consul", "sidecar", "gateway", "app", "infra":
+		default:
+			return fmt.Errorf("unknown container type: %s", typ)
+		}
+	}
+	if grep != "" {
+		re, err := regexp.Compile(grep)
+		if err != nil {
+			return fmt.Errorf("invalid -grep: %v", err)
+		}
+		filter.Grep = re
+	}
+
+	sources, err := c.listLogSources()
+	if err != nil {
+		return err
+	}
+
+	var matched []*logSource
+	for _, src := range sources {
+		if filter.Match(src) {
+			matched = append(matched, src)
+		}
+	}
+	if len(matched) == 0 {
+		return fmt.Errorf("no containers match")
+	}
+
+	args := []string{"logs", "--timestamps"}
+	if since != "" {
+		args = append(args, "--since", since)
+	}
+	if follow {
+		args = append(args, "--follow")
+	}
+
+	p := newLogPrinter(matched, isTerminal(os.Stdout))
+
+	var (
+		mu    sync.Mutex
+		lines []logLine // only used without -f
+		wg    sync.WaitGroup
+	)
+	for _, src := range matched {
+		src := src
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.streamContainerLogs(src, args, func(line logLine) {
+				if filter.Grep != nil && !filter.Grep.MatchString(line.Text) {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if follow {
+					p.Print(os.Stdout, line)
+				} else {
+					lines = append(lines, line)
+				}
+			})
+			if err != nil {
+				c.logger.Warn("error reading container logs", "container", src.Name, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Without -f everything has already been read, so it can be shown as
+	// one timeline instead of in whatever order the containers answered.
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].Time.Before(lines[j].Time)
+	})
+	for _, line := range lines {
+		p.Print(os.Stdout, line)
+	}
+	return nil
+}
+
+// logSource is a container along with the devconsul labels that describe it.
+type logSource struct {
+	ID         string
+	Name       string
+	Type       string
+	Datacenter string
+	Node       string
+}
+
+// Label is the prefix shown in front of each of the container's lines.
+func (s *logSource) Label() string {
+	if s.Node == "" {
+		return s.Name
+	}
+	return s.Node + " " + s.Type
+}
+
+const logSourceFormat = `{{.ID}}\t{{.Names}}\t{{.Label "devconsul.type"}}\t{{.Label "devconsul.datacenter"}}\t{{.Label "devconsul.node"}}`
+
+func (c *Core) listLogSources() ([]*logSource, error) {
+	var out bytes.Buffer
+	err := c.dockerExec([]string{
+		"ps", "-a",
+		"--filter", "label=devconsul=1",
+		"--format", logSourceFormat,
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return parseLogSources(out.String())
+}
+
+func parseLogSources(raw string) ([]*logSource, error) {
+	var out []*logSource
+	for _, line := range strings.Split(raw, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		if len(parts) != 5 {
+			return nil, fmt.Errorf("unexpected docker ps output: %q", line)
+		}
+		out = append(out, &logSource{
+			ID:         parts[0],
+			Name:       parts[1],
+			Type:       parts[2],
+			Datacenter: parts[3],
+			Node:       parts[4],
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+type logFilter struct {
+	Datacenters []string
+	Nodes       []string
+	Types       []string
+	Grep        *regexp.Regexp
+}
+
+// Match reports whether the container's logs should be shown. The pause
+// containers anchoring each pod never log anything, so they are skipped.
+func (f *logFilter) Match(src *logSource) bool {
+	if src.Type == "pod" {
+		return false
+	}
+	if len(f.Datacenters) > 0 && !stringSliceContains(f.Datacenters, src.Datacenter) {
+		return false
+	}
+	if len(f.Nodes) > 0 && !stringSliceContains(f.Nodes, src.Node) {
+		return false
+	}
+	if len(f.Types) > 0 && !stringSliceContains(f.Types, src.Type) {
+		return false
+	}
+	return true
+}
+
+type logLine struct {
+	Source *logSource
+	Time   time.Time
+	Text   string
+}
+
+// parseLogLine splits off the timestamp that 'docker logs --timestamps'
+// puts in front of every line.
+func parseLogLine(src *logSource, raw string) logLine {
+	line := logLine{Source: src, Text: raw}
+	if idx := strings.IndexByte(raw, ' '); idx > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, raw[:idx]); err == nil {
+			line.Time = t
+			line.Text = raw[idx+1:]
+		}
+	}
+	return line
+}
+
+func (c *Core) streamContainerLogs(src *logSource, args []string, f func(logLine)) error {
+	pr, pw := io.Pipe()
+
+	cmdArgs := append(append([]string(nil), args...), src.ID)
+
+	cmd := exec.Command(c.dockerBin, cmdArgs...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cmd.Wait()
+		pw.Close()
+	}()
+
+	s := bufio.NewScanner(pr)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		f(parseLogLine(src, s.Text()))
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return <-errCh
+}
+
+// logDatacenterColors are the ANSI colors used for each datacenter in turn.
+var logDatacenterColors = []int{36, 35, 33, 32, 34, 31}
+
+type logPrinter struct {
+	width int
+	color bool
+}
+
+func newLogPrinter(sources []*logSource, color bool) *logPrinter {
+	p := &logPrinter{color: color}
+	for _, src := range sources {
+		if n := len(src.Label()); n > p.width {
+			p.width = n
+		}
+	}
+	return p
+}
+
+func (p *logPrinter) Print(w io.Writer, line logLine) {
+	prefix := fmt.Sprintf("%-*s |", p.width, line.Source.Label())
+	if p.color {
+		if code := datacenterColor(line.Source.Datacenter); code != 0 {
+			prefix = "\x1b[" + strconv.Itoa(code) + "m" + prefix + "\x1b[0m"
+		}
+	}
+	fmt.Fprintln(w, prefix, line.Text)
+}
+
+func datacenterColor(dc string) int {
+	if !strings.HasPrefix(dc, "dc") {
+		return 0
+	}
+	idx, err := strconv.Atoi(strings.TrimPrefix(dc, "dc"))
+	if err != nil || idx < 1 {
+		return 0
+	}
+	return logDatacenterColors[(idx-1)%len(logDatacenterColors)]
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func stringSliceContains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogSources(t *testing.T) {
+	raw := "" +
+		"c1\tdc1-client1-ping-sidecar\tsidecar\tdc1\tdc1-client1\n" +
+		"c2\tdc1-client1-pod\tpod\tdc1\tdc1-client1\n" +
+		"c3\tdc2-server1\tconsul\tdc2\tdc2-server1\n" +
+		"c4\tprometheus\tinfra\t\t\n" +
+		"c5\tdc1-client1\tconsul\tdc1\tdc1-client1\n"
+
+	sources, err := parseLogSources(raw)
+	require.NoError(t, err)
+	require.Len(t, sources, 5)
+	require.Equal(t, "dc1-client1", sources[0].Name)
+	require.Equal(t, "prometheus", sources[4].Label())
+	require.Equal(t, "dc1-client1 sidecar", sources[1].Label())
+
+	names := func(f *logFilter) []string {
+		var out []string
+		for _, src := range sources {
+			if f.Match(src) {
+				out = append(out, src.Name)
+			}
+		}
+		return out
+	}
+
+	require.Equal(t, []string{
+		"dc1-client1",
+		"dc1-client1-ping-sidecar",
+		"dc2-server1",
+		"prometheus",
+	}, names(&logFilter{}))
+	require.Equal(t, []string{
+		"dc1-client1",
+		"dc1-client1-ping-sidecar",
+	}, names(&logFilter{Datacenters: []string{"dc1"}}))
+	require.Equal(t, []string{
+		"dc1-client1",
+		"dc2-server1",
+	}, names(&logFilter{Types: []string{"consul"}}))
+	require.Equal(t, []string{
+		"dc1-client1-ping-sidecar",
+	}, names(&logFilter{Nodes: []string{"dc1-client1"}, Types: []string{"sidecar", "app"}}))
+
+	_, err = parseLogSources("c1\tonly-two\n")
+	require.Error(t, err)
+}
+
+func TestLogPrinter(t *testing.T) {
+	sources := []*logSource{
+		{Name: "dc1-server1", Type: "consul", Datacenter: "dc1", Node: "dc1-server1"},
+		{Name: "dc2-client1-pong-sidecar", Type: "sidecar", Datacenter: "dc2", Node: "dc2-client1"},
+	}
+
+	line := parseLogLine(sources[1], "2021-01-02T03:04:05.123456789Z [info] envoy started")
+	require.Equal(t, "[info] envoy started", line.Text)
+	require.Equal(t, time.Date(2021, 1, 2, 3, 4, 5, 123456789, time.UTC), line.Time)
+
+	// Lines without a timestamp are passed through as is.
+	require.Equal(t, "no timestamp", parseLogLine(sources[0], "no timestamp").Text)
+
+	var buf bytes.Buffer
+	newLogPrinter(sources, false).Print(&buf, line)
+	require.Equal(t, "dc2-client1 sidecar | [info] envoy started\n", buf.String())
+
+	buf.Reset()
+	newLogPrinter(sources, true).Print(&buf, parseLogLine(sources[0], "hello"))
+	require.Equal(t, "\x1b[36mdc1-server1 consul  |\x1b[0m hello\n", buf.String())
+}
@@ -15,6 +15,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-uuid"
@@ -36,6 +37,14 @@ var allCommands = []command{
 	{"down", (*Core).RunBringDown, []string{"destroy", "rm"}}, // porcelain
 	{"restart", (*Core).RunRestart, nil},                      // porcelain
 	{"config", (*Core).RunConfigDump, nil},                    // porcelain
+	{"export", (*Core).RunExport, nil},                        // porcelain
+	{"plan", (*Core).RunPlan, nil},                            // porcelain
+	{"ca", (*Core).RunCA, nil},                                // porcelain
+	{"tls", (*Core).RunTLS, nil},                              // porcelain
+	{"gossip", (*Core).RunGossip, nil},                        // porcelain
+	{"logs", (*Core).RunLogs, nil},                            // porcelain
+	{"tokens", (*Core).RunTokens, nil},                        // porcelain
+	{"snapshot", (*Core).RunSnapshot, nil},                    // porcelain
 	// ================ special scenarios
 	{"force-docker", (*Core).RunForceDocker, []string{"docker"}},
 	{"primary", (*Core).RunBringUpPrimary, []string{"up-primary", "up-pri"}},
@@ -45,6 +54,13 @@ var allCommands = []command{
 	{"config-entries", (*Core).RunDebugListConfigs, nil},
 }
 
+// ownFlagCommands take flags that are not known to the global flag set, so
+// everything after their name is left for them to parse.
+var ownFlagCommands = map[string]struct{}{
+	"logs":   {},
+	"tokens": {},
+}
+
 func main() {
 	log.SetOutput(ioutil.Discard)
 
@@ -64,9 +80,28 @@ func main() {
 	os.Args = os.Args[1:]
 	os.Args[0] = programName
 
-	var resetOnce bool
+	var (
+		resetOnce   bool
+		parallelism int
+		bootTimeout time.Duration
+		logSecrets  bool
+	)
 	flag.BoolVar(&resetOnce, "force", false, "force one time operations to run again")
-	flag.Parse()
+	flag.IntVar(&parallelism, "parallelism", defaultParallelism, "how many nodes to talk to at once while booting")
+	flag.DurationVar(&bootTimeout, "timeout", defaultBootTimeout, "how long booting may take before giving up (0 waits forever)")
+	flag.BoolVar(&logSecrets, "log-secrets", false, "log token secrets while booting, not just their accessors")
+
+	args := os.Args[1:]
+	if _, ok := ownFlagCommands[subcommand]; ok {
+		// Everything after the subcommand belongs to its own flag set.
+		args = append([]string{"--"}, args...)
+	}
+	flag.CommandLine.Parse(args)
+
+	if parallelism < 1 {
+		logger.Error("-parallelism must be at least 1")
+		os.Exit(1)
+	}
 
 	if resetOnce {
 		if err := resetRunOnceMemory(); err != nil {
@@ -86,14 +121,20 @@ func main() {
 	}
 
 	destroying := (subcommand == "down")
-	configOnly := (subcommand == "config")
+	planning := (subcommand == "plan")
+	// tokens only reads the registry, so it must not mint anything.
+	configOnly := (subcommand == "config" || subcommand == "tokens")
 
-	core, err := NewCore(logger, configOnly, destroying)
+	core, err := NewCore(logger, configOnly, planning, destroying)
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
+	core.parallelism = parallelism
+	core.bootTimeout = bootTimeout
+	core.logSecrets = logSecrets
+
 	commandMap := make(map[string]func(core *Core) error)
 	for _, cmd := range allCommands {
 		commandMap[cmd.Name] = cmd.Func
@@ -123,7 +164,6 @@ type Core struct {
 
 	devconsulBin string // special
 
-	consulBin   string
 	tfBin       string
 	dockerBin   string
 	minikubeBin string // optional
@@ -134,10 +174,12 @@ type Core struct {
 
 	topology *Topology
 
+	plan *planRecorder // non-nil when only planning
+
 	BootInfo // for boot
 }
 
-func NewCore(logger hclog.Logger, configOnly, destroying bool) (*Core, error) {
+func NewCore(logger hclog.Logger, configOnly, planning, destroying bool) (*Core, error) {
 	c := &Core{
 		logger: logger,
 	}
@@ -159,7 +201,10 @@ func NewCore(logger hclog.Logger, configOnly, destroying bool) (*Core, error) {
 		return nil, err
 	}
 
+	cacheDir := filepath.Join(c.rootDir, "cache")
+
 	if configOnly {
+		c.cache = cachestore.OpenReadOnly(cacheDir)
 		return c, nil
 	}
 
@@ -171,11 +216,21 @@ func NewCore(logger hclog.Logger, configOnly, destroying bool) (*Core, error) {
 		return c, nil
 	}
 
-	cacheDir := filepath.Join(c.rootDir, "cache")
+	// Catch broken config entries before anything is brought up.
+	if _, err := c.desiredConfigEntries(); err != nil {
+		return nil, fmt.Errorf("config_entries: %v", err)
+	}
 
-	c.cache, err = cachestore.New(cacheDir)
-	if err != nil {
-		return nil, err
+	if planning {
+		// Whatever would be generated below is only kept in memory and
+		// reported as part of the plan.
+		c.plan = &planRecorder{}
+		c.cache = cachestore.OpenReadOnly(cacheDir)
+	} else {
+		c.cache, err = cachestore.New(cacheDir)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if c.config.EncryptionTLS {
@@ -183,7 +238,7 @@ func NewCore(logger hclog.Logger, configOnly, destroying bool) (*Core, error) {
 			return nil, err
 		}
 	} else {
-		if err := os.RemoveAll("cache/tls"); err != nil {
+		if err := c.removeTLSDir(); err != nil {
 			return nil, err
 		}
 	}
@@ -193,7 +248,7 @@ func NewCore(logger hclog.Logger, configOnly, destroying bool) (*Core, error) {
 			return nil, err
 		}
 	} else {
-		if err := c.cache.DelValue("gossip-key"); err != nil {
+		if err := c.delCacheValue("gossip-key"); err != nil {
 			return nil, err
 		}
 	}
@@ -202,6 +257,23 @@ func NewCore(logger hclog.Logger, configOnly, destroying bool) (*Core, error) {
 		return nil, err
 	}
 
+	if err := c.initClientTLS(); err != nil {
+		return nil, err
+	}
+
+	if c.config.VaultEnabled {
+		if err := c.initVaultTokens(); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := c.delCacheValue("vault-root-token"); err != nil {
+			return nil, err
+		}
+		if err := c.delCacheValue("vault-connect-token"); err != nil {
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
@@ -219,7 +291,6 @@ func (c *Core) lookupBinaries() error {
 		warn string // optional
 	}
 	lookup := []item{
-		{"consul", &c.consulBin, "run 'make dev' from your consul checkout"},
 		{"docker", &c.dockerBin, ""},
 		{"terraform", &c.tfBin, ""},
 	}
@@ -250,116 +321,83 @@ func (c *Core) lookupBinaries() error {
 	return nil
 }
 
-func (c *Core) initTLS() error {
-	cacheDir := filepath.Join(c.rootDir, "cache")
-	tlsDir := filepath.Join(cacheDir, "tls")
-	if err := os.MkdirAll(tlsDir, 0755); err != nil {
-		return err
-	}
+func (c *Core) initAgentMasterToken() error {
+	var err error
+	c.config.AgentMasterToken, err = c.loadOrSaveCacheValue("agent-master-token", func() (string, error) {
+		return uuid.GenerateUUID()
+	})
+	return err
+}
 
-	if exists, err := filesExist(tlsDir, "consul-agent-ca-key.pem", "consul-agent-ca.pem"); err != nil {
+// initVaultTokens picks the token IDs up front so the vault token can be
+// baked into the server agent config before vault is even running.
+func (c *Core) initVaultTokens() error {
+	var err error
+	c.config.VaultRootToken, err = c.loadOrSaveCacheValue("vault-root-token", func() (string, error) {
+		return uuid.GenerateUUID()
+	})
+	if err != nil {
 		return err
-	} else if !exists {
-		var errWriter bytes.Buffer
-
-		cmd := exec.Command(c.consulBin, "tls", "ca", "create")
-		cmd.Dir = tlsDir
-		cmd.Stdout = nil
-		cmd.Stderr = &errWriter
-		cmd.Stdin = nil
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("could not invoke 'consul' to create a CA: %v : %s", err, errWriter.String())
-		}
-		c.logger.Info("created cluster CA")
 	}
+	c.config.VaultConnectToken, err = c.loadOrSaveCacheValue("vault-connect-token", func() (string, error) {
+		return uuid.GenerateUUID()
+	})
+	return err
+}
 
-	genCert := func(dc *Datacenter, server bool, idx int) error {
-		typ := "client"
-		if server {
-			typ = "server"
-		}
-
-		prefix := fmt.Sprintf("%s-%s-consul-%d", dc.Name, typ, idx)
-
-		exists, err := filesExist(tlsDir, prefix+"-key.pem", prefix+".pem")
-		if err != nil {
-			return err
-		} else if exists {
-			return nil
-		}
-
-		c.logger.Info("creating certs", "prefix", prefix)
-
-		var errWriter bytes.Buffer
-
-		var args []string
-		if server {
-			nodeName := fmt.Sprintf("%s-server%d-pod", dc.Name, idx+1)
-			args = []string{
-				"tls", "cert", "create",
-				"-server",
-				"-dc=" + dc.Name,
-				"-node=" + nodeName,
-			}
-		} else {
-			args = []string{
-				"tls", "cert", "create",
-				"-client",
-				"-dc=" + dc.Name,
-			}
-		}
+func (c *Core) initGossipKey() error {
+	var err error
+	c.config.GossipKey, err = c.loadOrSaveCacheValue("gossip-key", generateGossipKey)
+	return err
+}
 
-		cmd := exec.Command(c.consulBin, args...)
-		cmd.Dir = tlsDir
-		cmd.Stdout = nil
-		cmd.Stderr = &errWriter
-		cmd.Stdin = nil
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("could not invoke 'consul tls cert create': %v : %s", err, errWriter.String())
-		}
+// loadOrSaveCacheValue is cache.LoadOrSaveValue, except that while planning
+// a missing value is only generated in memory and noted in the plan.
+func (c *Core) loadOrSaveCacheValue(name string, fetchFn func() (string, error)) (string, error) {
+	if c.plan == nil {
+		return c.cache.LoadOrSaveValue(name, fetchFn)
+	}
 
-		return nil
+	val, err := c.cache.LoadValue(name)
+	if err != nil || val != "" {
+		return val, err
+	}
+	val, err = fetchFn()
+	if err != nil {
+		return "", err
 	}
+	c.plan.addNote("cache/" + name + ".val would be generated")
+	return val, nil
+}
 
-	for _, dc := range c.topology.Datacenters() {
-		for i := 0; i < dc.Servers; i++ {
-			if err := genCert(&dc, true, i); err != nil {
-				return err
-			}
-		}
-		for i := 0; i < dc.Clients; i++ {
-			if err := genCert(&dc, false, i); err != nil {
-				return err
-			}
-		}
+// delCacheValue is cache.DelValue, except that while planning it is only
+// noted in the plan.
+func (c *Core) delCacheValue(name string) error {
+	if c.plan == nil {
+		return c.cache.DelValue(name)
 	}
 
+	val, err := c.cache.LoadValue(name)
+	if err != nil {
+		return err
+	}
+	if val != "" {
+		c.plan.addNote("cache/" + name + ".val would be removed")
+	}
 	return nil
 }
 
-func (c *Core) initAgentMasterToken() error {
-	var err error
-	c.config.AgentMasterToken, err = c.cache.LoadOrSaveValue("agent-master-token", func() (string, error) {
-		return uuid.GenerateUUID()
-	})
-	return err
-}
-
-func (c *Core) initGossipKey() error {
-	var err error
-	c.config.GossipKey, err = c.cache.LoadOrSaveValue("gossip-key", func() (string, error) {
-		key := make([]byte, 16)
-		n, err := rand.Reader.Read(key)
-		if err != nil {
-			return "", fmt.Errorf("Error reading random data: %s", err)
-		}
-		if n != 16 {
-			return "", fmt.Errorf("Couldn't read enough entropy. Generate more entropy!")
-		}
+func generateGossipKey() (string, error) {
+	key := make([]byte, 16)
+	n, err := rand.Reader.Read(key)
+	if err != nil {
+		return "", fmt.Errorf("Error reading random data: %s", err)
+	}
+	if n != 16 {
+		return "", fmt.Errorf("Couldn't read enough entropy. Generate more entropy!")
+	}
 
-		return base64.StdEncoding.EncodeToString(key), nil
-	})
-	return err
+	return base64.StdEncoding.EncodeToString(key), nil
 }
 
 func filesExist(parent string, paths ...string) (bool, error) {
@@ -7,5 +7,10 @@ unset CDPATH
 
 echo "use the master token of: $(cat cache/master-token.val)"
 
+url="$(devconsul config url.dc1-server1.http)"
+if [[ -z "${url}" ]]; then
+    url="http://10.0.1.11:8500"
+fi
+
 set -x
-exec google-chrome --incognito "http://10.0.1.11:8500/"
+exec google-chrome --incognito "${url}/"
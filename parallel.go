@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// defaultParallelism is how many nodes boot talks to at once unless
+// -parallelism says otherwise.
+const defaultParallelism = 8
+
+// runParallel runs every task concurrently and returns all of their errors.
+// If limiter is non-nil each task holds a slot in it while it runs, so that
+// tasks started from different places still share one bound.
+func runParallel(limiter chan struct{}, tasks []func() error) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result *multierror.Error
+	)
+	for _, task := range tasks {
+		task := task
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter != nil {
+				limiter <- struct{}{}
+				defer func() { <-limiter }()
+			}
+			if err := task(); err != nil {
+				mu.Lock()
+				result = multierror.Append(result, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return result.ErrorOrNil()
+}
+
+// walkParallel is like Topology.Walk, except up to -parallelism nodes are
+// visited at once and every node is visited even if some fail. Errors are
+// prefixed with the node they came from.
+func (c *Core) walkParallel(f func(node *Node) error) error {
+	var tasks []func() error
+	c.topology.WalkSilent(func(node *Node) {
+		tasks = append(tasks, func() error {
+			if err := f(node); err != nil {
+				return fmt.Errorf("%s: %v", node.Name, err)
+			}
+			return nil
+		})
+	})
+	return runParallel(c.nodeLimiter(), tasks)
+}
+
+// eachDatacenter runs f for every datacenter at once. The per-datacenter work
+// is not bounded by -parallelism because it mostly fans out to nodes, which
+// are.
+func (c *Core) eachDatacenter(dcs []Datacenter, f func(dc Datacenter) error) error {
+	var tasks []func() error
+	for _, dc := range dcs {
+		dc := dc
+		tasks = append(tasks, func() error {
+			if err := f(dc); err != nil {
+				return fmt.Errorf("%s: %v", dc.Name, err)
+			}
+			return nil
+		})
+	}
+	return runParallel(nil, tasks)
+}
+
+func (c *Core) nodeLimiter() chan struct{} {
+	c.bootMu.Lock()
+	defer c.bootMu.Unlock()
+	if c.limiter == nil {
+		n := c.parallelism
+		if n < 1 {
+			n = defaultParallelism
+		}
+		c.limiter = make(chan struct{}, n)
+	}
+	return c.limiter
+}
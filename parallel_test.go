@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunParallel(t *testing.T) {
+	var (
+		running, peak int32
+		tasks         []func() error
+	)
+	for i := 0; i < 10; i++ {
+		i := i
+		tasks = append(tasks, func() error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			if i%4 == 0 {
+				return errors.New("boom")
+			}
+			return nil
+		})
+	}
+
+	err := runParallel(make(chan struct{}, 3), tasks)
+	require.Error(t, err)
+	merr, ok := err.(*multierror.Error)
+	require.True(t, ok)
+	require.Len(t, merr.Errors, 3)
+	require.LessOrEqual(t, int(peak), 3)
+	require.Greater(t, int(peak), 1)
+
+	require.NoError(t, runParallel(nil, nil))
+}
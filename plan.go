@@ -0,0 +1,692 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/rboyer/devconsul/consulfunc"
+)
+
+// planRecorder captures everything that would have been written to disk so
+// that 'plan' can report on it instead.
+type planRecorder struct {
+	files []*plannedFile
+	notes []string
+}
+
+type plannedFile struct {
+	Path string
+	Prev []byte // nil if the file does not exist yet
+	Next []byte
+}
+
+func (p *planRecorder) recordFile(path string, prev, next []byte) {
+	p.files = append(p.files, &plannedFile{
+		Path: path,
+		Prev: prev,
+		Next: next,
+	})
+}
+
+func (p *planRecorder) addNote(note string) {
+	p.notes = append(p.notes, note)
+}
+
+func (p *planRecorder) file(path string) *plannedFile {
+	for _, f := range p.files {
+		if f.Path == path {
+			return f
+		}
+	}
+	return nil
+}
+
+// RunPlan renders every generated artifact in memory and reports how it
+// differs from what 'up' last did, without touching docker.
+func (c *Core) RunPlan() error {
+	if c.plan == nil {
+		c.plan = &planRecorder{}
+	}
+	defer func() { c.plan = nil }()
+
+	if err := c.generateConfigs(false); err != nil {
+		return err
+	}
+	if c.config.PrometheusEnabled {
+		if err := c.generatePrometheusConfigFile(); err != nil {
+			return err
+		}
+		if err := c.generateGrafanaConfigFiles(); err != nil {
+			return err
+		}
+	}
+	if err := c.writeServiceRegistrationFiles(); err != nil {
+		return err
+	}
+
+	fmt.Println("==> Files")
+	if len(c.plan.files) == 0 {
+		fmt.Println("no changes")
+	}
+	for _, f := range c.plan.files {
+		fmt.Print(unifiedDiff(
+			f.Path,
+			f.Path+" (planned)",
+			string(f.Prev),
+			string(f.Next),
+			3,
+		))
+	}
+
+	fmt.Println()
+	fmt.Println("==> Containers")
+	changes, err := c.planContainerChanges()
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Println("no changes")
+	}
+	for _, ch := range changes {
+		if len(ch.Reasons) > 0 {
+			fmt.Printf("  %s %s: %s (%s)\n", ch.Symbol(), ch.Name, ch.Action, strings.Join(ch.Reasons, "; "))
+		} else {
+			fmt.Printf("  %s %s: %s\n", ch.Symbol(), ch.Name, ch.Action)
+		}
+	}
+
+	fmt.Println()
+	if err := c.printConsulPlan(); err != nil {
+		return err
+	}
+
+	if len(c.plan.notes) > 0 {
+		fmt.Println()
+		fmt.Println("==> Notes")
+		for _, note := range c.plan.notes {
+			fmt.Println("  * " + note)
+		}
+	}
+
+	return nil
+}
+
+const (
+	planCreate   = "create"
+	planUpdate   = "update"
+	planRecreate = "recreate"
+	planDelete   = "delete"
+)
+
+type plannedChange struct {
+	Name    string
+	Action  string
+	Reasons []string
+}
+
+func (ch *plannedChange) Symbol() string {
+	switch ch.Action {
+	case planCreate:
+		return "+"
+	case planDelete:
+		return "-"
+	default:
+		return "~"
+	}
+}
+
+var (
+	tfImageRefPatt   = regexp.MustCompile(`docker_image\.([^.\s]+)\.`)
+	tfNetworkRefPatt = regexp.MustCompile(`docker_container\.([^.\s]+)\.id`)
+)
+
+// planContainerChanges compares the container resources in the current and
+// planned docker.tf to explain which containers terraform would replace.
+func (c *Core) planContainerChanges() ([]*plannedChange, error) {
+	var prev, next []byte
+	if f := c.plan.file("docker.tf"); f != nil {
+		prev, next = f.Prev, f.Next
+	} else {
+		// Unchanged.
+		return nil, nil
+	}
+
+	oldRes, err := parseTFResources(prev)
+	if err != nil {
+		return nil, err
+	}
+	newRes, err := parseTFResources(next)
+	if err != nil {
+		return nil, err
+	}
+
+	changedImages := make(map[string]struct{})
+	for key, r := range newRes {
+		if r.Type != "docker_image" {
+			continue
+		}
+		if old, ok := oldRes[key]; ok && !old.Equal(r) {
+			changedImages[r.Name] = struct{}{}
+		}
+	}
+
+	changes := make(map[string]*plannedChange)
+	for key, r := range newRes {
+		if r.Type != "docker_container" {
+			continue
+		}
+		old, ok := oldRes[key]
+		if !ok {
+			changes[r.Name] = &plannedChange{Name: r.Name, Action: planCreate}
+			continue
+		}
+
+		var reasons []string
+		for _, attr := range r.ChangedFrom(old) {
+			switch attr {
+			case "command":
+				if c.topology.HasNode(r.Name) {
+					reasons = append(reasons, "agent config changed")
+				} else {
+					reasons = append(reasons, "command changed")
+				}
+			default:
+				reasons = append(reasons, attr+" changed")
+			}
+		}
+		if m := tfImageRefPatt.FindStringSubmatch(r.Attrs["image"]); m != nil {
+			if _, ok := changedImages[m[1]]; ok {
+				reasons = append(reasons, "image "+m[1]+" changed")
+			}
+		}
+		if len(reasons) > 0 {
+			changes[r.Name] = &plannedChange{Name: r.Name, Action: planRecreate, Reasons: reasons}
+		}
+	}
+	for key, r := range oldRes {
+		if r.Type != "docker_container" {
+			continue
+		}
+		if _, ok := newRes[key]; !ok {
+			changes[r.Name] = &plannedChange{Name: r.Name, Action: planDelete}
+		}
+	}
+
+	// Containers sharing the network namespace of a replaced pod get
+	// replaced along with it.
+	for key, r := range newRes {
+		if r.Type != "docker_container" {
+			continue
+		}
+		if _, ok := oldRes[key]; !ok {
+			continue
+		}
+		m := tfNetworkRefPatt.FindStringSubmatch(r.Attrs["network_mode"])
+		if m == nil {
+			continue
+		}
+		if pod, ok := changes[m[1]]; !ok || pod.Action != planRecreate {
+			continue
+		}
+		ch, ok := changes[r.Name]
+		if !ok {
+			ch = &plannedChange{Name: r.Name, Action: planRecreate}
+			changes[r.Name] = ch
+		}
+		ch.Reasons = append(ch.Reasons, "pod "+m[1]+" recreated")
+	}
+
+	out := make([]*plannedChange, 0, len(changes))
+	for _, ch := range changes {
+		out = append(out, ch)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+type tfResource struct {
+	Type   string
+	Name   string
+	Attrs  map[string]string // name -> expression
+	Blocks map[string]string // type -> all nested blocks of that type
+}
+
+func (r *tfResource) Equal(o *tfResource) bool {
+	return len(r.ChangedFrom(o)) == 0
+}
+
+// ChangedFrom returns the sorted names of attributes and nested block types
+// that differ between the two versions of the resource.
+func (r *tfResource) ChangedFrom(old *tfResource) []string {
+	changed := make(map[string]struct{})
+	diffMaps := func(a, b map[string]string) {
+		for k, v := range a {
+			if b[k] != v {
+				changed[k] = struct{}{}
+			}
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				changed[k] = struct{}{}
+			}
+		}
+	}
+	diffMaps(r.Attrs, old.Attrs)
+	diffMaps(r.Blocks, old.Blocks)
+
+	out := make([]string, 0, len(changed))
+	for k := range changed {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func parseTFResources(src []byte) (map[string]*tfResource, error) {
+	out := make(map[string]*tfResource)
+	if len(src) == 0 {
+		return out, nil
+	}
+
+	f, diags := hclwrite.ParseConfig(src, "docker.tf", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	for _, block := range f.Body().Blocks() {
+		labels := block.Labels()
+		if block.Type() != "resource" || len(labels) != 2 {
+			continue
+		}
+		r := &tfResource{
+			Type:   labels[0],
+			Name:   labels[1],
+			Attrs:  make(map[string]string),
+			Blocks: make(map[string]string),
+		}
+		for name, attr := range block.Body().Attributes() {
+			r.Attrs[name] = strings.TrimSpace(string(attr.Expr().BuildTokens(nil).Bytes()))
+		}
+		for _, nested := range block.Body().Blocks() {
+			r.Blocks[nested.Type()] += string(nested.BuildTokens(nil).Bytes())
+		}
+		out[r.Type+"."+r.Name] = r
+	}
+	return out, nil
+}
+
+// printConsulPlan reports what boot would do to config entries and ACL
+// objects in the running cluster.
+func (c *Core) printConsulPlan() error {
+	masterToken, err := c.cache.LoadValue("master-token")
+	if err != nil {
+		return err
+	}
+	if masterToken == "" {
+		c.plan.addNote("cluster has not been bootstrapped yet, so boot would create every config entry and ACL object")
+		return nil
+	}
+
+	client, err := consulfunc.GetClient(c.topology.LeaderIP(PrimaryDC, false), masterToken)
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.Status().Leader(); err != nil {
+		c.plan.addNote("could not reach the primary datacenter, so config entries and ACL objects were skipped: " + err.Error())
+		return nil
+	}
+
+	entryChanges, err := c.planConfigEntryChanges(client)
+	if err != nil {
+		return err
+	}
+	fmt.Println("==> Config entries")
+	printPlannedChanges(entryChanges)
+
+	aclChanges, err := c.planACLChanges(client)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	fmt.Println("==> ACL objects")
+	printPlannedChanges(aclChanges)
+
+	return nil
+}
+
+func printPlannedChanges(changes []*plannedChange) {
+	if len(changes) == 0 {
+		fmt.Println("no changes")
+	}
+	for _, ch := range changes {
+		fmt.Printf("  %s %s\n", ch.Symbol(), ch.Name)
+	}
+}
+
+func (c *Core) planConfigEntryChanges(client *api.Client) ([]*plannedChange, error) {
+	namespaced := c.config.EnterpriseEnabled
+
+	current, err := consulfunc.ListAllConfigEntries(client, knownConfigEntryKinds, namespaced)
+	if err != nil {
+		return nil, err
+	}
+
+	desired, err := c.desiredConfigEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*plannedChange
+	for _, entry := range desired {
+		ckn := consulfunc.NewConfigKindName(entry, namespaced)
+		name := ckn.String()
+
+		live, ok := current[ckn]
+		if !ok {
+			out = append(out, &plannedChange{Name: name, Action: planCreate})
+			continue
+		}
+		delete(current, ckn)
+
+		same, err := configEntrySubsetOf(entry, live)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			out = append(out, &plannedChange{Name: name, Action: planUpdate})
+		}
+	}
+	for ckn := range current {
+		out = append(out, &plannedChange{Name: ckn.String(), Action: planDelete})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// configEntrySubsetOf reports whether every field set in the desired entry
+// has the same value in the live one. Fields the servers fill in on their own
+// are therefore ignored.
+func configEntrySubsetOf(desired, live api.ConfigEntry) (bool, error) {
+	var d, l interface{}
+	if err := roundTripJSON(desired, &d); err != nil {
+		return false, err
+	}
+	if err := roundTripJSON(live, &l); err != nil {
+		return false, err
+	}
+	return jsonSubsetOf(d, l), nil
+}
+
+func roundTripJSON(in, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+func jsonSubsetOf(desired, live interface{}) bool {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return len(d) == 0 && live == nil
+		}
+		for k, v := range d {
+			if isZeroJSON(v) {
+				continue
+			}
+			if !jsonSubsetOf(v, l[k]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok {
+			return len(d) == 0 && live == nil
+		}
+		if len(d) != len(l) {
+			return false
+		}
+		for i := range d {
+			if !jsonSubsetOf(d[i], l[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(desired, live)
+	}
+}
+
+func isZeroJSON(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case string:
+		return x == ""
+	case float64:
+		return x == 0
+	case bool:
+		return !x
+	case map[string]interface{}:
+		return len(x) == 0
+	case []interface{}:
+		return len(x) == 0
+	}
+	return false
+}
+
+func (c *Core) planACLChanges(client *api.Client) ([]*plannedChange, error) {
+	var out []*plannedChange
+
+	currentPolicies, err := consulfunc.ListExistingPoliciesByName(client)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range c.desiredACLPolicies() {
+		name := "policy/" + p.Name
+		if _, ok := currentPolicies[p.Name]; !ok {
+			out = append(out, &plannedChange{Name: name, Action: planCreate})
+			continue
+		}
+		live, err := consulfunc.GetPolicyByName(client, p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if live == nil || !policyMatches(p, live) {
+			out = append(out, &plannedChange{Name: name, Action: planUpdate})
+		}
+	}
+
+	for _, r := range c.desiredACLRoles() {
+		live, err := consulfunc.GetRoleByName(client, r.Name)
+		if err != nil {
+			return nil, err
+		}
+		name := "role/" + r.Name
+		if live == nil {
+			out = append(out, &plannedChange{Name: name, Action: planCreate})
+		} else if !roleMatches(r, live) {
+			out = append(out, &plannedChange{Name: name, Action: planUpdate})
+		}
+	}
+
+	currentTokens, err := consulfunc.ListExistingTokenAccessorsByDescription(client)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range c.desiredACLTokens() {
+		name := "token/" + t.Description
+		accessorID := t.AccessorID
+		if accessorID == "" {
+			accessorID = currentTokens[t.Description]
+		}
+		if accessorID == "" {
+			out = append(out, &plannedChange{Name: name, Action: planCreate})
+			continue
+		}
+		live, _, err := client.ACL().TokenRead(accessorID, nil)
+		if err != nil {
+			return nil, err
+		}
+		if live == nil {
+			out = append(out, &plannedChange{Name: name, Action: planCreate})
+			continue
+		}
+
+		switch {
+		case t.SecretID != "" && live.SecretID != t.SecretID && strings.HasPrefix(t.Description, declaredTokenPrefix):
+			out = append(out, &plannedChange{Name: name, Action: planRecreate, Reasons: []string{"secret_id changed"}})
+		case t.SecretID != "" && live.SecretID != t.SecretID:
+			out = append(out, &plannedChange{Name: name, Action: planUpdate, Reasons: []string{
+				"secret_id differs from the preset one; boot fails until 'devconsul down'",
+			}})
+		case !tokenMatches(t, live):
+			out = append(out, &plannedChange{Name: name, Action: planUpdate})
+		}
+	}
+
+	stale, err := c.findStaleDeclaredACLs(client)
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range sortedKeys(stale.Tokens) {
+		out = append(out, &plannedChange{Name: "token/" + desc, Action: planDelete})
+	}
+	for _, name := range sortedKeys(stale.Roles) {
+		out = append(out, &plannedChange{Name: "role/" + name, Action: planDelete})
+	}
+	for _, name := range sortedKeys(stale.Policies) {
+		out = append(out, &plannedChange{Name: "policy/" + name, Action: planDelete})
+	}
+	for _, name := range sortedKeys(legacyAgentPolicies(currentPolicies)) {
+		out = append(out, &plannedChange{Name: "policy/" + name, Action: planDelete})
+	}
+
+	return out, nil
+}
+
+// policyMatches reports whether the live policy is already what boot would
+// write.
+func policyMatches(desired, live *api.ACLPolicy) bool {
+	return desired.Rules == live.Rules &&
+		desired.Description == live.Description &&
+		sameStrings(desired.Datacenters, live.Datacenters)
+}
+
+// tokenMatches reports whether the live token already links what the desired
+// one does. Links are compared by name, since boot links them by name.
+func tokenMatches(desired, live *api.ACLToken) bool {
+	if desired.Local != live.Local {
+		return false
+	}
+
+	var desiredNames, liveNames []string
+	for _, l := range desired.Policies {
+		desiredNames = append(desiredNames, l.Name)
+	}
+	for _, l := range live.Policies {
+		liveNames = append(liveNames, l.Name)
+	}
+	if !sameStrings(desiredNames, liveNames) {
+		return false
+	}
+
+	desiredNames, liveNames = nil, nil
+	for _, l := range desired.Roles {
+		desiredNames = append(desiredNames, l.Name)
+	}
+	for _, l := range live.Roles {
+		liveNames = append(liveNames, l.Name)
+	}
+	if !sameStrings(desiredNames, liveNames) {
+		return false
+	}
+
+	if len(desired.ServiceIdentities) != len(live.ServiceIdentities) {
+		return false
+	}
+	for i, si := range desired.ServiceIdentities {
+		ls := live.ServiceIdentities[i]
+		if si.ServiceName != ls.ServiceName || !sameStrings(si.Datacenters, ls.Datacenters) {
+			return false
+		}
+	}
+
+	if len(desired.NodeIdentities) != len(live.NodeIdentities) {
+		return false
+	}
+	for i, ni := range desired.NodeIdentities {
+		if *ni != *live.NodeIdentities[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameStrings compares a and b ignoring order, with nil and empty equal.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
+
+// roleMatches reports whether the live role already grants what the desired
+// one does. Policies are linked by name when desired, and come back with both
+// an ID and a name.
+func roleMatches(desired, live *api.ACLRole) bool {
+	if desired.Description != live.Description {
+		return false
+	}
+
+	policyNames := func(links []*api.ACLRolePolicyLink) []string {
+		var out []string
+		for _, l := range links {
+			out = append(out, l.Name)
+		}
+		sort.Strings(out)
+		return out
+	}
+	if !reflect.DeepEqual(policyNames(desired.Policies), policyNames(live.Policies)) {
+		return false
+	}
+
+	if len(desired.ServiceIdentities) != len(live.ServiceIdentities) {
+		return false
+	}
+	for i, si := range desired.ServiceIdentities {
+		if si.ServiceName != live.ServiceIdentities[i].ServiceName {
+			return false
+		}
+	}
+
+	if len(desired.NodeIdentities) != len(live.NodeIdentities) {
+		return false
+	}
+	for i, ni := range desired.NodeIdentities {
+		if *ni != *live.NodeIdentities[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/rboyer/devconsul/cachestore"
+	"github.com/rboyer/devconsul/consulfunc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoleMatches(t *testing.T) {
+	node := &Node{Name: "dc2-client1", Datacenter: "dc2"}
+
+	live := agentRole(node)
+	live.ID = "abc"
+	require.True(t, roleMatches(agentRole(node), live))
+
+	live.NodeIdentities[0].Datacenter = "dc1"
+	require.False(t, roleMatches(agentRole(node), live))
+
+	desired := meshGatewayRole()
+	require.True(t, roleMatches(desired, &api.ACLRole{
+		ID:          "def",
+		Name:        meshGatewayName,
+		Description: meshGatewayName,
+		Policies:    []*api.ACLRolePolicyLink{{ID: "123", Name: meshGatewayName}},
+	}))
+	require.False(t, roleMatches(desired, &api.ACLRole{
+		Name:        meshGatewayName,
+		Description: meshGatewayName,
+	}))
+}
+
+func TestTokenMatches(t *testing.T) {
+	desired := meshGatewayToken()
+	require.True(t, tokenMatches(desired, &api.ACLToken{
+		AccessorID:  "abc",
+		SecretID:    "def",
+		Description: meshGatewayName,
+		Roles:       []*api.ACLTokenRoleLink{{ID: "123", Name: meshGatewayName}},
+	}))
+	require.False(t, tokenMatches(desired, &api.ACLToken{
+		Description: meshGatewayName,
+		Roles:       []*api.ACLTokenRoleLink{{ID: "123", Name: "other"}},
+	}))
+	require.False(t, tokenMatches(desired, &api.ACLToken{
+		Description: meshGatewayName,
+		Roles:       []*api.ACLTokenRoleLink{{ID: "123", Name: meshGatewayName}},
+		Policies:    []*api.ACLTokenPolicyLink{{ID: "456", Name: "extra"}},
+	}))
+
+	svc := serviceToken(&Service{Name: "ping"})
+	live := serviceToken(&Service{Name: "ping"})
+	require.True(t, tokenMatches(svc, live))
+	live.ServiceIdentities[0].Datacenters = []string{"dc2"}
+	require.False(t, tokenMatches(svc, live))
+}
+
+func TestPolicyMatches(t *testing.T) {
+	desired := &api.ACLPolicy{Name: "p", Rules: "x", Datacenters: []string{"dc1", "dc2"}}
+	require.True(t, policyMatches(desired, &api.ACLPolicy{ID: "1", Name: "p", Rules: "x", Datacenters: []string{"dc2", "dc1"}}))
+	require.False(t, policyMatches(desired, &api.ACLPolicy{ID: "1", Name: "p", Rules: "x"}))
+	require.True(t, policyMatches(&api.ACLPolicy{Name: "p"}, &api.ACLPolicy{Name: "p", Datacenters: []string{}}))
+}
+
+func TestLegacyAgentPolicies(t *testing.T) {
+	got := legacyAgentPolicies(map[string]string{
+		"agent--dc1-server1": "1",
+		"mesh-gateway":       "2",
+		"anonymous":          "3",
+	})
+	require.Equal(t, map[string]string{"agent--dc1-server1": "1"}, got)
+}
+
+func TestConfigEntryDeletionOrder(t *testing.T) {
+	require.ElementsMatch(t, knownConfigEntryKinds, configEntryDeletionOrder)
+}
+
+func TestNewConfigKindName(t *testing.T) {
+	entry := &api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "ping"}
+
+	ckn := consulfunc.NewConfigKindName(entry, false)
+	require.Equal(t, "service-defaults/ping", ckn.String())
+	require.Nil(t, ckn.WriteOptions())
+
+	ckn = consulfunc.NewConfigKindName(entry, true)
+	require.Equal(t, "service-defaults/default/ping", ckn.String())
+
+	entry.Namespace = "foo"
+	ckn = consulfunc.NewConfigKindName(entry, true)
+	require.Equal(t, "service-defaults/foo/ping", ckn.String())
+	require.Equal(t, "foo", ckn.WriteOptions().Namespace)
+}
+
+func TestPlanDoesNotWriteCache(t *testing.T) {
+	cfg, topo, err := parseConfig([]byte(`
+		security {
+			encryption {
+				tls    = true
+				gossip = true
+			}
+		}
+	`))
+	require.NoError(t, err)
+
+	rootDir, err := ioutil.TempDir("", "devconsul-plan")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootDir)
+
+	cacheDir := filepath.Join(rootDir, "cache")
+	c := &Core{
+		rootDir:  rootDir,
+		cache:    cachestore.OpenReadOnly(cacheDir),
+		config:   cfg,
+		topology: topo,
+		plan:     &planRecorder{},
+	}
+
+	require.NoError(t, c.initTLS())
+	require.NoError(t, c.initGossipKey())
+	require.NoError(t, c.initAgentMasterToken())
+	require.NoError(t, c.delCacheValue("vault-root-token"))
+
+	require.NotEmpty(t, c.config.GossipKey)
+	require.NotEmpty(t, c.config.AgentMasterToken)
+	require.Equal(t, []string{
+		"a new cluster CA and agent certificates would be created in cache/tls",
+		"cache/gossip-key.val would be generated",
+		"cache/agent-master-token.val would be generated",
+	}, c.plan.notes)
+
+	_, err = os.Stat(cacheDir)
+	require.True(t, os.IsNotExist(err), "cache dir should not be created")
+}
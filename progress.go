@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// bootProgress tracks what boot is doing so it can periodically say so. A
+// nil *bootProgress is valid and tracks nothing.
+type bootProgress struct {
+	mu           sync.Mutex
+	started      time.Time
+	phase        string
+	phaseStarted time.Time
+	pending      map[string]int // what -> number of waiters
+}
+
+func newBootProgress() *bootProgress {
+	now := time.Now()
+	return &bootProgress{
+		started:      now,
+		phaseStarted: now,
+		pending:      make(map[string]int),
+	}
+}
+
+func (p *bootProgress) setPhase(phase string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase = phase
+	p.phaseStarted = time.Now()
+}
+
+// waiting marks what as outstanding until the returned func is called.
+func (p *bootProgress) waiting(what string) func() {
+	if p == nil {
+		return func() {}
+	}
+	p.mu.Lock()
+	p.pending[what]++
+	p.mu.Unlock()
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.pending[what]--; p.pending[what] <= 0 {
+			delete(p.pending, what)
+		}
+	}
+}
+
+// outstanding returns everything still being waited on, sorted.
+func (p *bootProgress) outstanding() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]string, 0, len(p.pending))
+	for what := range p.pending {
+		out = append(out, what)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (p *bootProgress) report(logger hclog.Logger) {
+	p.mu.Lock()
+	phase := p.phase
+	phaseElapsed := time.Since(p.phaseStarted).Round(time.Second)
+	elapsed := time.Since(p.started).Round(time.Second)
+	p.mu.Unlock()
+
+	args := []interface{}{
+		"phase", phase,
+		"phase_elapsed", phaseElapsed,
+		"elapsed", elapsed,
+	}
+	if waiting := p.outstanding(); len(waiting) > 0 {
+		args = append(args, "waiting_on", strings.Join(waiting, ", "))
+	}
+	logger.Info("boot progress", args...)
+}
+
+// reportEvery logs progress every interval until ctx is done or the
+// returned func is called.
+func (p *bootProgress) reportEvery(ctx context.Context, logger hclog.Logger, interval time.Duration) func() {
+	stopCh := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				p.report(logger)
+			}
+		}
+	}()
+	return func() { close(stopCh) }
+}
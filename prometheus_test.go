@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusAddresses(t *testing.T) {
+	body := `
+		monitor {
+			prometheus = true
+		}
+		security {
+			encryption {
+				tls = true
+			}
+		}
+		topology {
+			network_shape = "islands"
+			datacenter "dc1" {
+				servers       = 1
+				clients       = 2
+				mesh_gateways = 1
+			}
+			datacenter "dc2" {
+				servers       = 1
+				clients       = 2
+				mesh_gateways = 1
+			}
+		}
+	`
+	cfg, topo, err := parseConfig([]byte(body))
+	require.NoError(t, err)
+
+	c := &Core{config: cfg, topology: topo}
+
+	require.Equal(t, []Address{
+		{Network: "dc1", IPAddress: "10.0.1.250"},
+		{Network: "dc2", IPAddress: "10.0.2.250"},
+	}, c.prometheusAddresses())
+
+	require.Equal(t, "10.0.1.250", c.prometheusIP(topo.Node("dc1-server1")))
+	require.Equal(t, "10.0.2.250", c.prometheusIP(topo.Node("dc2-client2")))
+
+	res, err := stringTemplate(tfPrometheusT, c.prometheusAddresses())
+	require.NoError(t, err)
+	require.Contains(t, res, "docker_network.devconsul-dc1.name")
+	require.Contains(t, res, "docker_network.devconsul-dc2.name")
+	require.NotContains(t, res, "devconsul-lan")
+}
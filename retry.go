@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+const (
+	retryMinWait = 250 * time.Millisecond
+	retryMaxWait = 5 * time.Second
+
+	// defaultBootTimeout is how long boot may take unless -timeout says
+	// otherwise.
+	defaultBootTimeout = 15 * time.Minute
+)
+
+// retryWithBackoff calls f until it reports done, sleeping in between for
+// exponentially longer, up to max. Errors from f end the retries right away.
+// It gives up when ctx is done.
+func retryWithBackoff(ctx context.Context, min, max time.Duration, f func() (bool, error)) error {
+	wait := min
+	for {
+		done, err := f()
+		if err != nil {
+			return err
+		} else if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		wait *= 2
+		if wait > max {
+			wait = max
+		}
+	}
+}
+
+// retryUntil is retryWithBackoff for boot. While it waits, what is listed
+// as outstanding in the progress reports.
+func (c *Core) retryUntil(what string, f func() (bool, error)) error {
+	defer c.progress.waiting(what)()
+
+	return retryFor(c.bootContext(), what, f)
+}
+
+// retryFor is retryWithBackoff with the context errors spelled out in terms
+// of what it was waiting for.
+func retryFor(ctx context.Context, what string, f func() (bool, error)) error {
+	err := retryWithBackoff(ctx, retryMinWait, retryMaxWait, f)
+	switch {
+	case err == nil:
+		return nil
+	case err == context.DeadlineExceeded:
+		return fmt.Errorf("timed out waiting for %s", what)
+	case err == context.Canceled:
+		return fmt.Errorf("interrupted while waiting for %s", what)
+	default:
+		return err
+	}
+}
+
+func (c *Core) bootContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// startBoot sets up the context that every boot wait loop runs under.
+func (c *Core) startBoot() func() {
+	ctx, stop := c.interruptibleContext("boot", c.bootTimeout)
+
+	c.ctx = ctx
+	c.progress = newBootProgress()
+	stopProgress := c.progress.reportEvery(ctx, c.logger, 10*time.Second)
+
+	return func() {
+		stopProgress()
+		stop()
+	}
+}
+
+// interruptibleContext returns a context that ends after timeout (unless it
+// is 0) or on the first Ctrl-C; a second Ctrl-C exits without waiting for
+// anything to wind down.
+func (c *Core) interruptibleContext(what string, timeout time.Duration) (context.Context, func()) {
+	ctx := context.Background()
+	cancelTimeout := func() {}
+	if timeout > 0 {
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		select {
+		case _, ok := <-sigCh:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		c.logger.Warn("interrupted; stopping " + what + " (press Ctrl-C again to exit immediately)")
+		cancel()
+		if _, ok := <-sigCh; ok {
+			os.Exit(1)
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigCh)
+		close(sigCh)
+		cancel()
+		cancelTimeout()
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryWithBackoff(t *testing.T) {
+	ctx := context.Background()
+
+	var calls int
+	err := retryWithBackoff(ctx, time.Millisecond, 4*time.Millisecond, func() (bool, error) {
+		calls++
+		return calls == 5, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 5, calls)
+
+	boom := errors.New("boom")
+	calls = 0
+	err = retryWithBackoff(ctx, time.Millisecond, time.Millisecond, func() (bool, error) {
+		calls++
+		return false, boom
+	})
+	require.Equal(t, boom, err)
+	require.Equal(t, 1, calls)
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	err = retryWithBackoff(ctx, time.Millisecond, 5*time.Millisecond, func() (bool, error) {
+		return false, nil
+	})
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestRetryUntil_Progress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Core{}
+	c.ctx = ctx
+	c.progress = newBootProgress()
+
+	started := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.retryUntil("leader in dc2", func() (bool, error) {
+			select {
+			case <-started:
+			default:
+				close(started)
+			}
+			return false, nil
+		})
+	}()
+
+	<-started
+	require.Equal(t, []string{"leader in dc2"}, c.progress.outstanding())
+
+	cancel()
+	err := <-errCh
+	require.EqualError(t, err, "interrupted while waiting for leader in dc2")
+	require.Empty(t, c.progress.outstanding())
+}
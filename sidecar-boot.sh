@@ -25,10 +25,14 @@ done
 api_args=()
 agent_tls=""
 service_register_file=""
+redirect_proxy_id=""
+redirect_dns_ip=""
+redirect_exclude_uid=""
+redirect_exclude_inbound=""
 case "${mode}" in
     direct)
         token_file=""
-        while getopts ":t:r:e" opt; do
+        while getopts ":t:r:eT:D:X:I:" opt; do
             case "${opt}" in
                 e)
                     agent_tls=1
@@ -39,6 +43,18 @@ case "${mode}" in
                 r)
                     service_register_file="$OPTARG"
                     ;;
+                T)
+                    redirect_proxy_id="$OPTARG"
+                    ;;
+                D)
+                    redirect_dns_ip="$OPTARG"
+                    ;;
+                X)
+                    redirect_exclude_uid="$OPTARG"
+                    ;;
+                I)
+                    redirect_exclude_inbound="$OPTARG"
+                    ;;
                 \?)
                     echo "invalid option: -$OPTARG" >&2
                     exit 1
@@ -66,7 +82,7 @@ case "${mode}" in
     login)
         bearer_token_file=""
         token_sink_file=""
-        while getopts ":t:s:r:e" opt; do
+        while getopts ":t:s:r:eT:D:X:I:" opt; do
             case "${opt}" in
                 e)
                     agent_tls=1
@@ -80,6 +96,18 @@ case "${mode}" in
                 r)
                     service_register_file="$OPTARG"
                     ;;
+                T)
+                    redirect_proxy_id="$OPTARG"
+                    ;;
+                D)
+                    redirect_dns_ip="$OPTARG"
+                    ;;
+                X)
+                    redirect_exclude_uid="$OPTARG"
+                    ;;
+                I)
+                    redirect_exclude_inbound="$OPTARG"
+                    ;;
                 \?)
                     echo "invalid option: -$OPTARG" >&2
                     exit 1
@@ -147,6 +175,33 @@ done
 echo "Registering service..."
 consul services register "${api_args[@]}" "${service_register_file}"
 
+if [[ -n "${redirect_proxy_id}" ]]; then
+    redirect_args=(
+        -proxy-id "${redirect_proxy_id}"
+        -proxy-uid "$(id -u)"
+    )
+    if [[ -n "${redirect_dns_ip}" ]]; then
+        redirect_args+=( -consul-dns-ip "${redirect_dns_ip}" -consul-dns-port 8600 )
+    fi
+    if [[ -n "${redirect_exclude_uid}" ]]; then
+        redirect_args+=( -exclude-uid "${redirect_exclude_uid}" )
+    fi
+    if [[ -n "${redirect_exclude_inbound}" ]]; then
+        IFS=, read -r -a ports <<< "${redirect_exclude_inbound}"
+        for port in "${ports[@]}"; do
+            redirect_args+=( -exclude-inbound-port "${port}" )
+        done
+    fi
+
+    # The rules outlive this container, so a restart finds them in place.
+    if iptables -t nat -L CONSUL_PROXY_OUTPUT &> /dev/null ; then
+        echo "Traffic is already redirected"
+    else
+        echo "Redirecting traffic through ${redirect_proxy_id}..."
+        consul connect redirect-traffic "${api_args[@]}" "${redirect_args[@]}"
+    fi
+fi
+
 echo "Launching proxy..."
 case "${proxy_type}" in
     envoy)
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/rboyer/devconsul/consulfunc"
+	"github.com/rboyer/safeio"
+	"golang.org/x/crypto/blake2b"
+)
+
+const snapshotsDir = "cache/snapshots"
+
+var snapshotNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+type snapshotMeta struct {
+	Name         string    `json:"name"`
+	Created      time.Time `json:"created"`
+	ConsulImage  string    `json:"consul_image"`
+	TopologyHash string    `json:"topology_hash"`
+	Datacenters  []string  `json:"datacenters"`
+
+	// Values are the cache values holding secrets that live in the
+	// snapshotted state. They are put back along with the snapshot.
+	Values map[string]string `json:"values"`
+
+	// Pinned are the cache values baked into the agent configs. They cannot
+	// be put back, so the cluster being restored onto must already use them.
+	Pinned map[string]string `json:"pinned,omitempty"`
+}
+
+// snapshotCacheValue reports whether a cache value goes with a snapshot, and
+// whether it is pinned.
+func snapshotCacheValue(name string) (keep, pinned bool) {
+	switch {
+	case name == "master-token", name == "mesh-gateway", strings.HasPrefix(name, "service-token--"):
+		return true, false
+	case name == "vault-root-token", name == "vault-connect-token":
+		return true, true
+	}
+	return false, false
+}
+
+// topologyHash identifies the shape of the topology. Snapshots only restore
+// onto a cluster with the same one.
+func topologyHash(t *Topology) (string, error) {
+	type nodeSummary struct {
+		Datacenter  string
+		Name        string
+		Server      bool
+		MeshGateway bool
+		Service     string
+		Namespace   string
+		Addresses   []Address
+	}
+
+	var nodes []nodeSummary
+	for _, n := range t.Nodes() {
+		ns := nodeSummary{
+			Datacenter:  n.Datacenter,
+			Name:        n.Name,
+			Server:      n.Server,
+			MeshGateway: n.MeshGateway,
+			Addresses:   n.Addresses,
+		}
+		if n.Service != nil {
+			ns.Service = n.Service.Name
+			ns.Namespace = n.Service.Namespace
+		}
+		nodes = append(nodes, ns)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+
+	b, err := json.Marshal(nodes)
+	if err != nil {
+		return "", err
+	}
+	sum := blake2b.Sum256(b)
+	return fmt.Sprintf("%x", sum[:]), nil
+}
+
+func (c *Core) RunSnapshot() error {
+	args := flag.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("Missing required snapshot subcommand: [save, restore, list]")
+	}
+
+	switch args[0] {
+	case "save":
+		return c.runSnapshotSave(args[1:])
+	case "restore":
+		return c.runSnapshotRestore(args[1:])
+	case "list":
+		return c.runSnapshotList()
+	default:
+		return fmt.Errorf("unknown snapshot subcommand: %s", args[0])
+	}
+}
+
+func snapshotNameArg(cmd string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: %s snapshot %s <name>", programName, cmd)
+	}
+	name := args[0]
+	if !snapshotNameRE.MatchString(name) {
+		return "", fmt.Errorf("invalid snapshot name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	return name, nil
+}
+
+func (c *Core) snapshotClients(masterToken string) (map[string]*api.Client, error) {
+	clients := make(map[string]*api.Client)
+	for _, dc := range c.topology.Datacenters() {
+		client, err := consulfunc.GetClient(c.topology.LeaderIP(dc.Name, false), masterToken)
+		if err != nil {
+			return nil, err
+		}
+		clients[dc.Name] = client
+	}
+	return clients, nil
+}
+
+func (c *Core) runSnapshotSave(args []string) (xerr error) {
+	name, err := snapshotNameArg("save", args)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(snapshotsDir, name)
+	if ok, err := fileExists(dir); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("snapshot %q already exists; remove %s first", name, dir)
+	}
+
+	masterToken, err := c.cache.LoadValue("master-token")
+	if err != nil {
+		return err
+	}
+	if masterToken == "" {
+		return fmt.Errorf("cluster has not been booted yet; run '%s up' first", programName)
+	}
+
+	hash, err := topologyHash(c.topology)
+	if err != nil {
+		return err
+	}
+
+	meta := &snapshotMeta{
+		Name:         name,
+		Created:      time.Now().UTC(),
+		ConsulImage:  c.config.ConsulImage,
+		TopologyHash: hash,
+		Values:       make(map[string]string),
+		Pinned:       make(map[string]string),
+	}
+
+	files, err := filepath.Glob("cache/*.val")
+	if err != nil {
+		return err
+	}
+	for _, fn := range files {
+		key := strings.TrimSuffix(filepath.Base(fn), ".val")
+		keep, pinned := snapshotCacheValue(key)
+		if !keep {
+			continue
+		}
+		val, err := c.cache.LoadValue(key)
+		if err != nil {
+			return err
+		}
+		if pinned {
+			meta.Pinned[key] = val
+		} else {
+			meta.Values[key] = val
+		}
+	}
+
+	clients, err := c.snapshotClients(masterToken)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if xerr != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	for _, dc := range c.topology.Datacenters() {
+		rc, _, err := clients[dc.Name].Snapshot().Save(nil)
+		if err != nil {
+			return fmt.Errorf("could not save snapshot of %s: %v", dc.Name, err)
+		}
+		_, err = safeio.WriteToFile(rc, filepath.Join(dir, dc.Name+".snap"), 0644)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		meta.Datacenters = append(meta.Datacenters, dc.Name)
+		c.logger.Info("saved snapshot", "dc", dc.Name, "name", name)
+	}
+
+	b, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = safeio.WriteToFile(strings.NewReader(string(b)), filepath.Join(dir, "meta.json"), 0644)
+	return err
+}
+
+func loadSnapshotMeta(name string) (*snapshotMeta, error) {
+	b, err := ioutil.ReadFile(filepath.Join(snapshotsDir, name, "meta.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no snapshot named %q", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var meta snapshotMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("could not decode snapshot %q: %v", name, err)
+	}
+	return &meta, nil
+}
+
+// checkSnapshotRestorable makes sure a snapshot fits the cluster it is about
+// to be restored onto.
+func (c *Core) checkSnapshotRestorable(meta *snapshotMeta) error {
+	hash, err := topologyHash(c.topology)
+	if err != nil {
+		return err
+	}
+	if meta.TopologyHash != hash {
+		return fmt.Errorf("snapshot %q was taken of a different topology", meta.Name)
+	}
+
+	var dcs []string
+	for _, dc := range c.topology.Datacenters() {
+		dcs = append(dcs, dc.Name)
+	}
+	sort.Strings(dcs)
+	have := append([]string(nil), meta.Datacenters...)
+	sort.Strings(have)
+	if strings.Join(dcs, ",") != strings.Join(have, ",") {
+		return fmt.Errorf("snapshot %q has datacenters [%s], not [%s]",
+			meta.Name, strings.Join(have, ", "), strings.Join(dcs, ", "))
+	}
+
+	var keys []string
+	for key := range meta.Pinned {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		val, err := c.cache.LoadValue(key)
+		if err != nil {
+			return err
+		}
+		if val != meta.Pinned[key] {
+			return fmt.Errorf("snapshot %q was taken with a different cache/%s.val, which is baked into the agent configs", meta.Name, key)
+		}
+	}
+	return nil
+}
+
+func (c *Core) runSnapshotRestore(args []string) error {
+	name, err := snapshotNameArg("restore", args)
+	if err != nil {
+		return err
+	}
+
+	meta, err := loadSnapshotMeta(name)
+	if err != nil {
+		return err
+	}
+	if err := c.checkSnapshotRestorable(meta); err != nil {
+		return err
+	}
+	if meta.ConsulImage != c.config.ConsulImage {
+		c.logger.Warn("snapshot was taken with a different consul image",
+			"snapshot", meta.ConsulImage,
+			"current", c.config.ConsulImage,
+		)
+	}
+
+	masterToken, err := c.cache.LoadValue("master-token")
+	if err != nil {
+		return err
+	}
+	if masterToken == "" {
+		return fmt.Errorf("cluster has not been booted yet; run '%s up' first", programName)
+	}
+
+	clients, err := c.snapshotClients(masterToken)
+	if err != nil {
+		return err
+	}
+
+	// The secondaries go first, since the current master token stops working
+	// everywhere once the primary is restored and replicates.
+	dcs := c.topology.Datacenters()
+	sort.SliceStable(dcs, func(i, j int) bool {
+		return !dcs[i].Primary && dcs[j].Primary
+	})
+	for _, dc := range dcs {
+		f, err := os.Open(filepath.Join(snapshotsDir, name, dc.Name+".snap"))
+		if err != nil {
+			return err
+		}
+		err = clients[dc.Name].Snapshot().Restore(nil, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not restore snapshot of %s: %v", dc.Name, err)
+		}
+		c.logger.Info("restored snapshot", "dc", dc.Name, "name", name)
+	}
+
+	for key, val := range meta.Values {
+		if err := c.cache.SaveValue(key, val); err != nil {
+			return err
+		}
+	}
+
+	if err := c.replacePresetAgentTokens(); err != nil {
+		return err
+	}
+
+	// Boot again to hand the agents the tokens that are in the restored
+	// state, then restart the proxies so they read their restored tokens.
+	if err := c.runBoot(false); err != nil {
+		return err
+	}
+	return c.restartProxies()
+}
+
+// replacePresetAgentTokens deletes restored agent tokens whose secret is
+// not the one baked into the agent config, so boot mints the right one.
+func (c *Core) replacePresetAgentTokens() error {
+	if len(c.config.PresetAgentTokens) == 0 {
+		return nil
+	}
+
+	masterToken, err := c.cache.LoadValue("master-token")
+	if err != nil {
+		return err
+	}
+	client, err := consulfunc.GetClient(c.topology.LeaderIP(PrimaryDC, false), masterToken)
+	if err != nil {
+		return err
+	}
+
+	for nodeName, preset := range c.config.PresetAgentTokens {
+		node := c.topology.Node(nodeName)
+		if node == nil {
+			continue
+		}
+		token, err := consulfunc.GetTokenByDescription(client, node.TokenName())
+		if err != nil {
+			return err
+		}
+		if token == nil || token.SecretID == preset {
+			continue
+		}
+		if _, err := client.ACL().TokenDelete(token.AccessorID, nil); err != nil {
+			return err
+		}
+		c.logger.Info("replaced restored agent token", "node", nodeName)
+	}
+	return nil
+}
+
+func (c *Core) restartProxies() error {
+	sources, err := c.listLogSources()
+	if err != nil {
+		return err
+	}
+
+	args := []string{"restart"}
+	for _, src := range sources {
+		if src.Type == "sidecar" || src.Type == "gateway" {
+			args = append(args, src.ID)
+			c.logger.Info("restarting container", "name", src.Name)
+		}
+	}
+	if len(args) == 1 {
+		return nil
+	}
+	return c.dockerExec(args, ioutil.Discard)
+}
+
+func (c *Core) runSnapshotList() error {
+	entries, err := ioutil.ReadDir(snapshotsDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	hash, err := topologyHash(c.topology)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCREATED\tCONSUL IMAGE\tDATACENTERS\tTOPOLOGY")
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		meta, err := loadSnapshotMeta(e.Name())
+		if err != nil {
+			return err
+		}
+		topology := "same"
+		if meta.TopologyHash != hash {
+			topology = "different"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			meta.Name,
+			meta.Created.Local().Format(time.RFC3339),
+			meta.ConsulImage,
+			strings.Join(meta.Datacenters, ","),
+			topology,
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rboyer/devconsul/cachestore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSnapshotRestorable(t *testing.T) {
+	config, topology, err := parseConfig([]byte(`
+		topology {
+			datacenter "dc1" {}
+			datacenter "dc2" {
+				servers = 1
+				clients = 1
+			}
+		}
+	`))
+	require.NoError(t, err)
+
+	cacheDir, err := ioutil.TempDir("", "devconsul-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := cachestore.New(cacheDir)
+	require.NoError(t, err)
+
+	c := &Core{config: config, topology: topology, cache: cache}
+
+	hash, err := topologyHash(topology)
+	require.NoError(t, err)
+
+	meta := &snapshotMeta{
+		Name:         "before-upgrade",
+		TopologyHash: hash,
+		Datacenters:  []string{"dc2", "dc1"},
+	}
+	require.NoError(t, c.checkSnapshotRestorable(meta))
+
+	meta.Pinned = map[string]string{"vault-connect-token": "abc"}
+	require.EqualError(t, c.checkSnapshotRestorable(meta),
+		`snapshot "before-upgrade" was taken with a different cache/vault-connect-token.val, which is baked into the agent configs`)
+	require.NoError(t, cache.SaveValue("vault-connect-token", "abc"))
+	require.NoError(t, c.checkSnapshotRestorable(meta))
+
+	meta.Datacenters = []string{"dc1"}
+	require.EqualError(t, c.checkSnapshotRestorable(meta),
+		`snapshot "before-upgrade" has datacenters [dc1], not [dc1, dc2]`)
+
+	_, other, err := parseConfig([]byte(`
+		topology {
+			datacenter "dc1" {
+				clients = 3
+			}
+			datacenter "dc2" {
+				servers = 1
+				clients = 1
+			}
+		}
+	`))
+	require.NoError(t, err)
+	meta.TopologyHash, err = topologyHash(other)
+	require.NoError(t, err)
+	require.EqualError(t, c.checkSnapshotRestorable(meta),
+		`snapshot "before-upgrade" was taken of a different topology`)
+}
+
+func TestSnapshotCacheValue(t *testing.T) {
+	for name, expect := range map[string][2]bool{
+		"master-token":        {true, false},
+		"mesh-gateway":        {true, false},
+		"service-token--ping": {true, false},
+		"vault-connect-token": {true, true},
+		"agent-token--dc1-a":  {false, false},
+		"agent-master-token":  {false, false},
+		"gossip-key":          {false, false},
+		"ready":               {false, false},
+	} {
+		keep, pinned := snapshotCacheValue(name)
+		require.Equal(t, expect, [2]bool{keep, pinned}, name)
+	}
+}
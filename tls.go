@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	tlsCAFile    = "consul-agent-ca.pem"
+	tlsCAKeyFile = "consul-agent-ca-key.pem"
+)
+
+type tlsOptions struct {
+	CAValidity   time.Duration
+	CertValidity time.Duration
+	KeyType      string
+	KeyBits      int
+	ExtraSANs    []string
+}
+
+func (c *Core) tlsOptions() *tlsOptions {
+	return &tlsOptions{
+		CAValidity:   c.config.TLSCAValidity,
+		CertValidity: c.config.TLSCertValidity,
+		KeyType:      c.config.TLSKeyType,
+		KeyBits:      c.config.TLSKeyBits,
+		ExtraSANs:    c.config.TLSExtraSANs,
+	}
+}
+
+// agentCertRequest describes a single agent's certificate. The resulting
+// files are named the same way 'consul tls cert create' would name them.
+type agentCertRequest struct {
+	Datacenter string
+	NodeName   string
+	Server     bool
+	Index      int
+	IPs        []string
+}
+
+func (r *agentCertRequest) role() string {
+	if r.Server {
+		return "server"
+	}
+	return "client"
+}
+
+func (r *agentCertRequest) FilePrefix() string {
+	return fmt.Sprintf("%s-%s-consul-%d", r.Datacenter, r.role(), r.Index)
+}
+
+func (r *agentCertRequest) sans(opts *tlsOptions) ([]string, []net.IP) {
+	dnsNames := []string{
+		r.role() + "." + r.Datacenter + ".consul",
+		r.NodeName + "." + r.role() + "." + r.Datacenter + ".consul",
+		"localhost",
+	}
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+	for _, ip := range r.IPs {
+		ips = append(ips, net.ParseIP(ip))
+	}
+
+	for _, san := range opts.ExtraSANs {
+		if ip := net.ParseIP(san); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, san)
+		}
+	}
+	return dnsNames, ips
+}
+
+func (c *Core) initTLS() error {
+	tlsDir := filepath.Join(c.rootDir, "cache", "tls")
+	if c.plan == nil {
+		if err := os.MkdirAll(tlsDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	opts := c.tlsOptions()
+
+	if exists, err := filesExist(tlsDir, tlsCAKeyFile, tlsCAFile); err != nil {
+		return err
+	} else if !exists {
+		if c.plan != nil {
+			c.plan.addNote("a new cluster CA and agent certificates would be created in cache/tls")
+			return nil
+		}
+		certPEM, keyPEM, err := generateTLSCA(opts, time.Now())
+		if err != nil {
+			return fmt.Errorf("could not create a CA: %v", err)
+		}
+		if err := writeTLSFiles(tlsDir, tlsCAFile, certPEM, tlsCAKeyFile, keyPEM); err != nil {
+			return err
+		}
+		c.logger.Info("created cluster CA")
+	}
+
+	caCertPEM, err := ioutil.ReadFile(filepath.Join(tlsDir, tlsCAFile))
+	if err != nil {
+		return err
+	}
+	caKeyPEM, err := ioutil.ReadFile(filepath.Join(tlsDir, tlsCAKeyFile))
+	if err != nil {
+		return err
+	}
+
+	return c.topology.Walk(func(node *Node) error {
+		if !c.hasStaticCert(node) {
+			return nil
+		}
+
+		req := newAgentCertRequest(node)
+		prefix := req.FilePrefix()
+
+		certFile, keyFile := prefix+".pem", prefix+"-key.pem"
+		if exists, err := filesExist(tlsDir, keyFile, certFile); err != nil {
+			return err
+		} else if exists {
+			existing, err := ioutil.ReadFile(filepath.Join(tlsDir, certFile))
+			if err != nil {
+				return err
+			}
+			reason := agentCertOutdated(string(existing), string(caCertPEM), req, opts)
+			if reason == "" {
+				return nil
+			}
+			if c.plan != nil {
+				c.plan.addNote(fmt.Sprintf("certs for %s would be recreated: %s", prefix, reason))
+				return nil
+			}
+			c.logger.Info("recreating certs", "prefix", prefix, "reason", reason)
+		} else {
+			if c.plan != nil {
+				c.plan.addNote(fmt.Sprintf("certs for %s would be created", prefix))
+				return nil
+			}
+			c.logger.Info("creating certs", "prefix", prefix)
+		}
+
+		certPEM, keyPEM, err := generateAgentCert(string(caCertPEM), string(caKeyPEM), req, opts, time.Now())
+		if err != nil {
+			return fmt.Errorf("could not create certs for %s: %v", prefix, err)
+		}
+		return writeTLSFiles(tlsDir, certFile, certPEM, keyFile, keyPEM)
+	})
+}
+
+// removeTLSDir drops the generated TLS material once TLS is turned off.
+func (c *Core) removeTLSDir() error {
+	tlsDir := filepath.Join(c.rootDir, "cache", "tls")
+	if c.plan != nil {
+		if exists, err := fileExists(tlsDir); err != nil {
+			return err
+		} else if exists {
+			c.plan.addNote("cache/tls would be removed")
+		}
+		return nil
+	}
+	return os.RemoveAll(tlsDir)
+}
+
+// hasStaticCert is false for client agents that get their certs from the
+// servers.
+func (c *Core) hasStaticCert(node *Node) bool {
+	return node.Server || c.config.ClientTLS == ClientTLSStatic
+}
+
+func newAgentCertRequest(node *Node) *agentCertRequest {
+	req := &agentCertRequest{
+		Datacenter: node.Datacenter,
+		NodeName:   node.Name + "-pod",
+		Server:     node.Server,
+		Index:      node.Index,
+	}
+	for _, addr := range node.Addresses {
+		req.IPs = append(req.IPs, addr.IPAddress)
+	}
+	return req
+}
+
+func writeTLSFiles(dir, certFile, certPEM, keyFile, keyPEM string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, certFile), []byte(certPEM), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, keyFile), []byte(keyPEM), 0600)
+}
+
+// generateTLSCA creates a self-signed CA for the agents' RPC and HTTPS
+// listeners.
+func generateTLSCA(opts *tlsOptions, now time.Time) (string, string, error) {
+	signer, err := generatePrivateKey(opts.KeyType, opts.KeyBits)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return "", "", err
+	}
+	keyID, err := keyIDFromPublicKey(signer.Public())
+	if err != nil {
+		return "", "", err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "Consul Agent CA " + serial.String(),
+			Organization: []string{"devconsul"},
+		},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(opts.CAValidity),
+		SubjectKeyId:          keyID,
+		AuthorityKeyId:        keyID,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyPEM, err := encodePrivateKey(signer)
+	if err != nil {
+		return "", "", err
+	}
+	return encodeCert(der), keyPEM, nil
+}
+
+// crossSignCA reissues the new CA certificate with the old CA as its issuer,
+// so that anything still trusting only the old CA accepts leaves from the new
+// one when they are served along with it.
+func crossSignCA(newCACertPEM, oldCACertPEM, oldCAKeyPEM string) (string, error) {
+	newCA, err := parseCertPEM(newCACertPEM)
+	if err != nil {
+		return "", fmt.Errorf("error parsing new CA certificate: %v", err)
+	}
+	oldCA, err := parseCertPEM(oldCACertPEM)
+	if err != nil {
+		return "", fmt.Errorf("error parsing old CA certificate: %v", err)
+	}
+	oldSigner, err := parsePrivateKey(oldCAKeyPEM)
+	if err != nil {
+		return "", fmt.Errorf("error parsing old CA key: %v", err)
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return "", err
+	}
+
+	notAfter := newCA.NotAfter
+	if notAfter.After(oldCA.NotAfter) {
+		notAfter = oldCA.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               newCA.Subject,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              newCA.KeyUsage,
+		NotBefore:             newCA.NotBefore,
+		NotAfter:              notAfter,
+		SubjectKeyId:          newCA.SubjectKeyId,
+		AuthorityKeyId:        oldCA.SubjectKeyId,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, oldCA, newCA.PublicKey, oldSigner)
+	if err != nil {
+		return "", err
+	}
+	return encodeCert(der), nil
+}
+
+// generateAgentCert creates a certificate for one agent signed by the CA.
+// Every cert is usable both as a server and a client, like the ones from
+// 'consul tls cert create'.
+func generateAgentCert(caCertPEM, caKeyPEM string, req *agentCertRequest, opts *tlsOptions, now time.Time) (string, string, error) {
+	caCert, err := parseCertPEM(caCertPEM)
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing CA certificate: %v", err)
+	}
+	caSigner, err := parsePrivateKey(caKeyPEM)
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing CA key: %v", err)
+	}
+
+	signer, err := generatePrivateKey(opts.KeyType, opts.KeyBits)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return "", "", err
+	}
+	keyID, err := keyIDFromPublicKey(signer.Public())
+	if err != nil {
+		return "", "", err
+	}
+
+	dnsNames, ips := req.sans(opts)
+
+	notAfter := now.Add(opts.CertValidity)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: req.role() + "." + req.Datacenter + ".consul",
+		},
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              notAfter,
+		SubjectKeyId:          keyID,
+		AuthorityKeyId:        caCert.SubjectKeyId,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, signer.Public(), caSigner)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyPEM, err := encodePrivateKey(signer)
+	if err != nil {
+		return "", "", err
+	}
+	return encodeCert(der), keyPEM, nil
+}
+
+// agentCertOutdated returns a reason the existing agent certificate has to be
+// replaced, or the empty string if it is still fine.
+func agentCertOutdated(certPEM, caCertPEM string, req *agentCertRequest, opts *tlsOptions) string {
+	cert, err := parseCertPEM(certPEM)
+	if err != nil {
+		return "unparseable"
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(caCertPEM)) {
+		return "unparseable CA"
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return "not signed by the current CA"
+	}
+
+	if keyTypeOf(cert.PublicKey) != opts.KeyType {
+		return "key type changed"
+	}
+
+	dnsNames, ips := req.sans(opts)
+	if !sameStringSet(dnsNames, cert.DNSNames) {
+		return "DNS SANs changed"
+	}
+	var want, have []string
+	for _, ip := range ips {
+		want = append(want, ip.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		have = append(have, ip.String())
+	}
+	if !sameStringSet(want, have) {
+		return "IP SANs changed"
+	}
+
+	return ""
+}
+
+func sameStringSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func defaultKeyBits(keyType string) int {
+	switch keyType {
+	case "ec":
+		return 256
+	case "rsa":
+		return 2048
+	default:
+		return 0
+	}
+}
+
+func validateKeyTypeAndBits(keyType string, keyBits int) error {
+	switch keyType {
+	case "ec":
+		switch keyBits {
+		case 256, 384, 521:
+			return nil
+		}
+		return fmt.Errorf("unsupported ec key bits: %d", keyBits)
+	case "rsa":
+		switch keyBits {
+		case 2048, 4096:
+			return nil
+		}
+		return fmt.Errorf("unsupported rsa key bits: %d", keyBits)
+	default:
+		return fmt.Errorf("unsupported key type: %s", keyType)
+	}
+}
+
+func generatePrivateKey(keyType string, keyBits int) (crypto.Signer, error) {
+	if err := validateKeyTypeAndBits(keyType, keyBits); err != nil {
+		return nil, err
+	}
+
+	switch keyType {
+	case "ec":
+		var curve elliptic.Curve
+		switch keyBits {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, keyBits)
+	default:
+		panic("unreachable")
+	}
+}
+
+func keyTypeOf(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return "ec"
+	case *rsa.PublicKey:
+		return "rsa"
+	default:
+		return "unknown"
+	}
+}
+
+func encodePrivateKey(signer crypto.Signer) (string, error) {
+	var block *pem.Block
+	switch k := signer.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	default:
+		return "", fmt.Errorf("unsupported private key type: %T", signer)
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+func parsePrivateKey(keyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type: %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block: %s", block.Type)
+	}
+}
+
+func encodeCert(der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func keyIDFromPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	return sum[:20], nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/rboyer/devconsul/consulfunc"
+)
+
+func (c *Core) RunTLS() error {
+	args := flag.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("Missing required tls subcommand: [rotate]")
+	}
+
+	switch args[0] {
+	case "rotate":
+		return c.runTLSRotate(args[1:])
+	default:
+		return fmt.Errorf("unknown tls subcommand: %s", args[0])
+	}
+}
+
+func (c *Core) runTLSRotate(args []string) error {
+	var (
+		rotateCA bool
+		nodeList string
+		timeout  time.Duration
+	)
+	fs := flag.NewFlagSet("tls rotate", flag.ContinueOnError)
+	fs.BoolVar(&rotateCA, "ca", false, "also replace the CA, with a cross-signed transition period")
+	fs.StringVar(&nodeList, "nodes", "", "comma separated list of nodes to rotate (default: all)")
+	fs.DurationVar(&timeout, "timeout", 5*time.Minute, "how long to wait for the cluster to settle after each reload")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if !c.config.EncryptionTLS {
+		return fmt.Errorf("tls rotate requires security.encryption.tls = true")
+	}
+
+	var nodes []*Node
+	if nodeList == "" {
+		for _, node := range c.topology.Nodes() {
+			if c.hasStaticCert(node) {
+				nodes = append(nodes, node)
+			}
+		}
+	} else {
+		if rotateCA {
+			return fmt.Errorf("-ca always rotates every agent and cannot be combined with -nodes")
+		}
+		for _, name := range strings.Split(nodeList, ",") {
+			name = strings.TrimSpace(name)
+			node := c.topology.Node(name)
+			if node == nil {
+				return fmt.Errorf("unknown node: %s", name)
+			}
+			if !c.hasStaticCert(node) {
+				return fmt.Errorf("node %s gets its certificate from the servers", name)
+			}
+			nodes = append(nodes, node)
+		}
+	}
+
+	masterToken, err := c.cache.LoadValue("master-token")
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := c.interruptibleContext("tls rotation", 0)
+	defer stop()
+
+	tlsDir := filepath.Join(c.rootDir, "cache", "tls")
+	start := time.Now()
+
+	if !rotateCA {
+		if err := c.reissueAgentCerts(tlsDir, nodes, ""); err != nil {
+			return err
+		}
+		if err := c.reloadAndVerifyTLS(ctx, nodes, masterToken, timeout); err != nil {
+			return err
+		}
+		c.logger.Info("tls rotation complete", "elapsed", time.Since(start))
+		return nil
+	}
+
+	// Every agent has to trust the new CA before any of them can drop the
+	// old one, so this happens in two rounds of reloads. In the first the
+	// agents trust both CAs and serve their new leaf along with the new CA
+	// cross-signed by the old one.
+	crossPEM, err := c.rotateTLSCA(tlsDir, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := c.reissueAgentCerts(tlsDir, nodes, crossPEM); err != nil {
+		return err
+	}
+	if err := c.reloadAndVerifyTLS(ctx, c.topology.Nodes(), masterToken, timeout); err != nil {
+		return err
+	}
+	c.logger.Info("all agents are using the new CA; dropping the old one", "elapsed", time.Since(start))
+
+	if err := c.finishTLSCARotation(tlsDir, nodes); err != nil {
+		return err
+	}
+	if err := c.reloadAndVerifyTLS(ctx, c.topology.Nodes(), masterToken, timeout); err != nil {
+		return err
+	}
+
+	if c.config.EncryptionTLSAPI {
+		c.logger.Warn("sidecars read the agent CA when they start; run 'devconsul restart' to have them trust the new one")
+	}
+	c.logger.Info("tls rotation complete", "elapsed", time.Since(start))
+	return nil
+}
+
+// rotateTLSCA replaces the CA on disk with a new one, leaving the old
+// certificate in the CA bundle. It returns the new CA cross-signed by the old.
+func (c *Core) rotateTLSCA(tlsDir string, now time.Time) (string, error) {
+	oldCertPEM, err := readFirstCert(filepath.Join(tlsDir, tlsCAFile))
+	if err != nil {
+		return "", err
+	}
+	oldKeyPEM, err := ioutil.ReadFile(filepath.Join(tlsDir, tlsCAKeyFile))
+	if err != nil {
+		return "", err
+	}
+
+	newCertPEM, newKeyPEM, err := generateTLSCA(c.tlsOptions(), now)
+	if err != nil {
+		return "", fmt.Errorf("could not create a CA: %v", err)
+	}
+	crossPEM, err := crossSignCA(newCertPEM, oldCertPEM, string(oldKeyPEM))
+	if err != nil {
+		return "", fmt.Errorf("could not cross-sign the new CA: %v", err)
+	}
+
+	if err := writeTLSFiles(tlsDir, tlsCAFile, newCertPEM+oldCertPEM, tlsCAKeyFile, newKeyPEM); err != nil {
+		return "", err
+	}
+	c.logger.Info("created new cluster CA")
+	return crossPEM, nil
+}
+
+// reissueAgentCerts replaces the certs of the given nodes with new ones from
+// the current CA, appending chainPEM to each of them.
+func (c *Core) reissueAgentCerts(tlsDir string, nodes []*Node, chainPEM string) error {
+	caCertPEM, err := ioutil.ReadFile(filepath.Join(tlsDir, tlsCAFile))
+	if err != nil {
+		return err
+	}
+	caKeyPEM, err := ioutil.ReadFile(filepath.Join(tlsDir, tlsCAKeyFile))
+	if err != nil {
+		return err
+	}
+
+	opts := c.tlsOptions()
+	for _, node := range nodes {
+		req := newAgentCertRequest(node)
+		prefix := req.FilePrefix()
+
+		certPEM, keyPEM, err := generateAgentCert(string(caCertPEM), string(caKeyPEM), req, opts, time.Now())
+		if err != nil {
+			return fmt.Errorf("could not create certs for %s: %v", prefix, err)
+		}
+		if err := writeTLSFiles(tlsDir, prefix+".pem", certPEM+chainPEM, prefix+"-key.pem", keyPEM); err != nil {
+			return err
+		}
+		c.logger.Info("reissued certs", "node", node.Name, "prefix", prefix)
+	}
+	return nil
+}
+
+// finishTLSCARotation drops the old CA from the bundle and the cross-signed
+// CA from the given nodes' certs.
+func (c *Core) finishTLSCARotation(tlsDir string, nodes []*Node) error {
+	files := []string{tlsCAFile}
+	for _, node := range nodes {
+		files = append(files, newAgentCertRequest(node).FilePrefix()+".pem")
+	}
+
+	for _, file := range files {
+		certPEM, err := readFirstCert(filepath.Join(tlsDir, file))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(tlsDir, file), []byte(certPEM), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFirstCert(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	cert, err := parseCertPEM(string(data))
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return encodeCert(cert.Raw), nil
+}
+
+// reloadAndVerifyTLS has the given agents reload their TLS files and then
+// waits until every agent in the cluster can make RPCs again and sees all of
+// its peers alive in gossip.
+func (c *Core) reloadAndVerifyTLS(ctx context.Context, nodes []*Node, token string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, node := range nodes {
+		agentClient, err := consulfunc.GetClient(node.LocalAddress(), token)
+		if err != nil {
+			return err
+		}
+		err = retryFor(ctx, node.Name+" to reload", func() (bool, error) {
+			if err := agentClient.Agent().Reload(); err != nil {
+				c.logger.Warn("error reloading agent", "node", node.Name, "error", err)
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+		c.logger.Info("reloaded agent", "node", node.Name)
+	}
+
+	for _, node := range c.topology.Nodes() {
+		agentClient, err := consulfunc.GetClient(node.LocalAddress(), token)
+		if err != nil {
+			return err
+		}
+		expectMembers := len(c.topology.DatacenterNodes(node.Datacenter))
+
+		err = retryFor(ctx, node.Name+" to recover after the reload", func() (bool, error) {
+			leader, err := agentClient.Status().Leader()
+			if err != nil || leader == "" {
+				c.logger.Warn("no leader visible", "node", node.Name, "error", err)
+				return false, nil
+			}
+			for _, dc := range c.topology.Datacenters() {
+				_, _, err := agentClient.Catalog().Nodes(&api.QueryOptions{Datacenter: dc.Name})
+				if err != nil {
+					c.logger.Warn("rpc failed", "node", node.Name, "datacenter", dc.Name, "error", err)
+					return false, nil
+				}
+			}
+
+			members, err := agentClient.Agent().Members(false)
+			if err != nil {
+				c.logger.Warn("error listing members", "node", node.Name, "error", err)
+				return false, nil
+			}
+			alive := 0
+			for _, m := range members {
+				if m.Status == 1 { // serf.StatusAlive
+					alive++
+				}
+			}
+			if alive < expectMembers {
+				c.logger.Debug("not all members are alive yet", "node", node.Name, "alive", alive)
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	c.logger.Info("rpc and gossip are healthy on every agent")
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSCARotation(t *testing.T) {
+	cfg, topo, err := parseConfig([]byte(`
+		security {
+			encryption {
+				tls = true
+			}
+		}
+	`))
+	require.NoError(t, err)
+
+	rootDir, err := ioutil.TempDir("", "devconsul-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootDir)
+
+	c := &Core{
+		logger:   hclog.NewNullLogger(),
+		rootDir:  rootDir,
+		config:   cfg,
+		topology: topo,
+	}
+	require.NoError(t, c.initTLS())
+
+	tlsDir := filepath.Join(rootDir, "cache", "tls")
+	read := func(file string) string {
+		data, err := ioutil.ReadFile(filepath.Join(tlsDir, file))
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	oldCA := read("consul-agent-ca.pem")
+	oldServerCert := read("dc1-server-consul-0.pem")
+
+	nodes := topo.Nodes()
+
+	crossPEM, err := c.rotateTLSCA(tlsDir, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, c.reissueAgentCerts(tlsDir, nodes, crossPEM))
+
+	newCA, err := readFirstCert(filepath.Join(tlsDir, "consul-agent-ca.pem"))
+	require.NoError(t, err)
+	require.NotEqual(t, oldCA, newCA)
+	bundle := read("consul-agent-ca.pem")
+	require.Equal(t, newCA+oldCA, bundle)
+
+	// During the transition agents that have not reloaded yet accept the new
+	// certs, and reloaded agents accept the old ones.
+	newServerCert := read("dc1-server-consul-0.pem")
+	require.NoError(t, verifyCertFile(newServerCert, oldCA))
+	require.NoError(t, verifyCertFile(newServerCert, bundle))
+	require.NoError(t, verifyCertFile(oldServerCert, bundle))
+
+	// Nothing looks outdated to the next 'up'.
+	require.NoError(t, c.initTLS())
+	require.Equal(t, newServerCert, read("dc1-server-consul-0.pem"))
+
+	require.NoError(t, c.finishTLSCARotation(tlsDir, nodes))
+	require.Equal(t, newCA, read("consul-agent-ca.pem"))
+
+	finalServerCert := read("dc1-server-consul-0.pem")
+	leaf, err := readFirstCert(filepath.Join(tlsDir, "dc1-server-consul-0.pem"))
+	require.NoError(t, err)
+	require.Equal(t, leaf, finalServerCert)
+	require.NoError(t, verifyCertFile(finalServerCert, newCA))
+	require.Error(t, verifyCertFile(finalServerCert, oldCA))
+	require.Error(t, verifyCertFile(oldServerCert, newCA))
+}
+
+// verifyCertFile verifies the first certificate in certPEM the way a TLS peer
+// would, using any others as the chain it was presented with.
+func verifyCertFile(certPEM, rootsPEM string) error {
+	var certs []*x509.Certificate
+	rest := []byte(certPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(rootsPEM))
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
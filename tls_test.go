@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateAgentCert(t *testing.T) {
+	now := time.Now()
+	opts := &tlsOptions{
+		CAValidity:   24 * time.Hour,
+		CertValidity: 48 * time.Hour, // clamped to the CA
+		KeyType:      "ec",
+		KeyBits:      256,
+		ExtraSANs:    []string{"10.9.9.9", "consul.example.com"},
+	}
+
+	caCertPEM, caKeyPEM, err := generateTLSCA(opts, now)
+	require.NoError(t, err)
+
+	caCert, err := parseCertPEM(caCertPEM)
+	require.NoError(t, err)
+	require.True(t, caCert.IsCA)
+
+	req := &agentCertRequest{
+		Datacenter: "dc2",
+		NodeName:   "dc2-server1-pod",
+		Server:     true,
+		Index:      0,
+		IPs:        []string{"10.0.2.11"},
+	}
+	require.Equal(t, "dc2-server-consul-0", req.FilePrefix())
+
+	certPEM, keyPEM, err := generateAgentCert(caCertPEM, caKeyPEM, req, opts, now)
+	require.NoError(t, err)
+	require.Contains(t, keyPEM, "EC PRIVATE KEY")
+
+	cert, err := parseCertPEM(certPEM)
+	require.NoError(t, err)
+
+	require.Equal(t, "server.dc2.consul", cert.Subject.CommonName)
+	require.ElementsMatch(t, []string{
+		"server.dc2.consul",
+		"dc2-server1-pod.server.dc2.consul",
+		"localhost",
+		"consul.example.com",
+	}, cert.DNSNames)
+	var ips []string
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	require.ElementsMatch(t, []string{"127.0.0.1", "10.0.2.11", "10.9.9.9"}, ips)
+	require.Equal(t, caCert.NotAfter, cert.NotAfter)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		_, err = cert.Verify(x509.VerifyOptions{
+			DNSName:   "server.dc2.consul",
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{usage},
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, "", agentCertOutdated(certPEM, caCertPEM, req, opts))
+
+	t.Run("sans changed", func(t *testing.T) {
+		opts2 := *opts
+		opts2.ExtraSANs = nil
+		require.Equal(t, "DNS SANs changed", agentCertOutdated(certPEM, caCertPEM, req, &opts2))
+	})
+
+	t.Run("key type changed", func(t *testing.T) {
+		opts2 := *opts
+		opts2.KeyType = "rsa"
+		opts2.KeyBits = 2048
+		require.Equal(t, "key type changed", agentCertOutdated(certPEM, caCertPEM, req, &opts2))
+	})
+
+	t.Run("different ca", func(t *testing.T) {
+		otherCAPEM, _, err := generateTLSCA(opts, now)
+		require.NoError(t, err)
+		require.Equal(t, "not signed by the current CA", agentCertOutdated(certPEM, otherCAPEM, req, opts))
+	})
+}
+
+func TestParseConfig_TLSKeyBits(t *testing.T) {
+	_, _, err := parseConfig([]byte(`
+		security {
+			encryption {
+				tls = true
+			}
+			tls {
+				key_type = "ec"
+				key_bits = 224
+			}
+		}
+	`))
+	require.EqualError(t, err, "invalid security.tls: unsupported ec key bits: 224")
+}
+
+func TestInitTLS(t *testing.T) {
+	cfg, topo, err := parseConfig([]byte(`
+		security {
+			encryption {
+				tls = true
+			}
+			tls {
+				key_type = "rsa"
+			}
+		}
+	`))
+	require.NoError(t, err)
+	require.Equal(t, 2048, cfg.TLSKeyBits)
+
+	rootDir, err := ioutil.TempDir("", "devconsul-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootDir)
+
+	c := &Core{
+		logger:   hclog.NewNullLogger(),
+		rootDir:  rootDir,
+		config:   cfg,
+		topology: topo,
+	}
+	require.NoError(t, c.initTLS())
+
+	tlsDir := filepath.Join(rootDir, "cache", "tls")
+	exists, err := filesExist(tlsDir,
+		"consul-agent-ca.pem",
+		"consul-agent-ca-key.pem",
+		"dc1-server-consul-0.pem",
+		"dc1-server-consul-0-key.pem",
+		"dc1-client-consul-0.pem",
+		"dc1-client-consul-0-key.pem",
+		"dc1-client-consul-1.pem",
+		"dc1-client-consul-1-key.pem",
+	)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	before, err := ioutil.ReadFile(filepath.Join(tlsDir, "dc1-client-consul-1.pem"))
+	require.NoError(t, err)
+
+	// Running it again leaves everything alone.
+	require.NoError(t, c.initTLS())
+	after, err := ioutil.ReadFile(filepath.Join(tlsDir, "dc1-client-consul-1.pem"))
+	require.NoError(t, err)
+	require.Equal(t, string(before), string(after))
+
+	// Changing the SANs reissues the agent certs.
+	c.config.TLSExtraSANs = []string{"127.0.0.2"}
+	require.NoError(t, c.initTLS())
+	after, err = ioutil.ReadFile(filepath.Join(tlsDir, "dc1-client-consul-1.pem"))
+	require.NoError(t, err)
+	require.NotEqual(t, string(before), string(after))
+}
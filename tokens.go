@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// tokenRegistryFile lives in the cache directory and lists every secret that
+// boot minted, so they can be found again after boot has exited.
+const tokenRegistryFile = "tokens.json"
+
+var tokenTypes = []string{
+	"master",
+	"agent-master",
+	"replication",
+	"mesh-gateway",
+	"agent",
+	"service",
+	"config",
+	"vault",
+}
+
+type tokenRecord struct {
+	Type       string   `json:"type"`
+	Name       string   `json:"name"`
+	AccessorID string   `json:"accessor_id,omitempty"`
+	SecretID   string   `json:"secret_id"`
+	Datacenter string   `json:"datacenter,omitempty"`
+	Policies   []string `json:"policies,omitempty"`
+}
+
+func (r *tokenRecord) key() string {
+	return r.Type + "/" + r.Name
+}
+
+// newTokenRecord describes an ACL token. Roles and identities are listed
+// alongside the policies as role:<name>, service:<name> and node:<name>.
+func newTokenRecord(typ, name, dc string, token *api.ACLToken) *tokenRecord {
+	r := &tokenRecord{
+		Type:       typ,
+		Name:       name,
+		AccessorID: token.AccessorID,
+		SecretID:   token.SecretID,
+		Datacenter: dc,
+	}
+	for _, p := range token.Policies {
+		r.Policies = append(r.Policies, defaultValue(p.Name, p.ID))
+	}
+	for _, role := range token.Roles {
+		r.Policies = append(r.Policies, "role:"+defaultValue(role.Name, role.ID))
+	}
+	for _, si := range token.ServiceIdentities {
+		r.Policies = append(r.Policies, "service:"+si.ServiceName)
+	}
+	for _, ni := range token.NodeIdentities {
+		r.Policies = append(r.Policies, "node:"+ni.NodeName)
+	}
+	return r
+}
+
+// loadTokenRegistry starts boot off with whatever the last boot recorded.
+// Entries that this boot does not record again are dropped when it finishes.
+func (c *Core) loadTokenRegistry() error {
+	records, err := c.readTokenRegistry()
+	if err != nil {
+		return err
+	}
+
+	c.bootMu.Lock()
+	defer c.bootMu.Unlock()
+	c.registry = make(map[string]*tokenRecord)
+	c.registrySeen = make(map[string]struct{})
+	for _, r := range records {
+		c.registry[r.key()] = r
+	}
+	return nil
+}
+
+// recordToken adds a token to the registry and persists it right away, so
+// that a boot that fails part of the way through still leaves behind the
+// tokens it did mint.
+func (c *Core) recordToken(r *tokenRecord) error {
+	c.bootMu.Lock()
+	defer c.bootMu.Unlock()
+	if c.registry == nil {
+		c.registry = make(map[string]*tokenRecord)
+		c.registrySeen = make(map[string]struct{})
+	}
+	c.registry[r.key()] = r
+	c.registrySeen[r.key()] = struct{}{}
+	return c.writeTokenRegistryLocked()
+}
+
+// pruneTokenRegistry forgets the tokens that this boot did not record.
+func (c *Core) pruneTokenRegistry() error {
+	c.bootMu.Lock()
+	defer c.bootMu.Unlock()
+	for k := range c.registry {
+		if _, ok := c.registrySeen[k]; !ok {
+			delete(c.registry, k)
+		}
+	}
+	return c.writeTokenRegistryLocked()
+}
+
+func (c *Core) writeTokenRegistryLocked() error {
+	records := make([]*tokenRecord, 0, len(c.registry))
+	for _, r := range c.registry {
+		records = append(records, r)
+	}
+	sortTokenRecords(records)
+
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return c.cache.WriteStringFile(tokenRegistryFile, string(b))
+}
+
+func (c *Core) readTokenRegistry() ([]*tokenRecord, error) {
+	raw, err := c.cache.LoadStringFile(tokenRegistryFile)
+	if err != nil {
+		return nil, err
+	}
+	if raw == "" {
+		return nil, nil
+	}
+
+	var records []*tokenRecord
+	if err := json.Unmarshal([]byte(raw), &records); err != nil {
+		return nil, fmt.Errorf("could not decode cache/%s: %v", tokenRegistryFile, err)
+	}
+	return records, nil
+}
+
+func sortTokenRecords(records []*tokenRecord) {
+	order := make(map[string]int)
+	for i, typ := range tokenTypes {
+		order[typ] = i
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Type != b.Type {
+			return order[a.Type] < order[b.Type]
+		}
+		return a.Name < b.Name
+	})
+}
+
+// tokenLogArgs is what boot logs about a token: just the accessor, unless
+// -log-secrets was given.
+func (c *Core) tokenLogArgs(accessorID, secretID string) []interface{} {
+	args := []interface{}{"accessorID", accessorID}
+	if c.logSecrets {
+		args = append(args, "secretID", secretID)
+	}
+	return args
+}
+
+func (c *Core) RunTokens() error {
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "env" {
+		return c.runTokensEnv(args[1:])
+	}
+
+	var (
+		asJSON bool
+		typ    string
+	)
+	fs := flag.NewFlagSet("tokens", flag.ContinueOnError)
+	fs.BoolVar(&asJSON, "json", false, "print the tokens as JSON")
+	fs.StringVar(&typ, "type", "", "only show tokens of this type: "+strings.Join(tokenTypes, ", "))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if typ != "" && !stringSliceContains(tokenTypes, typ) {
+		return fmt.Errorf("unknown token type: %s", typ)
+	}
+
+	records, err := c.readTokenRegistry()
+	if err != nil {
+		return err
+	}
+	if records == nil {
+		return fmt.Errorf("no tokens recorded yet; run '%s up' first", programName)
+	}
+
+	records = filterTokenRecords(records, typ)
+	if asJSON {
+		fmt.Println(jsonPretty(records))
+		return nil
+	}
+	return printTokenRecords(os.Stdout, records)
+}
+
+func (c *Core) runTokensEnv(args []string) error {
+	fs := flag.NewFlagSet("tokens env", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: %s tokens env <name | type/name>", programName)
+	}
+
+	records, err := c.readTokenRegistry()
+	if err != nil {
+		return err
+	}
+
+	r, err := findTokenRecord(records, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("export CONSUL_HTTP_TOKEN=%s\n", r.SecretID)
+	return nil
+}
+
+func filterTokenRecords(records []*tokenRecord, typ string) []*tokenRecord {
+	if typ == "" {
+		return records
+	}
+	var out []*tokenRecord
+	for _, r := range records {
+		if r.Type == typ {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// findTokenRecord looks a token up by type/name, or by name alone when that
+// is unambiguous.
+func findTokenRecord(records []*tokenRecord, name string) (*tokenRecord, error) {
+	var found []*tokenRecord
+	for _, r := range records {
+		if r.key() == name || r.Name == name {
+			found = append(found, r)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no token named %q", name)
+	case 1:
+		return found[0], nil
+	default:
+		var keys []string
+		for _, r := range found {
+			keys = append(keys, r.key())
+		}
+		return nil, fmt.Errorf("token name %q is ambiguous: %s", name, strings.Join(keys, ", "))
+	}
+}
+
+func printTokenRecords(w io.Writer, records []*tokenRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tNAME\tDC\tACCESSOR\tSECRET\tPOLICIES")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Type,
+			r.Name,
+			defaultValue(r.Datacenter, "-"),
+			defaultValue(r.AccessorID, "-"),
+			r.SecretID,
+			defaultValue(strings.Join(r.Policies, ","), "-"),
+		)
+	}
+	return tw.Flush()
+}
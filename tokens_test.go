@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/rboyer/devconsul/cachestore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTokenRecord(t *testing.T) {
+	r := newTokenRecord("agent", "dc2-client1", "dc2", &api.ACLToken{
+		AccessorID:        "acc",
+		SecretID:          "sec",
+		Policies:          []*api.ACLTokenPolicyLink{{ID: "1", Name: "p1"}, {ID: "2"}},
+		Roles:             []*api.ACLTokenRoleLink{{ID: "3", Name: "agent--dc2-client1"}},
+		ServiceIdentities: []*api.ACLServiceIdentity{{ServiceName: "ping"}},
+	})
+	require.Equal(t, &tokenRecord{
+		Type:       "agent",
+		Name:       "dc2-client1",
+		AccessorID: "acc",
+		SecretID:   "sec",
+		Datacenter: "dc2",
+		Policies:   []string{"p1", "2", "role:agent--dc2-client1", "service:ping"},
+	}, r)
+}
+
+func TestFindTokenRecord(t *testing.T) {
+	records := []*tokenRecord{
+		{Type: "service", Name: "ping", SecretID: "a"},
+		{Type: "config", Name: "ping", SecretID: "b"},
+		{Type: "mesh-gateway", Name: "mesh-gateway", SecretID: "c"},
+	}
+	sortTokenRecords(records)
+	require.Equal(t, "mesh-gateway", records[0].Type)
+
+	r, err := findTokenRecord(records, "mesh-gateway")
+	require.NoError(t, err)
+	require.Equal(t, "c", r.SecretID)
+
+	r, err = findTokenRecord(records, "config/ping")
+	require.NoError(t, err)
+	require.Equal(t, "b", r.SecretID)
+
+	_, err = findTokenRecord(records, "ping")
+	require.EqualError(t, err, `token name "ping" is ambiguous: service/ping, config/ping`)
+
+	_, err = findTokenRecord(records, "pong")
+	require.EqualError(t, err, `no token named "pong"`)
+}
+
+func TestReadTokenRegistry_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devconsul-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheDir := filepath.Join(dir, "cache")
+	c := &Core{cache: cachestore.OpenReadOnly(cacheDir)}
+
+	records, err := c.readTokenRegistry()
+	require.NoError(t, err)
+	require.Nil(t, records)
+
+	require.Equal(t, cachestore.ErrReadOnly, c.cache.SaveValue("gossip-key", "abc"))
+	_, err = c.cache.LoadOrSaveValue("agent-master-token", func() (string, error) {
+		return "abc", nil
+	})
+	require.Equal(t, cachestore.ErrReadOnly, err)
+
+	_, err = os.Stat(cacheDir)
+	require.True(t, os.IsNotExist(err), "cache dir should not be created")
+}
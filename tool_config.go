@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"time"
 
 	"github.com/hashicorp/hcl/v2/hclsimple"
 
@@ -18,17 +19,69 @@ type FlatConfig struct {
 	EncryptionTLS        bool
 	EncryptionTLSAPI     bool
 	EncryptionGossip     bool
+	TLSCAValidity        time.Duration
+	TLSCertValidity      time.Duration
+	TLSKeyType           string
+	TLSKeyBits           int
+	TLSExtraSANs         []string
+	ClientTLS            string
 	KubernetesEnabled    bool
+	KubernetesBindType   api.BindingRuleBindType
+	KubernetesBindName   string
 	EnvoyLogLevel        string
 	PrometheusEnabled    bool
+	Tracing              string
 	InitialMasterToken   string
 	ConfigEntries        []api.ConfigEntry
 	GossipKey            string
 	AgentMasterToken     string
 	EnterpriseEnabled    bool
 	EnterpriseNamespaces []string
+	ExposeEnabled        bool
+	VaultEnabled         bool
+	VaultImage           string
+	VaultRootToken       string
+	VaultConnectToken    string
+
+	// ACLPolicies, ACLRoles and ACLTokens are declared in the acl block and
+	// reconciled by boot.
+	ACLPolicies []*api.ACLPolicy
+	ACLRoles    []*api.ACLRole
+	ACLTokens   []*api.ACLToken
+
+	// Intentions are declared in the intentions block and laid over the
+	// allow intentions generated for each upstream, unless those are
+	// disabled.
+	Intentions               []*api.ServiceIntentionsConfigEntry
+	DisableDefaultIntentions bool
+
+	// SeededKV, KVDir and SeededQueries are written by boot, and removed
+	// again once they are taken out of config.
+	SeededKV      []*seededKV
+	KVDir         string
+	SeededQueries []*seededQuery
+
+	// PresetAgentTokens holds the pre-minted agent token SecretIDs for client
+	// agents that need one before they can be reached over HTTP.
+	PresetAgentTokens map[string]string
+
+	// AutoConfigPublicKey and AutoConfigIntroTokens are only set with
+	// client_tls=auto_config.
+	AutoConfigPublicKey   string
+	AutoConfigIntroTokens map[string]string
 }
 
+const (
+	ClientTLSStatic      = "static"
+	ClientTLSAutoEncrypt = "auto_encrypt"
+	ClientTLSAutoConfig  = "auto_config"
+)
+
+const (
+	TracingZipkin = "zipkin"
+	TracingJaeger = "jaeger"
+)
+
 func (c *FlatConfig) Namespaces() []string {
 	out := []string{"default"}
 	out = append(out, c.EnterpriseNamespaces...)
@@ -36,16 +89,23 @@ func (c *FlatConfig) Namespaces() []string {
 }
 
 type userConfig struct {
-	ConsulImage      string                   `hcl:"consul_image,optional"`
-	EnvoyVersion     string                   `hcl:"envoy_version,optional"`
-	CanaryProxies    *userConfigCanaryProxies `hcl:"canary_proxies,block"`
-	Security         *userConfigSecurity      `hcl:"security,block"`
-	Kubernetes       *userConfigK8S           `hcl:"kubernetes,block"`
-	Envoy            *userConfigEnvoy         `hcl:"envoy,block"`
-	Monitor          *userConfigMonitor       `hcl:"monitor,block"`
-	Enterprise       *userConfigEnterprise    `hcl:"enterprise,block"`
-	Topology         *userConfigTopology      `hcl:"topology,block"`
-	RawConfigEntries []string                 `hcl:"config_entries,optional"`
+	ConsulImage      string                     `hcl:"consul_image,optional"`
+	EnvoyVersion     string                     `hcl:"envoy_version,optional"`
+	CanaryProxies    *userConfigCanaryProxies   `hcl:"canary_proxies,block"`
+	Security         *userConfigSecurity        `hcl:"security,block"`
+	Kubernetes       *userConfigK8S             `hcl:"kubernetes,block"`
+	Envoy            *userConfigEnvoy           `hcl:"envoy,block"`
+	Monitor          *userConfigMonitor         `hcl:"monitor,block"`
+	Enterprise       *userConfigEnterprise      `hcl:"enterprise,block"`
+	Expose           *userConfigExpose          `hcl:"expose,block"`
+	Vault            *userConfigVault           `hcl:"vault,block"`
+	ACL              *userConfigACL             `hcl:"acl,block"`
+	Intentions       *userConfigIntentions      `hcl:"intentions,block"`
+	KV               []*userConfigKV            `hcl:"kv,block"`
+	KVDir            string                     `hcl:"kv_dir,optional"`
+	PreparedQueries  []*userConfigPreparedQuery `hcl:"prepared_query,block"`
+	Topology         *userConfigTopology        `hcl:"topology,block"`
+	RawConfigEntries []string                   `hcl:"config_entries,optional"`
 }
 
 func (uc *userConfig) removeNilFields() {
@@ -58,6 +118,9 @@ func (uc *userConfig) removeNilFields() {
 	if uc.Security.Encryption == nil {
 		uc.Security.Encryption = &userConfigEncryption{}
 	}
+	if uc.Security.TLS == nil {
+		uc.Security.TLS = &userConfigTLS{}
+	}
 	if uc.Kubernetes == nil {
 		uc.Kubernetes = &userConfigK8S{}
 	}
@@ -73,10 +136,23 @@ func (uc *userConfig) removeNilFields() {
 	if uc.Enterprise == nil {
 		uc.Enterprise = &userConfigEnterprise{}
 	}
+	if uc.Expose == nil {
+		uc.Expose = &userConfigExpose{}
+	}
+	if uc.Vault == nil {
+		uc.Vault = &userConfigVault{}
+	}
+	if uc.ACL == nil {
+		uc.ACL = &userConfigACL{}
+	}
+	if uc.Intentions == nil {
+		uc.Intentions = &userConfigIntentions{}
+	}
 }
 
 type userConfigMonitor struct {
-	Prometheus bool `hcl:"prometheus,optional"`
+	Prometheus bool   `hcl:"prometheus,optional"`
+	Tracing    string `hcl:"tracing,optional"`
 }
 
 type userConfigEnvoy struct {
@@ -84,14 +160,26 @@ type userConfigEnvoy struct {
 }
 
 type userConfigK8S struct {
-	Enabled bool `hcl:"enabled,optional"`
+	Enabled  bool   `hcl:"enabled,optional"`
+	BindType string `hcl:"bind_type,optional"`
+	BindName string `hcl:"bind_name,optional"`
 }
 
 type userConfigSecurity struct {
 	Encryption         *userConfigEncryption `hcl:"encryption,block"`
+	TLS                *userConfigTLS        `hcl:"tls,block"`
+	ClientTLS          string                `hcl:"client_tls,optional"`
 	InitialMasterToken string                `hcl:"initial_master_token,optional"`
 }
 
+type userConfigTLS struct {
+	CAValidity   string   `hcl:"ca_validity,optional"`
+	CertValidity string   `hcl:"cert_validity,optional"`
+	KeyType      string   `hcl:"key_type,optional"`
+	KeyBits      int      `hcl:"key_bits,optional"`
+	ExtraSANs    []string `hcl:"extra_sans,optional"`
+}
+
 type userConfigEncryption struct {
 	TLS    bool `hcl:"tls,optional"`
 	TLSAPI bool `hcl:"tls_api,optional"`
@@ -109,9 +197,46 @@ type userConfigEnterprise struct {
 	Namespaces []string `hcl:"namespaces,optional"`
 }
 
+type userConfigExpose struct {
+	Enabled bool `hcl:"enabled,optional"`
+}
+
+type userConfigVault struct {
+	Enabled bool   `hcl:"enabled,optional"`
+	Image   string `hcl:"image,optional"`
+}
+
+type userConfigACL struct {
+	Policies []*userConfigACLPolicy `hcl:"policy,block"`
+	Roles    []*userConfigACLRole   `hcl:"role,block"`
+	Tokens   []*userConfigACLToken  `hcl:"token,block"`
+}
+
+type userConfigACLPolicy struct {
+	Name        string   `hcl:"name,label"`
+	Rules       string   `hcl:"rules"`
+	Datacenters []string `hcl:"datacenters,optional"`
+}
+
+type userConfigACLRole struct {
+	Name              string   `hcl:"name,label"`
+	Policies          []string `hcl:"policies,optional"`
+	ServiceIdentities []string `hcl:"service_identities,optional"`
+}
+
+type userConfigACLToken struct {
+	Name              string   `hcl:"name,label"`
+	SecretID          string   `hcl:"secret_id,optional"`
+	Local             bool     `hcl:"local,optional"`
+	Policies          []string `hcl:"policies,optional"`
+	Roles             []string `hcl:"roles,optional"`
+	ServiceIdentities []string `hcl:"service_identities,optional"`
+}
+
 type userConfigTopology struct {
 	NetworkShape        string                          `hcl:"network_shape,optional"`
 	DisableWANBootstrap bool                            `hcl:"disable_wan_bootstrap,optional"`
+	TransparentProxy    bool                            `hcl:"transparent_proxy,optional"`
 	Datacenter          []*userConfigTopologyDatacenter `hcl:"datacenter,block"`
 	Nodes               []*userConfigTopologyNodeConfig `hcl:"node,block"`
 }
@@ -150,8 +275,28 @@ type userConfigTopologyNodeConfig struct {
 	ServiceMeta                 map[string]string `hcl:"service_meta,optional"` // key -> val
 	ServiceNamespace            string            `hcl:"service_namespace,optional"`
 	UseBuiltinProxy             bool              `hcl:"use_builtin_proxy,optional"`
+	TransparentProxy            *bool             `hcl:"transparent_proxy,optional"` // overrides topology.transparent_proxy
 	Dead                        bool              `hcl:"dead,optional"`
 	RetainInPrimaryGatewaysList bool              `hcl:"retain_in_primary_gateways_list,optional"`
+
+	Checks        []*userConfigServiceCheck `hcl:"check,block"`
+	SidecarChecks []*userConfigServiceCheck `hcl:"sidecar_check,block"`
+}
+
+type userConfigServiceCheck struct {
+	Name                           string   `hcl:"name,label"`
+	Type                           string   `hcl:"type"`
+	Port                           int      `hcl:"port,optional"`
+	Path                           string   `hcl:"path,optional"`
+	Method                         string   `hcl:"method,optional"`
+	TTL                            string   `hcl:"ttl,optional"`
+	Args                           []string `hcl:"args,optional"`
+	Shell                          string   `hcl:"shell,optional"`
+	AliasService                   string   `hcl:"alias_service,optional"`
+	Interval                       string   `hcl:"interval,optional"`
+	Timeout                        string   `hcl:"timeout,optional"`
+	Status                         string   `hcl:"status,optional"`
+	DeregisterCriticalServiceAfter string   `hcl:"deregister_critical_service_after,optional"`
 }
 
 func (c *userConfigTopologyNodeConfig) Meta() map[string]string {
@@ -188,6 +333,42 @@ func parseConfig(contents []byte) (*FlatConfig, *Topology, error) {
 		return nil, nil, fmt.Errorf("encryption.tls_api=true requires encryption.tls=true")
 	}
 
+	if cfg.EncryptionTLS {
+		if cfg.TLSCAValidity == 0 {
+			cfg.TLSCAValidity = defaultTLSCAValidity
+		}
+		if cfg.TLSCertValidity == 0 {
+			cfg.TLSCertValidity = defaultTLSCertValidity
+		}
+		if cfg.TLSKeyType == "" {
+			cfg.TLSKeyType = "ec"
+		}
+		if cfg.TLSKeyBits == 0 {
+			cfg.TLSKeyBits = defaultKeyBits(cfg.TLSKeyType)
+		}
+		if err := validateKeyTypeAndBits(cfg.TLSKeyType, cfg.TLSKeyBits); err != nil {
+			return nil, nil, fmt.Errorf("invalid security.tls: %v", err)
+		}
+		if cfg.TLSCertValidity > cfg.TLSCAValidity {
+			return nil, nil, fmt.Errorf("security.tls.cert_validity cannot be longer than security.tls.ca_validity")
+		}
+	} else if cfg.TLSCAValidity != 0 || cfg.TLSCertValidity != 0 ||
+		cfg.TLSKeyType != "" || cfg.TLSKeyBits != 0 || len(cfg.TLSExtraSANs) > 0 {
+		return nil, nil, fmt.Errorf("security.tls cannot be configured when encryption.tls=false")
+	}
+
+	switch cfg.ClientTLS {
+	case "":
+		cfg.ClientTLS = ClientTLSStatic
+	case ClientTLSStatic:
+	case ClientTLSAutoEncrypt, ClientTLSAutoConfig:
+		if !cfg.EncryptionTLS {
+			return nil, nil, fmt.Errorf("security.client_tls=%q requires encryption.tls=true", cfg.ClientTLS)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown security.client_tls: %s", cfg.ClientTLS)
+	}
+
 	if cfg.CanaryConsulImage == "" && cfg.CanaryEnvoyVersion != "" {
 		return nil, nil, fmt.Errorf("canary_proxies.consul_image must be set if canary_proxies.envoy_verison is set")
 	}
@@ -215,8 +396,63 @@ func parseConfig(contents []byte) (*FlatConfig, *Topology, error) {
 		return nil, nil, fmt.Errorf("network_shape=%q requires TLS to be enabled to function", topology.NetworkShape)
 	}
 
-	if cfg.PrometheusEnabled && topology.NetworkShape != NetworkShapeFlat {
-		return nil, nil, fmt.Errorf("enabling prometheus currently requires network_shape=flat")
+	switch cfg.Tracing {
+	case "", TracingZipkin, TracingJaeger:
+	default:
+		return nil, nil, fmt.Errorf("unknown monitor.tracing: %q", cfg.Tracing)
+	}
+
+	if (cfg.PrometheusEnabled || cfg.Tracing != "") && topology.NetworkShape != NetworkShapeFlat {
+		// prometheus and jaeger take .250 and .251 on each datacenter network
+		for _, dc := range topology.Datacenters() {
+			if dc.Clients > 229 {
+				return nil, nil, fmt.Errorf("enabling monitoring allows at most 229 clients in %s", dc.Name)
+			}
+		}
+	}
+
+	if cfg.KubernetesEnabled {
+		switch cfg.KubernetesBindType {
+		case "":
+			cfg.KubernetesBindType = api.BindingRuleBindTypeService
+		case api.BindingRuleBindTypeService, api.BindingRuleBindTypeRole:
+		default:
+			return nil, nil, fmt.Errorf("unknown kubernetes.bind_type: %q", cfg.KubernetesBindType)
+		}
+		if cfg.KubernetesBindName == "" {
+			cfg.KubernetesBindName = "${serviceaccount.name}"
+		}
+	} else if cfg.KubernetesBindType != "" || cfg.KubernetesBindName != "" {
+		return nil, nil, fmt.Errorf("kubernetes.bind_type and kubernetes.bind_name cannot be configured when kubernetes.enabled=false")
+	}
+
+	if cfg.VaultEnabled {
+		if topology.NetworkShape != NetworkShapeFlat {
+			return nil, nil, fmt.Errorf("enabling vault currently requires network_shape=flat")
+		}
+		if cfg.VaultImage == "" {
+			cfg.VaultImage = defaultVaultImage
+		}
+	} else if cfg.VaultImage != "" {
+		return nil, nil, fmt.Errorf("vault.image cannot be configured when vault.enabled=false")
+	}
+
+	if cfg.ExposeEnabled {
+		for _, dc := range topology.Datacenters() {
+			if dc.Index > 9 {
+				return nil, nil, fmt.Errorf("expose.enabled=true only supports datacenters dc1 through dc9")
+			}
+			if dc.Servers > 10 {
+				return nil, nil, fmt.Errorf("expose.enabled=true only supports up to 10 servers per datacenter")
+			}
+			if dc.Clients > 100 {
+				return nil, nil, fmt.Errorf("expose.enabled=true only supports up to 100 clients per datacenter")
+			}
+		}
+	}
+
+	if err := validateSeededDatacenters(cfg, topology); err != nil {
+		return nil, nil, err
 	}
 
 	return cfg, topology, nil
@@ -243,12 +479,35 @@ func parseConfigPartial(contents []byte) (*FlatConfig, *userConfigTopology, erro
 		EncryptionTLS:        uc.Security.Encryption.TLS,
 		EncryptionTLSAPI:     uc.Security.Encryption.TLSAPI,
 		EncryptionGossip:     uc.Security.Encryption.Gossip,
+		TLSKeyType:           uc.Security.TLS.KeyType,
+		TLSKeyBits:           uc.Security.TLS.KeyBits,
+		TLSExtraSANs:         uc.Security.TLS.ExtraSANs,
+		ClientTLS:            uc.Security.ClientTLS,
 		KubernetesEnabled:    uc.Kubernetes.Enabled,
+		KubernetesBindType:   api.BindingRuleBindType(uc.Kubernetes.BindType),
+		KubernetesBindName:   uc.Kubernetes.BindName,
 		EnvoyLogLevel:        uc.Envoy.LogLevel,
 		PrometheusEnabled:    uc.Monitor.Prometheus,
+		Tracing:              uc.Monitor.Tracing,
 		InitialMasterToken:   uc.Security.InitialMasterToken,
 		EnterpriseEnabled:    uc.Enterprise.Enabled,
 		EnterpriseNamespaces: uc.Enterprise.Namespaces,
+		ExposeEnabled:        uc.Expose.Enabled,
+		VaultEnabled:         uc.Vault.Enabled,
+		VaultImage:           uc.Vault.Image,
+	}
+
+	if uc.Security.TLS.CAValidity != "" {
+		cfg.TLSCAValidity, err = time.ParseDuration(uc.Security.TLS.CAValidity)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid security.tls.ca_validity: %v", err)
+		}
+	}
+	if uc.Security.TLS.CertValidity != "" {
+		cfg.TLSCertValidity, err = time.ParseDuration(uc.Security.TLS.CertValidity)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid security.tls.cert_validity: %v", err)
+		}
 	}
 
 	for i, raw := range uc.RawConfigEntries {
@@ -259,6 +518,27 @@ func parseConfigPartial(contents []byte) (*FlatConfig, *userConfigTopology, erro
 		cfg.ConfigEntries = append(cfg.ConfigEntries, entry)
 	}
 
+	cfg.ACLPolicies, cfg.ACLRoles, cfg.ACLTokens, err = parseDeclaredACLs(uc.ACL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg.DisableDefaultIntentions = uc.Intentions.DisableDefaultAllow
+	cfg.Intentions, err = parseDeclaredIntentions(uc.Intentions, cfg.EnterpriseEnabled)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg.KVDir = uc.KVDir
+	cfg.SeededKV, err = parseSeededKV(uc.KV)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.SeededQueries, err = parseSeededQueries(uc.PreparedQueries)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	return cfg, uc.Topology, nil
 }
 
@@ -293,6 +573,13 @@ func decodeHCL(out interface{}, name, config string) (xerr error) {
 	return nil
 }
 
+const defaultVaultImage = "vault:1.6.1"
+
+const (
+	defaultTLSCAValidity   = 5 * 365 * 24 * time.Hour
+	defaultTLSCertValidity = 365 * 24 * time.Hour
+)
+
 const defaultUserConfig = `
 consul_image  = "consul-dev:latest"
 envoy_version = "v1.16.0"
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -42,24 +43,43 @@ func TestParseConfigPartial_AllFields(t *testing.T) {
 				tls_api = true
 				gossip = true
 			}
+			tls {
+				ca_validity   = "87600h"
+				cert_validity = "720h"
+				key_type      = "rsa"
+				key_bits      = 4096
+				extra_sans    = ["127.0.0.2", "consul.example.com"]
+			}
+			client_tls = "auto_config"
 			initial_master_token = "root"
 		}
 		kubernetes {
-			enabled = true
+			enabled   = true
+			bind_type = "role"
+			bind_name = "k8s-$${serviceaccount.name}"
 		}
 		envoy {
 			log_level = "debug"
 		}
 		monitor {
 			prometheus = true
+			tracing    = "jaeger"
 		}
 		enterprise {
 			enabled = true
 			namespaces = ["foo", "bar"]
 		}
+		expose {
+			enabled = true
+		}
+		vault {
+			enabled = true
+			image   = "vault:1.5.0"
+		}
 		topology {
 			network_shape = "islands"
 			disable_wan_bootstrap = true
+			transparent_proxy = true
 			datacenter "dc1" {
 				servers = 3
 				clients = 2
@@ -80,10 +100,66 @@ func TestParseConfigPartial_AllFields(t *testing.T) {
 				}
 				service_namespace = "bar"
 				use_builtin_proxy = true
+				transparent_proxy = false
 				dead = true
 				retain_in_primary_gateways_list = true
 			}
 		}
+		acl {
+			policy "operator-read" {
+				rules       = "operator = \"read\""
+				datacenters = ["dc1"]
+			}
+			role "harness" {
+				policies           = ["operator-read"]
+				service_identities = ["ping"]
+			}
+			token "teammate" {
+				secret_id          = "7f2c2c3a-5a39-4ad4-bd3b-0e8ff2a53c3c"
+				local              = true
+				policies           = ["operator-read"]
+				roles              = ["harness"]
+				service_identities = ["pong"]
+			}
+		}
+		intentions {
+			disable_default_allow = true
+			service "pong" {
+				source "ping" {
+					permission {
+						action      = "allow"
+						path_prefix = "/api"
+						methods     = ["GET", "HEAD"]
+						header "x-debug" {
+							present = true
+							invert  = true
+						}
+					}
+				}
+				source "*" {
+					action      = "deny"
+					description = "deny by default"
+				}
+			}
+		}
+		kv_dir = "fixtures/kv"
+		kv {
+			path  = "config/ping/greeting"
+			value = "hello"
+		}
+		kv {
+			path       = "config/ping/greeting"
+			value      = "hola"
+			datacenter = "dc2"
+		}
+		prepared_query "pong" {
+			service      = "pong"
+			tags         = ["v2"]
+			only_passing = true
+			failover {
+				datacenters = ["dc2"]
+			}
+		}
 		config_entries = [
 			<<EOF
 {
@@ -122,12 +198,93 @@ EOF
 		EncryptionTLS:        true,
 		EncryptionTLSAPI:     true,
 		EncryptionGossip:     true,
+		TLSCAValidity:        87600 * time.Hour,
+		TLSCertValidity:      720 * time.Hour,
+		TLSKeyType:           "rsa",
+		TLSKeyBits:           4096,
+		TLSExtraSANs:         []string{"127.0.0.2", "consul.example.com"},
+		ClientTLS:            "auto_config",
 		KubernetesEnabled:    true,
+		KubernetesBindType:   api.BindingRuleBindTypeRole,
+		KubernetesBindName:   "k8s-${serviceaccount.name}",
 		EnvoyLogLevel:        "debug",
 		PrometheusEnabled:    true,
+		Tracing:              "jaeger",
 		InitialMasterToken:   "root",
 		EnterpriseEnabled:    true,
 		EnterpriseNamespaces: []string{"foo", "bar"},
+		ExposeEnabled:        true,
+		VaultEnabled:         true,
+		VaultImage:           "vault:1.5.0",
+		ACLPolicies: []*api.ACLPolicy{{
+			Name:        "operator-read",
+			Description: declaredACLDescription,
+			Rules:       `operator = "read"`,
+			Datacenters: []string{"dc1"},
+		}},
+		ACLRoles: []*api.ACLRole{{
+			Name:              "harness",
+			Description:       declaredACLDescription,
+			Policies:          []*api.ACLRolePolicyLink{{Name: "operator-read"}},
+			ServiceIdentities: []*api.ACLServiceIdentity{{ServiceName: "ping"}},
+		}},
+		ACLTokens: []*api.ACLToken{{
+			Description:       "config--teammate",
+			SecretID:          "7f2c2c3a-5a39-4ad4-bd3b-0e8ff2a53c3c",
+			Local:             true,
+			Policies:          []*api.ACLTokenPolicyLink{{Name: "operator-read"}},
+			Roles:             []*api.ACLTokenRoleLink{{Name: "harness"}},
+			ServiceIdentities: []*api.ACLServiceIdentity{{ServiceName: "pong"}},
+		}},
+		DisableDefaultIntentions: true,
+		Intentions: []*api.ServiceIntentionsConfigEntry{{
+			Kind:      api.ServiceIntentions,
+			Name:      "pong",
+			Namespace: "default",
+			Sources: []*api.SourceIntention{
+				{
+					Name:        "*",
+					Namespace:   "default",
+					Action:      api.IntentionActionDeny,
+					Description: "deny by default",
+				},
+				{
+					Name:      "ping",
+					Namespace: "default",
+					Permissions: []*api.IntentionPermission{{
+						Action: api.IntentionActionAllow,
+						HTTP: &api.IntentionHTTPPermission{
+							PathPrefix: "/api",
+							Methods:    []string{"GET", "HEAD"},
+							Header: []api.IntentionHTTPHeaderPermission{{
+								Name:    "x-debug",
+								Present: true,
+								Invert:  true,
+							}},
+						},
+					}},
+				},
+			},
+		}},
+		SeededKV: []*seededKV{
+			{Datacenter: "dc1", Key: "config/ping/greeting", Value: "hello"},
+			{Datacenter: "dc2", Key: "config/ping/greeting", Value: "hola"},
+		},
+		KVDir: "fixtures/kv",
+		SeededQueries: []*seededQuery{{
+			Datacenter: "dc1",
+			Query: &api.PreparedQueryDefinition{
+				Name: "pong",
+				Service: api.ServiceQuery{
+					Service:     "pong",
+					Tags:        []string{"v2"},
+					OnlyPassing: true,
+					Failover: api.QueryDatacenterOptions{
+						Datacenters: []string{"dc2"},
+					},
+				},
+			},
+		}},
 		ConfigEntries: []api.ConfigEntry{
 			&api.ProxyConfigEntry{
 				Kind: api.ProxyDefaults,
@@ -149,9 +306,11 @@ EOF
 		},
 	}, fc)
 
+	no := false
 	expectUCT := &userConfigTopology{
 		NetworkShape:        "islands",
 		DisableWANBootstrap: true,
+		TransparentProxy:    true,
 		Datacenter: []*userConfigTopologyDatacenter{
 			{Name: "dc1", Servers: 3, Clients: 2, MeshGateways: 1},
 			{Name: "dc2", Servers: 3, Clients: 2, MeshGateways: 1},
@@ -168,6 +327,7 @@ EOF
 				},
 				ServiceNamespace:            "bar",
 				UseBuiltinProxy:             true,
+				TransparentProxy:            &no,
 				Dead:                        true,
 				RetainInPrimaryGatewaysList: true,
 			},
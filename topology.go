@@ -140,6 +140,13 @@ func InferTopology(
 			if isGatewayClient {
 				node.MeshGateway = true
 
+				if len(nodeConfig.Checks) > 0 || len(nodeConfig.SidecarChecks) > 0 {
+					return fmt.Errorf("%s: mesh gateways cannot have service checks", nodeName)
+				}
+				if nodeConfig.TransparentProxy != nil && *nodeConfig.TransparentProxy {
+					return fmt.Errorf("%s: mesh gateways cannot use transparent_proxy", nodeName)
+				}
+
 				switch topology.NetworkShape {
 				case NetworkShapeIslands, NetworkShapeDual:
 					node.Addresses = append(node.Addresses, Address{
@@ -187,6 +194,29 @@ func InferTopology(
 					svc.UpstreamNamespace = nodeConfig.UpstreamNamespace
 				}
 
+				svc.TransparentProxy = uct.TransparentProxy
+				if nodeConfig.TransparentProxy != nil {
+					svc.TransparentProxy = *nodeConfig.TransparentProxy
+				}
+				if svc.TransparentProxy && node.UseBuiltinProxy {
+					return fmt.Errorf("%s: transparent_proxy cannot be used with use_builtin_proxy", nodeName)
+				}
+
+				var err error
+				svc.Checks, err = buildServiceChecks(nodeConfig.Checks, svc.Name, svc.Port, nodeName+"-"+svc.Name)
+				if err != nil {
+					return fmt.Errorf("%s: %v", nodeName, err)
+				}
+
+				sidecarContainer := nodeName + "-" + svc.Name + "-sidecar"
+				if node.UseBuiltinProxy {
+					sidecarContainer = "" // runs inside the consul container
+				}
+				svc.SidecarChecks, err = buildServiceChecks(nodeConfig.SidecarChecks, svc.Name, sidecarPublicPort, sidecarContainer)
+				if err != nil {
+					return fmt.Errorf("%s: sidecar: %v", nodeName, err)
+				}
+
 				node.Service = &svc
 			}
 
@@ -364,6 +394,11 @@ func (t *Topology) Node(name string) *Node {
 	return n
 }
 
+func (t *Topology) HasNode(name string) bool {
+	_, ok := t.nm[name]
+	return ok
+}
+
 func (t *Topology) Nodes() []*Node {
 	out := make([]*Node, 0, len(t.nm))
 	t.WalkSilent(func(n *Node) {
@@ -505,4 +540,14 @@ type Service struct {
 	UpstreamLocalPort  int
 	UpstreamExtraHCL   string
 	Meta               map[string]string
+
+	// TransparentProxy registers the sidecar in transparent mode and
+	// redirects all of the pod's traffic through it.
+	TransparentProxy bool
+
+	// Checks replaces the default health check. SidecarChecks are
+	// registered with the sidecar next to consul's default listening and
+	// alias checks, which have to be spelled out once any are set.
+	Checks        []*ServiceCheck
+	SidecarChecks []*ServiceCheck
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	jaegerImage = "jaegertracing/all-in-one:1.21"
+
+	// jaegerZipkinPort is where jaeger accepts spans in the zipkin formats,
+	// which is what envoy's built-in tracer speaks.
+	jaegerZipkinPort = 9411
+)
+
+// tracingAddresses returns where the jaeger container sits on each network
+// that has sidecars or gateways on it.
+func (c *Core) tracingAddresses() []Address {
+	return c.infraAddresses("10.0.100.102", "251")
+}
+
+// tracingProxyConfig returns the proxy-defaults config keys that point every
+// envoy at the jaeger collector.
+//
+// The collector is addressed by container name because proxy-defaults is
+// replicated to every datacenter, and jaeger has a different address on each
+// datacenter network when the network shape is not flat.
+func tracingProxyConfig(tracing string) (map[string]interface{}, error) {
+	zipkin := map[string]interface{}{
+		"@type":             "type.googleapis.com/envoy.config.trace.v3.ZipkinConfig",
+		"collector_cluster": "jaeger",
+	}
+	switch tracing {
+	case TracingZipkin:
+		zipkin["collector_endpoint"] = "/api/v2/spans"
+		zipkin["collector_endpoint_version"] = "HTTP_JSON"
+	case TracingJaeger:
+		// Jaeger does not support spans that are shared between the client
+		// and the server side of a request.
+		zipkin["collector_endpoint"] = "/api/v2/spans"
+		zipkin["collector_endpoint_version"] = "HTTP_PROTO"
+		zipkin["shared_span_context"] = false
+	default:
+		return nil, fmt.Errorf("unknown tracing provider: %q", tracing)
+	}
+
+	tracingJSON, err := json.Marshal(map[string]interface{}{
+		"http": map[string]interface{}{
+			"name":        "envoy.tracers.zipkin",
+			"typedConfig": zipkin,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Consul's own listener config only samples requests that already carry
+	// trace headers, which ping and pong never send. Consul 1.15+ lets the
+	// listener tracing be replaced, so sample every request instead. Older
+	// versions ignore the key.
+	listenerTracingJSON, err := json.Marshal(map[string]interface{}{
+		"@type": "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager.Tracing",
+		"provider": map[string]interface{}{
+			"name":         "envoy.tracers.zipkin",
+			"typed_config": zipkin,
+		},
+		"random_sampling": map[string]interface{}{
+			"value": 100,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	clusterJSON, err := json.Marshal(map[string]interface{}{
+		"name":              "jaeger",
+		"type":              "STRICT_DNS",
+		"connect_timeout":   "5s",
+		"dns_lookup_family": "V4_ONLY",
+		"lb_policy":         "ROUND_ROBIN",
+		"load_assignment": map[string]interface{}{
+			"cluster_name": "jaeger",
+			"endpoints": []interface{}{
+				map[string]interface{}{
+					"lb_endpoints": []interface{}{
+						map[string]interface{}{
+							"endpoint": map[string]interface{}{
+								"address": map[string]interface{}{
+									"socket_address": map[string]interface{}{
+										"address":    "jaeger",
+										"port_value": jaegerZipkinPort,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"envoy_tracing_json":               string(tracingJSON),
+		"envoy_listener_tracing_json":      string(listenerTracingJSON),
+		"envoy_extra_static_clusters_json": string(clusterJSON),
+	}, nil
+}
+
+// tracingServiceDefaults returns service-defaults entries that make every
+// topology service speak http, since envoy only emits spans for L7 traffic
+// and the stock services default to tcp. Services whose protocol is already
+// set in config_entries, directly or through proxy-defaults, are left alone.
+func (c *Core) tracingServiceDefaults() []api.ConfigEntry {
+	configured := make(map[string]struct{})
+	for _, entry := range c.config.ConfigEntries {
+		switch ce := entry.(type) {
+		case *api.ProxyConfigEntry:
+			if _, ok := ce.Config["protocol"]; ok {
+				return nil
+			}
+		case *api.ServiceConfigEntry:
+			configured[ce.Name] = struct{}{}
+		}
+	}
+
+	var out []api.ConfigEntry
+	seen := make(map[configServiceName]struct{})
+	for _, sn := range c.topologyServiceNames() {
+		if _, ok := seen[sn]; ok {
+			continue
+		}
+		seen[sn] = struct{}{}
+		if _, ok := configured[sn.Name]; ok {
+			continue
+		}
+		out = append(out, &api.ServiceConfigEntry{
+			Kind:      api.ServiceDefaults,
+			Name:      sn.Name,
+			Namespace: sn.Namespace,
+			Protocol:  "http",
+		})
+	}
+	return out
+}
+
+// warnUntracedGateways points out that mesh gateways will not show up in
+// jaeger. They route by SNI without terminating TLS, so Consul only ever gives
+// them tcp listeners, and envoy only traces http.
+func (c *Core) warnUntracedGateways() {
+	if c.config.Tracing == "" {
+		return
+	}
+	var gateways []string
+	c.topology.WalkSilent(func(n *Node) {
+		if n.MeshGateway {
+			gateways = append(gateways, n.Name)
+		}
+	})
+	if len(gateways) > 0 {
+		c.logger.Warn("mesh gateways do not emit spans; cross-datacenter requests are traced by the sidecars on either side",
+			"gateways", gateways)
+	}
+}
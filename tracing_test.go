@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDesiredConfigEntries_Tracing(t *testing.T) {
+	body := `
+		config_entries = [
+			<<EOF
+{
+	"Kind": "proxy-defaults",
+	"Name": "global",
+	"Config": {
+		"protocol": "http"
+	}
+}
+EOF
+		]
+		monitor {
+			prometheus = true
+			tracing    = "jaeger"
+		}
+	`
+	cfg, topo, err := parseConfig([]byte(body))
+	require.NoError(t, err)
+
+	c := &Core{config: cfg, topology: topo}
+
+	entries, err := c.desiredConfigEntries()
+	require.NoError(t, err)
+
+	var proxyDefaults *api.ProxyConfigEntry
+	for _, entry := range entries {
+		if entry.GetKind() == api.ProxyDefaults {
+			require.Nil(t, proxyDefaults, "only one proxy-defaults entry")
+			proxyDefaults = entry.(*api.ProxyConfigEntry)
+		}
+	}
+	require.NotNil(t, proxyDefaults)
+
+	require.Equal(t, "http", proxyDefaults.Config["protocol"])
+	require.Equal(t, "0.0.0.0:9102", proxyDefaults.Config["envoy_prometheus_bind_addr"])
+
+	var tracing struct {
+		HTTP struct {
+			Name        string
+			TypedConfig map[string]interface{}
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(proxyDefaults.Config["envoy_tracing_json"].(string)), &tracing))
+	require.Equal(t, "envoy.tracers.zipkin", tracing.HTTP.Name)
+	require.Equal(t, "jaeger", tracing.HTTP.TypedConfig["collector_cluster"])
+	require.Equal(t, false, tracing.HTTP.TypedConfig["shared_span_context"])
+
+	var listenerTracing struct {
+		Type     string `json:"@type"`
+		Provider struct {
+			Name        string
+			TypedConfig map[string]interface{} `json:"typed_config"`
+		}
+		RandomSampling struct {
+			Value float64
+		} `json:"random_sampling"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(proxyDefaults.Config["envoy_listener_tracing_json"].(string)), &listenerTracing))
+	require.Equal(t, "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager.Tracing", listenerTracing.Type)
+	require.Equal(t, "envoy.tracers.zipkin", listenerTracing.Provider.Name)
+	require.Equal(t, "jaeger", listenerTracing.Provider.TypedConfig["collector_cluster"])
+	require.Equal(t, float64(100), listenerTracing.RandomSampling.Value)
+
+	var cluster map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(proxyDefaults.Config["envoy_extra_static_clusters_json"].(string)), &cluster))
+	require.Equal(t, "jaeger", cluster["name"])
+}
+
+func TestDesiredConfigEntries_TracingProtocol(t *testing.T) {
+	serviceDefaults := func(body string) map[string]string {
+		cfg, topo, err := parseConfig([]byte(body))
+		require.NoError(t, err)
+
+		c := &Core{config: cfg, topology: topo}
+		entries, err := c.desiredConfigEntries()
+		require.NoError(t, err)
+
+		out := make(map[string]string)
+		for _, entry := range entries {
+			if sd, ok := entry.(*api.ServiceConfigEntry); ok {
+				out[sd.Name] = sd.Protocol
+			}
+		}
+		return out
+	}
+
+	require.Empty(t, serviceDefaults(``))
+
+	require.Equal(t, map[string]string{
+		"ping": "http",
+		"pong": "http",
+	}, serviceDefaults(`
+		monitor {
+			tracing = "jaeger"
+		}
+	`))
+
+	require.Equal(t, map[string]string{
+		"ping": "http",
+		"pong": "grpc",
+	}, serviceDefaults(`
+		config_entries = [
+			<<EOF
+{
+	"Kind": "service-defaults",
+	"Name": "pong",
+	"Protocol": "grpc"
+}
+EOF
+		]
+		monitor {
+			tracing = "zipkin"
+		}
+	`))
+}
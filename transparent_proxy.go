@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// publicDNSServer is what pods resolve names with when nothing in the pod
+	// needs consul DNS.
+	publicDNSServer = "8.8.8.8"
+
+	// consulAgentUID is the user the consul image drops to before starting the
+	// agent, whose traffic must never be redirected into envoy.
+	consulAgentUID = 100
+
+	// appUID is the user app containers run as when the sidecar is
+	// transparent. Only traffic from the proxy's own user (root) escapes the
+	// redirect, so the app cannot also run as root.
+	appUID = 5995
+)
+
+// ExplicitUpstream is true if the upstream has to be configured on the
+// sidecar with a local bind port. Virtual addresses only cover services in
+// the local datacenter and the default namespace, so everything else keeps
+// using an explicit upstream even when the sidecar is transparent.
+func (s *Service) ExplicitUpstream() bool {
+	return !s.TransparentProxy ||
+		s.UpstreamDatacenter != "" ||
+		s.UpstreamNamespace != "" ||
+		s.UpstreamExtraHCL != ""
+}
+
+// UpstreamDialAddress is where the app sends requests for its upstream.
+func (s *Service) UpstreamDialAddress() string {
+	if s.ExplicitUpstream() {
+		return "127.0.0.1:" + strconv.Itoa(s.UpstreamLocalPort)
+	}
+	// Every service listens on the same port, so the upstream does too.
+	return s.UpstreamName + ".virtual.consul:" + strconv.Itoa(s.Port)
+}
+
+func (n *Node) TransparentProxy() bool {
+	return n.Service != nil && n.Service.TransparentProxy
+}
+
+// DNSServer is the nameserver configured for the node's pod. Transparent
+// pods point at their own address, where the redirect rules hand DNS queries
+// to the local agent so that *.virtual.consul names resolve.
+func (n *Node) DNSServer() string {
+	if n.TransparentProxy() {
+		return n.LocalAddress()
+	}
+	return publicDNSServer
+}
+
+// redirectTrafficArgs returns the sidecar-boot.sh arguments that make it
+// install the transparent proxy redirect rules in the pod before starting
+// the proxy.
+func redirectTrafficArgs(node *Node) []string {
+	if !node.TransparentProxy() {
+		return nil
+	}
+
+	// Inbound traffic for everything the agent and the envoy admin and
+	// metrics listeners serve has to reach them directly.
+	excludeInbound := []int{8300, 8301, 8302, 8500, 8501, 8502, 8600, 9102, 19000}
+	ports := make([]string, 0, len(excludeInbound))
+	for _, p := range excludeInbound {
+		ports = append(ports, strconv.Itoa(p))
+	}
+
+	return []string{
+		"-T", node.Service.Name + "-sidecar-proxy",
+		"-D", node.LocalAddress(),
+		"-X", strconv.Itoa(consulAgentUID),
+		"-I", strings.Join(ports, ","),
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransparentProxy(t *testing.T) {
+	body := `
+		topology {
+			transparent_proxy = true
+			datacenter "dc1" {
+				servers = 1
+				clients = 3
+			}
+			datacenter "dc2" {
+				servers = 1
+				clients = 1
+			}
+			node "dc1-client2" {
+				upstream_datacenter = "dc2"
+			}
+			node "dc1-client3" {
+				transparent_proxy = false
+			}
+		}
+	`
+	cfg, topo, err := parseConfig([]byte(body))
+	require.NoError(t, err)
+
+	client1 := topo.Node("dc1-client1")
+	require.True(t, client1.TransparentProxy())
+	require.False(t, client1.Service.ExplicitUpstream())
+	require.Equal(t, "pong.virtual.consul:8080", client1.Service.UpstreamDialAddress())
+	require.Equal(t, "10.0.1.21", client1.DNSServer())
+
+	// Virtual addresses do not span datacenters.
+	client2 := topo.Node("dc1-client2")
+	require.True(t, client2.TransparentProxy())
+	require.True(t, client2.Service.ExplicitUpstream())
+	require.Equal(t, "127.0.0.1:9090", client2.Service.UpstreamDialAddress())
+
+	client3 := topo.Node("dc1-client3")
+	require.False(t, client3.TransparentProxy())
+	require.Equal(t, "127.0.0.1:9090", client3.Service.UpstreamDialAddress())
+	require.Equal(t, publicDNSServer, client3.DNSServer())
+	require.Nil(t, redirectTrafficArgs(client3))
+
+	c := &Core{config: cfg, topology: topo}
+	require.Equal(t, []string{
+		"/secrets/ready.val",
+		"envoy",
+		"direct",
+		"-t",
+		"/secrets/service-token--ping.val",
+		"-r",
+		"/secrets/servicereg__dc1-client1__ping.hcl",
+		"-T", "ping-sidecar-proxy",
+		"-D", "10.0.1.21",
+		"-X", "100",
+		"-I", "8300,8301,8302,8500,8501,8502,8600,9102,19000",
+	}, c.sidecarBootArgs(client1, false))
+	require.True(t, c.agentConfigInfo(client1).DNSRecursors)
+	require.False(t, c.agentConfigInfo(client3).DNSRecursors)
+
+	regHCL, err := GetServiceRegistrationHCL(*client1.Service)
+	require.NoError(t, err)
+	regHCL = strings.Join(strings.Fields(regHCL), " ")
+	require.Contains(t, regHCL, `proxy { mode = "transparent" }`)
+
+	regHCL, err = GetServiceRegistrationHCL(*client2.Service)
+	require.NoError(t, err)
+	regHCL = strings.Join(strings.Fields(regHCL), " ")
+	require.Contains(t, regHCL, `proxy { mode = "transparent" upstreams = [`)
+}
+
+func TestTransparentProxy_BuiltinProxy(t *testing.T) {
+	body := `
+		topology {
+			datacenter "dc1" {
+				servers = 1
+				clients = 1
+			}
+			node "dc1-client1" {
+				use_builtin_proxy = true
+				transparent_proxy = true
+			}
+		}
+	`
+	_, _, err := parseConfig([]byte(body))
+	require.Error(t, err)
+}
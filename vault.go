@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const (
+	vaultIP      = "10.0.100.101"
+	vaultAddress = "http://" + vaultIP + ":8200"
+
+	vaultRootPKIPath               = "connect-root"
+	vaultIntermediatePKIPathPrefix = "connect-intermediate-"
+	vaultConnectPolicyName         = "devconsul-connect-ca"
+)
+
+// vaultConnectPolicy is the minimum the consul vault CA provider needs to
+// manage its own PKI mounts. The root is matched as a prefix so that
+// 'devconsul ca rotate' can move it to a brand new mount.
+const vaultConnectPolicy = `
+path "/sys/mounts" {
+  capabilities = ["read"]
+}
+path "/sys/mounts/` + vaultRootPKIPath + `*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+path "/sys/mounts/` + vaultIntermediatePKIPathPrefix + `*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+path "/` + vaultRootPKIPath + `*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+path "/` + vaultIntermediatePKIPathPrefix + `*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+path "auth/token/renew-self" {
+  capabilities = ["update"]
+}
+path "auth/token/lookup-self" {
+  capabilities = ["read"]
+}
+`
+
+// initVault prepares the dev-mode vault server for use as the Connect CA. It
+// has to run before the servers can elect a leader, since they need the CA
+// to finish establishing leadership.
+func (c *Core) initVault() error {
+	if err := c.waitForVault(); err != nil {
+		return err
+	}
+
+	var mounts map[string]interface{}
+	if _, err := c.vaultRequest("GET", "sys/mounts", nil, &mounts); err != nil {
+		return fmt.Errorf("error listing vault mounts: %v", err)
+	}
+
+	paths := []string{vaultRootPKIPath}
+	for _, dc := range c.topology.Datacenters() {
+		paths = append(paths, vaultIntermediatePKIPathPrefix+dc.Name)
+	}
+	for _, path := range paths {
+		if _, ok := mounts[path+"/"]; ok {
+			continue
+		}
+		body := map[string]interface{}{
+			"type": "pki",
+			"config": map[string]interface{}{
+				"max_lease_ttl": "87600h",
+			},
+		}
+		if _, err := c.vaultRequest("POST", "sys/mounts/"+path, body, nil); err != nil {
+			return fmt.Errorf("error mounting vault pki at %q: %v", path, err)
+		}
+		c.logger.Info("mounted vault pki", "path", path)
+	}
+
+	body := map[string]interface{}{
+		"policy": vaultConnectPolicy,
+	}
+	if _, err := c.vaultRequest("PUT", "sys/policies/acl/"+vaultConnectPolicyName, body, nil); err != nil {
+		return fmt.Errorf("error writing vault policy: %v", err)
+	}
+
+	code, err := c.vaultRequest("POST", "auth/token/lookup", map[string]interface{}{
+		"token": c.config.VaultConnectToken,
+	}, nil)
+	if err == nil {
+		return nil // already created
+	} else if code != http.StatusForbidden && code != http.StatusBadRequest {
+		return fmt.Errorf("error looking up vault token: %v", err)
+	}
+
+	body = map[string]interface{}{
+		"id":           c.config.VaultConnectToken,
+		"policies":     []string{vaultConnectPolicyName},
+		"display_name": "consul-connect-ca",
+		"period":       "768h",
+	}
+	if _, err := c.vaultRequest("POST", "auth/token/create-orphan", body, nil); err != nil {
+		return fmt.Errorf("error creating vault token: %v", err)
+	}
+	c.logger.Info("created vault token for the connect ca")
+
+	return nil
+}
+
+func (c *Core) waitForVault() error {
+	return c.retryUntil("vault", func() (bool, error) {
+		_, err := c.vaultRequest("GET", "sys/health", nil, nil)
+		if err == nil {
+			c.logger.Info("vault is ready")
+			return true, nil
+		}
+		c.logger.Info("vault is not ready yet", "error", err)
+		return false, nil
+	})
+}
+
+// verifyVaultCA waits until every bootstrapped datacenter is using the vault
+// provider and can sign a leaf certificate with it.
+func (c *Core) verifyVaultCA() error {
+	for _, dc := range c.topology.Datacenters() {
+		client := c.clientForDC(dc.Name)
+		if client == nil {
+			continue // not bootstrapped
+		}
+
+		err := c.retryUntil("vault ca in "+dc.Name, func() (bool, error) {
+			conf, _, err := client.Connect().CAGetConfig(nil)
+			if err != nil {
+				c.logger.Warn("could not read ca configuration", "datacenter", dc.Name, "error", err)
+				return false, nil
+			}
+			if conf.Provider != "vault" {
+				return false, fmt.Errorf("datacenter %q is using the %q ca provider instead of vault", dc.Name, conf.Provider)
+			}
+
+			leaf, _, err := client.Agent().ConnectCALeaf("devconsul-ca-check", nil)
+			if err != nil {
+				c.logger.Warn("leaf certificate not issued yet", "datacenter", dc.Name, "error", err)
+				return false, nil
+			}
+
+			c.logger.Info("leaf certificate issued by vault ca",
+				"datacenter", dc.Name,
+				"serial", leaf.SerialNumber,
+			)
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vaultRequest makes a request against the vault HTTP API using the root
+// token, decoding the response into out if it is non-nil.
+func (c *Core) vaultRequest(method, path string, body, out interface{}) (int, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequest(method, vaultAddress+"/v1/"+path, &reqBody)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Vault-Token", c.config.VaultRootToken)
+
+	resp, err := cleanhttp.DefaultClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("unexpected response code %d: %s",
+			resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if out != nil && len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}